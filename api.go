@@ -0,0 +1,615 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"quizapp/database"
+	"quizapp/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// Page sizes for list endpoints. maxPage keeps the offset of the last
+// page well within range of the database's integers.
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+	maxPage        = 100000
+)
+
+// maxRequestBody bounds the JSON bodies the API accepts
+const maxRequestBody = 1 << 20
+
+type dataResponse struct {
+	Data interface{} `json:"data"`
+}
+
+type listResponse struct {
+	Data       interface{} `json:"data"`
+	Pagination pagination  `json:"pagination"`
+}
+
+type pagination struct {
+	Page    int `json:"page"`
+	PerPage int `json:"per_page"`
+	Total   int `json:"total"`
+}
+
+// attemptDetail is an attempt with the answers locked in so far
+type attemptDetail struct {
+	*database.Attempt
+	Answers []database.LockedAnswer `json:"answers"`
+}
+
+type quizInput struct {
+	Title string `json:"title"`
+	// Status defaults to draft
+	Status string `json:"status,omitempty"`
+	// TimeLimits default to database.DefaultTimeLimits
+	TimeLimits *database.TimeLimits `json:"time_limits,omitempty"`
+	// ScoringPolicy defaults to percentage
+	ScoringPolicy string              `json:"scoring_policy,omitempty"`
+	Questions     []database.Question `json:"questions"`
+}
+
+// quizUpdate changes the fields that are set
+type quizUpdate struct {
+	Title         *string              `json:"title,omitempty"`
+	Status        *string              `json:"status,omitempty"`
+	TimeLimits    *database.TimeLimits `json:"time_limits,omitempty"`
+	ScoringPolicy *string              `json:"scoring_policy,omitempty"`
+}
+
+type questionOrder struct {
+	QuestionIDs []int `json:"question_ids"`
+}
+
+// registerAPIRoutes mounts the versioned JSON API under /api/v1
+func registerAPIRoutes(r *mux.Router) {
+	api := r.PathPrefix("/api/v1").Subrouter()
+	read := func(h http.HandlerFunc) http.HandlerFunc { return middleware.RequireScope(database.ScopeRead, h) }
+	play := func(h http.HandlerFunc) http.HandlerFunc { return middleware.RequireScope(database.ScopePlay, h) }
+	write := func(h http.HandlerFunc) http.HandlerFunc { return middleware.RequireScope(database.ScopeWrite, h) }
+
+	api.HandleFunc("/me", read(apiGetMe)).Methods("GET")
+
+	api.HandleFunc("/quizzes", read(apiListQuizzes)).Methods("GET")
+	api.HandleFunc("/quizzes", write(middleware.RequireRole(database.RoleAuthor, apiCreateQuiz))).Methods("POST")
+	api.HandleFunc("/quizzes/{id:[0-9]+}", read(apiGetQuiz)).Methods("GET")
+	api.HandleFunc("/quizzes/{id:[0-9]+}", write(apiUpdateQuiz)).Methods("PUT")
+	api.HandleFunc("/quizzes/{id:[0-9]+}", write(apiDeleteQuiz)).Methods("DELETE")
+
+	api.HandleFunc("/quizzes/{id:[0-9]+}/questions", read(apiListQuestions)).Methods("GET")
+	api.HandleFunc("/quizzes/{id:[0-9]+}/questions", write(apiCreateQuestion)).Methods("POST")
+	api.HandleFunc("/quizzes/{id:[0-9]+}/questions/order", write(apiReorderQuestions)).Methods("PUT")
+	api.HandleFunc("/quizzes/{id:[0-9]+}/questions/{questionId:[0-9]+}", read(apiGetQuestion)).Methods("GET")
+	api.HandleFunc("/quizzes/{id:[0-9]+}/questions/{questionId:[0-9]+}", write(apiUpdateQuestion)).Methods("PUT")
+	api.HandleFunc("/quizzes/{id:[0-9]+}/questions/{questionId:[0-9]+}", write(apiDeleteQuestion)).Methods("DELETE")
+
+	api.HandleFunc("/quizzes/{id:[0-9]+}/attempts", play(apiStartAttempt)).Methods("POST")
+	api.HandleFunc("/attempts", read(apiListAttempts)).Methods("GET")
+	api.HandleFunc("/attempts/{id:[0-9]+}", read(apiGetAttempt)).Methods("GET")
+
+	api.HandleFunc("/results", read(apiListResults)).Methods("GET")
+	api.HandleFunc("/leaderboard", read(apiLeaderboard)).Methods("GET")
+
+	// Unmatched requests fall through to the root router, so API clients get
+	// their errors as JSON from there
+	r.NotFoundHandler = apiAwareError(http.StatusNotFound, "No such endpoint")
+	r.MethodNotAllowedHandler = apiAwareError(http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+// apiAwareError answers API requests with a JSON error and everything else
+// with plain text
+func apiAwareError(status int, message string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if middleware.IsAPIRequest(r) {
+			middleware.WriteJSONError(w, status, message)
+			return
+		}
+		http.Error(w, http.StatusText(status), status)
+	})
+}
+
+func apiGetMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := apiCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	middleware.WriteJSON(w, http.StatusOK, dataResponse{user})
+}
+
+func apiListQuizzes(w http.ResponseWriter, r *http.Request) {
+	user, ok := apiCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	page, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+	createdBy, ok := queryInt(w, r, "created_by")
+	if !ok {
+		return
+	}
+
+	quizzes, total, err := database.ListQuizzes(database.QuizFilter{
+		Search:    r.URL.Query().Get("q"),
+		CreatedBy: createdBy,
+		Viewer:    user,
+		Limit:     page.PerPage,
+		Offset:    (page.Page - 1) * page.PerPage,
+	})
+	if err != nil {
+		apiServerError(w, "Error listing quizzes", err)
+		return
+	}
+
+	page.Total = total
+	middleware.WriteJSON(w, http.StatusOK, listResponse{quizzes, page})
+}
+
+func apiCreateQuiz(w http.ResponseWriter, r *http.Request) {
+	userID, _ := middleware.UserID(r)
+
+	var input quizInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+
+	if input.Status == "" {
+		input.Status = database.QuizDraft
+	}
+	limits := database.DefaultTimeLimits
+	if input.TimeLimits != nil {
+		limits = *input.TimeLimits
+	}
+
+	quiz, err := database.CreateQuiz(database.Quiz{
+		Title:         input.Title,
+		CreatedBy:     userID,
+		Status:        input.Status,
+		TimeLimits:    limits,
+		ScoringPolicy: input.ScoringPolicy,
+		Questions:     input.Questions,
+	})
+	if err != nil {
+		apiSaveError(w, "Error creating quiz", err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/quizzes/%d", quiz.ID))
+	middleware.WriteJSON(w, http.StatusCreated, dataResponse{quiz})
+}
+
+// apiGetQuiz returns a quiz. Its questions and answers are only included
+// for users who may edit it; players get them by starting an attempt.
+func apiGetQuiz(w http.ResponseWriter, r *http.Request) {
+	quiz, user, ok := apiLoadQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	if user.CanEditQuiz(quiz) {
+		middleware.WriteJSON(w, http.StatusOK, dataResponse{quiz})
+		return
+	}
+
+	summary, err := database.GetQuizSummary(quiz.ID)
+	if err != nil {
+		apiServerError(w, "Error getting quiz", err)
+		return
+	}
+	middleware.WriteJSON(w, http.StatusOK, dataResponse{summary})
+}
+
+func apiUpdateQuiz(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := apiLoadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	var input quizUpdate
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+
+	updated := *quiz
+	if input.Title != nil {
+		updated.Title = *input.Title
+	}
+	if input.Status != nil {
+		updated.Status = *input.Status
+	}
+	if input.TimeLimits != nil {
+		updated.TimeLimits = *input.TimeLimits
+	}
+	if input.ScoringPolicy != nil {
+		updated.ScoringPolicy = *input.ScoringPolicy
+	}
+	if err := database.UpdateQuiz(&updated); err != nil {
+		apiSaveError(w, "Error updating quiz", err)
+		return
+	}
+
+	middleware.WriteJSON(w, http.StatusOK, dataResponse{updated})
+}
+
+func apiDeleteQuiz(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := apiLoadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	if err := database.DeleteQuiz(quiz.ID); err != nil {
+		apiServerError(w, "Error deleting quiz", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiListQuestions(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := apiLoadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+	questions := quiz.Questions
+	if questions == nil {
+		questions = []database.Question{}
+	}
+	middleware.WriteJSON(w, http.StatusOK, dataResponse{questions})
+}
+
+func apiCreateQuestion(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := apiLoadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	var question database.Question
+	if !decodeJSON(w, r, &question) {
+		return
+	}
+
+	if err := database.AddQuestion(quiz.ID, &question); err != nil {
+		apiSaveError(w, "Error adding question", err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/quizzes/%d/questions/%d", quiz.ID, question.ID))
+	middleware.WriteJSON(w, http.StatusCreated, dataResponse{question})
+}
+
+func apiGetQuestion(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := apiLoadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	question, ok := apiLoadQuestion(w, r, quiz)
+	if !ok {
+		return
+	}
+	middleware.WriteJSON(w, http.StatusOK, dataResponse{question})
+}
+
+func apiUpdateQuestion(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := apiLoadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	existing, ok := apiLoadQuestion(w, r, quiz)
+	if !ok {
+		return
+	}
+
+	var question database.Question
+	if !decodeJSON(w, r, &question) {
+		return
+	}
+	question.ID = existing.ID
+	question.QuizID = quiz.ID
+
+	if err := database.UpdateQuestion(&question); err != nil {
+		apiSaveError(w, "Error updating question", err)
+		return
+	}
+	middleware.WriteJSON(w, http.StatusOK, dataResponse{question})
+}
+
+func apiDeleteQuestion(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := apiLoadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	question, ok := apiLoadQuestion(w, r, quiz)
+	if !ok {
+		return
+	}
+
+	if err := database.DeleteQuestion(quiz.ID, question.ID); err != nil {
+		apiSaveError(w, "Error deleting question", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiReorderQuestions puts the questions of a quiz in the order given by
+// their IDs
+func apiReorderQuestions(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := apiLoadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	var order questionOrder
+	if !decodeJSON(w, r, &order) {
+		return
+	}
+
+	if err := database.ReorderQuestions(quiz.ID, order.QuestionIDs); err != nil {
+		apiSaveError(w, "Error reordering questions", err)
+		return
+	}
+
+	quiz, err := database.GetQuizWithQuestions(strconv.Itoa(quiz.ID))
+	if err != nil {
+		apiServerError(w, "Error getting quiz", err)
+		return
+	}
+	middleware.WriteJSON(w, http.StatusOK, dataResponse{quiz.Questions})
+}
+
+// apiStartAttempt starts an attempt and returns the quiz as the player sees
+// it, with its time limits and deadline. Questions are then fetched one at
+// a time from /api/next-question, answered through /api/check-answer and
+// the attempt finished with /api/submit-quiz.
+func apiStartAttempt(w http.ResponseWriter, r *http.Request) {
+	userID, _ := middleware.UserID(r)
+
+	quiz, err := database.GetQuizWithQuestions(mux.Vars(r)["id"])
+	if err != nil || !quiz.IsPublished() {
+		middleware.WriteJSONError(w, http.StatusNotFound, "Quiz not found")
+		return
+	}
+
+	attempt, err := database.StartAttempt(userID, quiz.ID)
+	if err != nil {
+		apiServerError(w, "Error starting attempt", err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/attempts/%d", attempt.ID))
+	middleware.WriteJSON(w, http.StatusCreated, dataResponse{quiz.ForPlayer(attempt)})
+}
+
+func apiListAttempts(w http.ResponseWriter, r *http.Request) {
+	userID, _ := middleware.UserID(r)
+
+	page, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+	quizID, ok := queryInt(w, r, "quiz_id")
+	if !ok {
+		return
+	}
+
+	attempts, total, err := database.ListUserAttempts(userID, quizID, page.PerPage, (page.Page-1)*page.PerPage)
+	if err != nil {
+		apiServerError(w, "Error listing attempts", err)
+		return
+	}
+
+	page.Total = total
+	middleware.WriteJSON(w, http.StatusOK, listResponse{attempts, page})
+}
+
+func apiGetAttempt(w http.ResponseWriter, r *http.Request) {
+	userID, _ := middleware.UserID(r)
+
+	attemptID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	attempt, err := database.GetAttempt(attemptID)
+	if err != nil || attempt.UserID != userID {
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			apiServerError(w, "Error getting attempt", err)
+			return
+		}
+		middleware.WriteJSONError(w, http.StatusNotFound, "Attempt not found")
+		return
+	}
+
+	answers, err := database.GetAttemptAnswers(attempt.ID)
+	if err != nil {
+		apiServerError(w, "Error getting attempt answers", err)
+		return
+	}
+
+	middleware.WriteJSON(w, http.StatusOK, dataResponse{attemptDetail{attempt, answers}})
+}
+
+// apiListResults returns the user's best score on every quiz
+func apiListResults(w http.ResponseWriter, r *http.Request) {
+	userID, _ := middleware.UserID(r)
+
+	page, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+	quizID, ok := queryInt(w, r, "quiz_id")
+	if !ok {
+		return
+	}
+
+	quizzes, err := database.GetUserQuizzes(userID)
+	if err != nil {
+		apiServerError(w, "Error getting results", err)
+		return
+	}
+
+	results := []database.QuizWithScore{}
+	for _, q := range quizzes {
+		if q.Rank > 0 && (quizID == 0 || q.ID == quizID) {
+			results = append(results, q)
+		}
+	}
+
+	page.Total = len(results)
+	start := min((page.Page-1)*page.PerPage, len(results))
+	end := min(start+page.PerPage, len(results))
+	middleware.WriteJSON(w, http.StatusOK, listResponse{results[start:end], page})
+}
+
+func apiLeaderboard(w http.ResponseWriter, r *http.Request) {
+	page, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+	quizID, ok := queryInt(w, r, "quiz_id")
+	if !ok {
+		return
+	}
+
+	entries, total, err := database.QueryLeaderboard(database.LeaderboardFilter{
+		QuizID: quizID,
+		Limit:  page.PerPage,
+		Offset: (page.Page - 1) * page.PerPage,
+	})
+	if err != nil {
+		apiServerError(w, "Error getting leaderboard", err)
+		return
+	}
+
+	page.Total = total
+	middleware.WriteJSON(w, http.StatusOK, listResponse{entries, page})
+}
+
+func apiCurrentUser(w http.ResponseWriter, r *http.Request) (*database.User, bool) {
+	userID, _ := middleware.UserID(r)
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		apiServerError(w, "Error getting user", err)
+		return nil, false
+	}
+	return user, true
+}
+
+// apiLoadQuiz loads the quiz named in the URL along with the current user.
+// Drafts are only found for users who may edit them.
+func apiLoadQuiz(w http.ResponseWriter, r *http.Request) (*database.Quiz, *database.User, bool) {
+	user, ok := apiCurrentUser(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	quiz, err := database.GetQuizWithQuestions(mux.Vars(r)["id"])
+	if err != nil || (!quiz.IsPublished() && !user.CanEditQuiz(quiz)) {
+		middleware.WriteJSONError(w, http.StatusNotFound, "Quiz not found")
+		return nil, nil, false
+	}
+	return quiz, user, true
+}
+
+// apiLoadEditableQuiz loads the quiz named in the URL if the current user
+// may edit it
+func apiLoadEditableQuiz(w http.ResponseWriter, r *http.Request) (*database.Quiz, bool) {
+	quiz, user, ok := apiLoadQuiz(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !user.CanEditQuiz(quiz) {
+		middleware.WriteJSONError(w, http.StatusForbidden, "Only the author of this quiz or an admin can do that")
+		return nil, false
+	}
+	return quiz, true
+}
+
+func apiLoadQuestion(w http.ResponseWriter, r *http.Request, quiz *database.Quiz) (*database.Question, bool) {
+	questionID, _ := strconv.Atoi(mux.Vars(r)["questionId"])
+	question, err := database.GetQuestion(quiz.ID, questionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			middleware.WriteJSONError(w, http.StatusNotFound, "Question not found")
+			return nil, false
+		}
+		apiServerError(w, "Error getting question", err)
+		return nil, false
+	}
+	return question, true
+}
+
+// parsePagination reads the page and per_page query parameters
+func parsePagination(w http.ResponseWriter, r *http.Request) (pagination, bool) {
+	p := pagination{Page: 1, PerPage: defaultPerPage}
+	page, ok := queryInt(w, r, "page")
+	if !ok {
+		return p, false
+	}
+	perPage, ok := queryInt(w, r, "per_page")
+	if !ok {
+		return p, false
+	}
+
+	if page > maxPage {
+		middleware.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("page must be at most %d", maxPage))
+		return p, false
+	}
+	if page > 0 {
+		p.Page = page
+	}
+	if perPage > 0 {
+		p.PerPage = min(perPage, maxPerPage)
+	}
+	return p, true
+}
+
+// queryInt reads an optional non-negative integer query parameter. A
+// missing parameter reads as zero.
+func queryInt(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		middleware.WriteJSONError(w, http.StatusBadRequest, name+" must be a non-negative integer")
+		return 0, false
+	}
+	return n, true
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// apiSaveError reports a failed change: rejected input as 422, a row that
+// has gone as 404 and anything else as a server error
+func apiSaveError(w http.ResponseWriter, context string, err error) {
+	switch {
+	case errors.Is(err, database.ErrInvalidQuiz):
+		middleware.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, sql.ErrNoRows):
+		middleware.WriteJSONError(w, http.StatusNotFound, "Not found")
+	default:
+		apiServerError(w, context, err)
+	}
+}
+
+func apiServerError(w http.ResponseWriter, context string, err error) {
+	log.Printf("%s: %v", context, err)
+	middleware.WriteJSONError(w, http.StatusInternalServerError, "Server error")
+}
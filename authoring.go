@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"quizapp/database"
+	"quizapp/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// authorQuizLimit caps how many quizzes the editor lists
+const authorQuizLimit = 100
+
+// questionTypeNames are how question types are shown to authors
+var questionTypeNames = map[string]string{
+	database.QuestionMultipleChoice: "Multiple choice",
+	database.QuestionTrueFalse:      "True/false",
+	database.QuestionMultiSelect:    "Multi-select",
+	database.QuestionFreeText:       "Free text",
+	database.QuestionNumeric:        "Numeric",
+	database.QuestionOrdering:       "Ordering",
+	database.QuestionMatching:       "Matching",
+}
+
+// scoringPolicies describes each scoring policy to authors and players
+var scoringPolicies = map[string]struct{ name, help string }{
+	database.ScoringPercentage: {"Percentage", "Every correct answer is worth 100 points."},
+	database.ScoringSpeedBonus: {"Speed bonus", "Correct answers are worth 100 points, plus up to 50 more the faster you answer."},
+	database.ScoringStreak:     {"Streak multiplier", "Correct answers are worth 100 points, multiplied by up to 3 for answering several in a row."},
+	database.ScoringNegative:   {"Negative marking", "Correct answers are worth 100 points and wrong ones cost 50. Skipping costs nothing."},
+}
+
+// handleAuthorQuizzes lists the quizzes the user can edit. Admins see every
+// quiz.
+func handleAuthorQuizzes(w http.ResponseWriter, r *http.Request) {
+	userID, _ := middleware.UserID(r)
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	filter := database.QuizFilter{CreatedBy: user.ID, Limit: authorQuizLimit}
+	if user.HasRole(database.RoleAdmin) {
+		filter.CreatedBy = 0
+	}
+	quizzes, _, err := database.ListQuizzes(filter)
+	if err != nil {
+		log.Printf("Error listing quizzes: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "author_quizzes.html", map[string]interface{}{
+		"Quizzes":   quizzes,
+		"IsAdmin":   user.HasRole(database.RoleAdmin),
+		"Error":     r.URL.Query().Get("error"),
+		"CSRFToken": middleware.CSRFToken(r),
+	}); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+}
+
+// handleCreateDraftQuiz starts an empty draft and opens it in the editor
+func handleCreateDraftQuiz(w http.ResponseWriter, r *http.Request) {
+	userID, _ := middleware.UserID(r)
+
+	quiz, err := database.CreateQuiz(database.Quiz{
+		Title:      r.FormValue("title"),
+		CreatedBy:  userID,
+		Status:     database.QuizDraft,
+		TimeLimits: database.DefaultTimeLimits,
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidQuiz) {
+			http.Redirect(w, r, "/admin/quizzes?error="+url.QueryEscape(invalidQuizReason(err)), http.StatusSeeOther)
+			return
+		}
+		log.Printf("Error creating quiz: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, editQuizURL(quiz.ID), http.StatusSeeOther)
+}
+
+func handleEditQuiz(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := loadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "edit_quiz.html", map[string]interface{}{
+		"Quiz":            quiz,
+		"ScoringPolicies": database.ScoringPolicies,
+		"QuestionTypes":   database.QuestionTypes,
+		"Error":           r.URL.Query().Get("error"),
+		"CSRFToken":       middleware.CSRFToken(r),
+	}); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+}
+
+func handleRenameQuiz(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := loadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+	finishEdit(w, r, quiz.ID, database.UpdateQuizTitle(quiz.ID, r.FormValue("title")))
+}
+
+// handleSetQuizTimeLimits saves the time limits of a quiz. Empty fields
+// mean no limit.
+func handleSetQuizTimeLimits(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := loadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	var limits database.TimeLimits
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{{"question_time_limit", &limits.Question}, {"time_limit", &limits.Quiz}} {
+		value := strings.TrimSpace(r.FormValue(field.name))
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			finishEdit(w, r, quiz.ID, fmt.Errorf("%w: time limits must be whole seconds", database.ErrInvalidQuiz))
+			return
+		}
+		*field.value = n
+	}
+	finishEdit(w, r, quiz.ID, database.SetQuizTimeLimits(quiz.ID, limits))
+}
+
+func handleSetScoringPolicy(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := loadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+	finishEdit(w, r, quiz.ID, database.SetScoringPolicy(quiz.ID, r.FormValue("scoring_policy")))
+}
+
+func handleSetQuizStatus(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := loadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+	finishEdit(w, r, quiz.ID, database.SetQuizStatus(quiz.ID, r.FormValue("status")))
+}
+
+func handleDeleteQuiz(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := loadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	if err := database.DeleteQuiz(quiz.ID); err != nil {
+		log.Printf("Error deleting quiz: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/quizzes", http.StatusSeeOther)
+}
+
+func handleAddQuestion(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := loadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	question := questionFromForm(r)
+	finishEdit(w, r, quiz.ID, database.AddQuestion(quiz.ID, &question))
+}
+
+func handleUpdateQuestion(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := loadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	question := questionFromForm(r)
+	question.ID, _ = strconv.Atoi(mux.Vars(r)["questionId"])
+	question.QuizID = quiz.ID
+	finishEdit(w, r, quiz.ID, database.UpdateQuestion(&question))
+}
+
+func handleDeleteQuestion(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := loadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	questionID, _ := strconv.Atoi(mux.Vars(r)["questionId"])
+	finishEdit(w, r, quiz.ID, database.DeleteQuestion(quiz.ID, questionID))
+}
+
+func handleMoveQuestion(w http.ResponseWriter, r *http.Request) {
+	quiz, ok := loadEditableQuiz(w, r)
+	if !ok {
+		return
+	}
+
+	offset := 1
+	if r.FormValue("direction") == "up" {
+		offset = -1
+	}
+	questionID, _ := strconv.Atoi(mux.Vars(r)["questionId"])
+	finishEdit(w, r, quiz.ID, database.MoveQuestion(quiz.ID, questionID, offset))
+}
+
+// loadEditableQuiz loads the quiz named in the URL if the current user may
+// edit it
+func loadEditableQuiz(w http.ResponseWriter, r *http.Request) (*database.Quiz, bool) {
+	userID, _ := middleware.UserID(r)
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	quiz, err := database.GetQuizWithQuestions(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Quiz not found", http.StatusNotFound)
+		return nil, false
+	}
+	if !user.CanEditQuiz(quiz) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return quiz, true
+}
+
+// questionFromForm reads a question from the editor. Options and correct
+// answers are entered one per line, and the options matching a correct
+// answer are marked correct. A free-text question takes its correct
+// answers as the answers it accepts and a numeric one its value, and a
+// true/false question without options gets True and False. The options of
+// a matching question are written "Option = Match".
+func questionFromForm(r *http.Request) database.Question {
+	q := database.Question{
+		Text: r.FormValue("text"),
+		Type: r.FormValue("type"),
+	}
+	correct := formLines(r.FormValue("answer"))
+
+	if tolerance := strings.TrimSpace(r.FormValue("tolerance")); tolerance != "" {
+		v, err := database.ParseNumber(tolerance)
+		if err != nil {
+			// Left for ValidateQuestion to reject
+			v = math.NaN()
+		}
+		q.Tolerance = v
+	}
+
+	lines := formLines(r.FormValue("options"))
+	switch {
+	case q.Type == database.QuestionFreeText || q.Type == database.QuestionNumeric:
+		lines = correct
+	case q.Type == database.QuestionTrueFalse && len(lines) == 0:
+		lines = []string{"True", "False"}
+	}
+	for _, line := range lines {
+		option := database.Option{Text: line, IsCorrect: slices.Contains(correct, line)}
+		if q.Type == database.QuestionMatching {
+			option.Text, option.Match, _ = strings.Cut(line, "=")
+		}
+		q.Options = append(q.Options, option)
+	}
+	return q
+}
+
+// formLines returns the non-blank lines of a form field, trimmed
+func formLines(value string) []string {
+	var lines []string
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// finishEdit sends the author back to the editor, showing why a change was
+// rejected if it was
+func finishEdit(w http.ResponseWriter, r *http.Request, quizID int, err error) {
+	switch {
+	case err == nil:
+		http.Redirect(w, r, editQuizURL(quizID), http.StatusSeeOther)
+	case errors.Is(err, database.ErrInvalidQuiz):
+		http.Redirect(w, r, editQuizURL(quizID)+"?error="+url.QueryEscape(invalidQuizReason(err)), http.StatusSeeOther)
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Question not found", http.StatusNotFound)
+	default:
+		log.Printf("Error editing quiz %d: %v", quizID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+}
+
+// invalidQuizReason turns a validation error into a message for the author
+func invalidQuizReason(err error) string {
+	msg := strings.Replace(err.Error(), database.ErrInvalidQuiz.Error()+": ", "", 1)
+	if msg == "" {
+		return msg
+	}
+	return strings.ToUpper(msg[:1]) + msg[1:]
+}
+
+func editQuizURL(quizID int) string {
+	return fmt.Sprintf("/admin/quizzes/%d/edit", quizID)
+}
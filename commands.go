@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"quizapp/database"
+)
+
+const usage = `Usage:
+  quizapp                            start the web server
+  quizapp set-role <username> <role> change a user's role (player, author, admin)
+  quizapp openapi                    print the OpenAPI document
+  quizapp migrate [up [version]]     apply pending migrations, up to version if given
+  quizapp migrate down [steps]       revert the last applied migration, or the last steps
+  quizapp migrate status             list migrations and when they were applied`
+
+// runCommand runs a maintenance command given on the command line instead
+// of starting the server
+func runCommand(args []string) error {
+	switch args[0] {
+	case "set-role":
+		if len(args) != 3 {
+			return fmt.Errorf("set-role takes a username and a role\n%s", usage)
+		}
+		if err := database.SetUserRole(args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Printf("User %s is now %s\n", args[1], args[2])
+		return nil
+	case "openapi":
+		out, err := json.MarshalIndent(buildOpenAPIDocument(), "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode OpenAPI document: %v", err)
+		}
+		fmt.Println(string(out))
+		return nil
+	case "migrate":
+		return runMigrate(args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func runMigrate(args []string) error {
+	action := "up"
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("migrate %s takes at most one number\n%s", action, usage)
+	}
+	n := 0
+	if len(args) == 1 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+			return fmt.Errorf("invalid number %q\n%s", args[0], usage)
+		}
+	}
+
+	switch action {
+	case "up":
+		applied, err := database.MigrateUp(n)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migrations\n", len(applied))
+		return nil
+	case "down":
+		if n == 0 {
+			n = 1
+		}
+		reverted, err := database.MigrateDown(n)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reverted %d migrations\n", len(reverted))
+		return nil
+	case "status":
+		statuses, err := database.GetMigrationStatus()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate action %q\n%s", action, usage)
+	}
+}
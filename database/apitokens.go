@@ -0,0 +1,196 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Scopes an API token can be granted
+const (
+	// ScopeRead allows reading quizzes, results and leaderboards
+	ScopeRead = "read"
+	// ScopePlay allows taking quizzes and submitting answers
+	ScopePlay = "play"
+	// ScopeWrite allows creating and changing quizzes
+	ScopeWrite = "write"
+)
+
+// Scopes lists every scope in the order they are shown to users
+var Scopes = []string{ScopeRead, ScopePlay, ScopeWrite}
+
+// apiTokenPrefix marks API tokens so they are easy to recognise in logs and
+// secret scanners
+const apiTokenPrefix = "qz_"
+
+// apiTokenTouchInterval limits how often last_used_at is written
+const apiTokenTouchInterval = time.Minute
+
+var ErrInvalidAPIToken = errors.New("invalid API token")
+
+// APIToken is a personal access token. Only its hash is stored.
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// HasScope reports whether the token was granted scope
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidScope reports whether scope is one of the known scopes
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIToken mints a token for a user. ttl of zero means the token
+// never expires. The returned secret is not stored and has to be shown to
+// the user now.
+func CreateAPIToken(userID int, name string, scopes []string, ttl time.Duration) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("token name is required")
+	}
+	if len(scopes) == 0 {
+		return "", fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !ValidScope(scope) {
+			return "", fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now().UTC()
+	var expiresAt *time.Time
+	if ttl > 0 {
+		t := now.Add(ttl)
+		expiresAt = &t
+	}
+
+	_, err := DB.Exec(`
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, userID, name, hashAPIToken(secret), strings.Join(scopes, " "), now, expiresAt)
+	if err != nil {
+		return "", fmt.Errorf("failed to store API token: %v", err)
+	}
+	return secret, nil
+}
+
+// AuthenticateAPIToken looks up an unexpired token by its secret and
+// records that it was used
+func AuthenticateAPIToken(secret string) (*APIToken, error) {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return nil, ErrInvalidAPIToken
+	}
+
+	now := time.Now().UTC()
+	t, err := scanAPIToken(DB.QueryRow(`
+		SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at
+		FROM api_tokens
+		WHERE token_hash = ? AND (expires_at IS NULL OR expires_at > ?)
+	`, hashAPIToken(secret), now))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API token: %v", err)
+	}
+
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > apiTokenTouchInterval {
+		if _, err := DB.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, now, t.ID); err != nil {
+			return nil, fmt.Errorf("failed to update API token: %v", err)
+		}
+		t.LastUsedAt = &now
+	}
+	return t, nil
+}
+
+// GetUserAPITokens lists the tokens of a user, newest first
+func GetUserAPITokens(userID int) ([]APIToken, error) {
+	rows, err := DB.Query(`
+		SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at
+		FROM api_tokens
+		WHERE user_id = ?
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API tokens: %v", err)
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API token: %v", err)
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken deletes a token of a user
+func RevokeAPIToken(userID, tokenID int) error {
+	result, err := DB.Exec(`DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, tokenID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API token: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIToken(row rowScanner) (*APIToken, error) {
+	var t APIToken
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	if err := row.Scan(&t.ID, &t.UserID, &t.Name, &scopes, &t.CreatedAt, &expiresAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	t.Scopes = strings.Fields(scopes)
+	if expiresAt.Valid {
+		t.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		t.LastUsedAt = &lastUsedAt.Time
+	}
+	return &t, nil
+}
+
+func hashAPIToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,559 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+var (
+	ErrAttemptSubmitted  = errors.New("attempt already submitted")
+	ErrAnswerLocked      = errors.New("answer already locked in")
+	ErrQuestionNotServed = errors.New("question not served yet")
+)
+
+// States an attempt goes through. An attempt whose time limit has run out
+// is expired until it is submitted.
+const (
+	AttemptInProgress = "in_progress"
+	AttemptExpired    = "expired"
+	AttemptSubmitted  = "submitted"
+)
+
+// answerGrace is how late an answer may arrive and still count, to allow
+// for the time it spends in transit
+const answerGrace = 2 * time.Second
+
+type Attempt struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	QuizID      int        `json:"quiz_id"`
+	Status      string     `json:"status"`
+	StartedAt   time.Time  `json:"started_at"`
+	SubmittedAt *time.Time `json:"submitted_at,omitempty"`
+	// TimeLimits and ScoringPolicy are the quiz's as they were when the
+	// attempt started
+	TimeLimits    TimeLimits `json:"time_limits"`
+	ScoringPolicy string     `json:"scoring_policy"`
+	// Deadline is when the attempt runs out of time, if the quiz has a limit
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Score is the percentage of questions answered correctly and Points
+	// what the answers were worth under the scoring policy. Both are set
+	// once the attempt is submitted.
+	Score  *float64 `json:"score,omitempty"`
+	Points *float64 `json:"points,omitempty"`
+	// Seed drives the option order shown during this attempt
+	Seed int64 `json:"-"`
+}
+
+// LockedAnswer is an answer that has been locked in for a question of an
+// attempt and can no longer be changed. Response is the answer as the
+// player sent it, in the JSON form the question's type takes, and is empty
+// for a skipped question. OptionID is set for the types answered with a
+// single option. Answer keeps what the player answered as it read at the
+// time. Credit is the share of the question's points the answer earned,
+// and IsCorrect is set when that is all of them. TimeTakenMS is how long
+// the player took over the question, counted from when it was served; it
+// is unknown for answers recorded before questions were served one at a
+// time. A timed out answer arrived after the question's time ran out and
+// is never correct.
+type LockedAnswer struct {
+	QuestionID  int             `json:"question_id"`
+	Response    json.RawMessage `json:"response,omitempty"`
+	OptionID    int             `json:"option_id"`
+	Answer      string          `json:"answer"`
+	Credit      float64         `json:"credit"`
+	IsCorrect   bool            `json:"is_correct"`
+	TimeTakenMS *int            `json:"time_taken_ms,omitempty"`
+	TimedOut    bool            `json:"timed_out,omitempty"`
+}
+
+// Answered reports whether the player gave an answer rather than skipping
+// the question
+func (a *LockedAnswer) Answered() bool {
+	return len(a.Response) > 0
+}
+
+// ServedQuestion records when a question of an attempt was sent to the
+// player and when its time runs out. Number counts from one.
+type ServedQuestion struct {
+	QuestionID int
+	Number     int
+	ServedAt   time.Time
+	ExpiresAt  *time.Time
+}
+
+// ForPlayer describes an attempt at a quiz to the player taking it
+func (q *Quiz) ForPlayer(attempt *Attempt) *PlayerQuiz {
+	return &PlayerQuiz{
+		ID:            q.ID,
+		Title:         q.Title,
+		AttemptID:     attempt.ID,
+		QuestionCount: len(q.Questions),
+		TimeLimits:    attempt.TimeLimits,
+		ScoringPolicy: attempt.ScoringPolicy,
+		Deadline:      attempt.Deadline,
+	}
+}
+
+// ForPlayer strips the correct answer from a question
+func (q *Question) ForPlayer() PlayerQuestion {
+	return PlayerQuestion{
+		ID:       q.ID,
+		Text:     q.Text,
+		Type:     q.Type,
+		Options:  q.PlayerOptions(),
+		Matches:  q.PlayerMatches(),
+		ImageURL: q.ImageURL,
+		Context:  q.Context,
+	}
+}
+
+// setTiming fills in the deadline and state of an attempt read from the
+// database
+func (a *Attempt) setTiming(now time.Time) {
+	if a.TimeLimits.Quiz > 0 {
+		deadline := a.StartedAt.Add(time.Duration(a.TimeLimits.Quiz) * time.Second)
+		a.Deadline = &deadline
+	}
+	switch {
+	case a.SubmittedAt != nil:
+		a.Status = AttemptSubmitted
+	case a.Deadline != nil && now.After(*a.Deadline):
+		a.Status = AttemptExpired
+	default:
+		a.Status = AttemptInProgress
+	}
+}
+
+// QuestionExpiresAt returns when time runs out for a question served at
+// servedAt: the end of its own time limit or of the attempt's, whichever
+// comes first. It is nil if neither applies.
+func (a *Attempt) QuestionExpiresAt(servedAt time.Time) *time.Time {
+	var expires *time.Time
+	if a.TimeLimits.Question > 0 {
+		end := servedAt.Add(time.Duration(a.TimeLimits.Question) * time.Second)
+		expires = &end
+	}
+	if a.Deadline != nil && (expires == nil || a.Deadline.Before(*expires)) {
+		expires = a.Deadline
+	}
+	return expires
+}
+
+// TimedOut reports whether an answer received at answeredAt, for a question
+// served at servedAt, came too late to count
+func (a *Attempt) TimedOut(servedAt, answeredAt time.Time) bool {
+	expires := a.QuestionExpiresAt(servedAt)
+	return expires != nil && answeredAt.After(expires.Add(answerGrace))
+}
+
+// StartAttempt records that a user started taking a quiz, under the quiz's
+// current time limits and scoring policy. Each attempt gets its own random
+// seed so players see the options in different orders.
+func StartAttempt(userID, quizID int) (*Attempt, error) {
+	var limits TimeLimits
+	var policy string
+	err := DB.QueryRow(`
+		SELECT question_time_limit, time_limit, scoring_policy FROM quizzes WHERE id = ?
+	`, quizID).Scan(&limits.Question, &limits.Quiz, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quiz rules: %w", err)
+	}
+
+	seed := rand.Int63()
+	id, err := insertID(DB, `
+		INSERT INTO attempts (user_id, quiz_id, seed, started_at, question_time_limit, time_limit, scoring_policy)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, userID, quizID, seed, time.Now().UTC(), limits.Question, limits.Quiz, policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start attempt: %v", err)
+	}
+	return GetAttempt(id)
+}
+
+// GetAttempt retrieves an attempt by ID
+func GetAttempt(attemptID int) (*Attempt, error) {
+	var attempt Attempt
+	var submittedAt sql.NullTime
+	var score, points sql.NullFloat64
+	err := DB.QueryRow(`
+		SELECT id, user_id, quiz_id, started_at, submitted_at, question_time_limit, time_limit,
+			scoring_policy, score, points, seed
+		FROM attempts
+		WHERE id = ?
+	`, attemptID).Scan(&attempt.ID, &attempt.UserID, &attempt.QuizID, &attempt.StartedAt, &submittedAt,
+		&attempt.TimeLimits.Question, &attempt.TimeLimits.Quiz, &attempt.ScoringPolicy, &score, &points, &attempt.Seed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attempt: %w", err)
+	}
+	if submittedAt.Valid {
+		attempt.SubmittedAt = &submittedAt.Time
+	}
+	if score.Valid {
+		attempt.Score = &score.Float64
+	}
+	if points.Valid {
+		attempt.Points = &points.Float64
+	}
+	attempt.setTiming(time.Now())
+	return &attempt, nil
+}
+
+// NextQuestion serves the first of questionIDs the player has not answered
+// yet and records when it was served. A question already served is served
+// again with its original time, so reloading does not reset the clock;
+// once its time has run out it is locked in as timed out and skipped. It
+// returns nil when every question is answered or the attempt has expired.
+func NextQuestion(attempt *Attempt, questionIDs []int) (*ServedQuestion, error) {
+	if attempt.SubmittedAt != nil {
+		return nil, ErrAttemptSubmitted
+	}
+	now := time.Now().UTC()
+	if attempt.Deadline != nil && now.After(*attempt.Deadline) {
+		return nil, nil
+	}
+
+	answers, err := GetAttemptAnswers(attempt.ID)
+	if err != nil {
+		return nil, err
+	}
+	answered := make(map[int]bool, len(answers))
+	for _, a := range answers {
+		answered[a.QuestionID] = true
+	}
+	served, err := GetServedQuestions(attempt.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, questionID := range questionIDs {
+		if answered[questionID] {
+			continue
+		}
+		servedAt, ok := served[questionID]
+		if !ok {
+			servedAt = now
+			if _, err := DB.Exec(`
+				INSERT INTO attempt_questions (attempt_id, question_id, served_at)
+				VALUES (?, ?, ?)
+				ON CONFLICT(attempt_id, question_id) DO NOTHING
+			`, attempt.ID, questionID, servedAt); err != nil {
+				return nil, fmt.Errorf("failed to serve question: %v", err)
+			}
+			if err := DB.QueryRow(`
+				SELECT served_at FROM attempt_questions WHERE attempt_id = ? AND question_id = ?
+			`, attempt.ID, questionID).Scan(&servedAt); err != nil {
+				return nil, fmt.Errorf("failed to serve question: %v", err)
+			}
+		} else if attempt.TimedOut(servedAt, now) {
+			timeTaken := int(attempt.QuestionExpiresAt(servedAt).Sub(servedAt).Milliseconds())
+			skipped := LockedAnswer{QuestionID: questionID, TimeTakenMS: &timeTaken, TimedOut: true}
+			if err := insertAnswer(DB, attempt.ID, skipped, true); err != nil {
+				return nil, fmt.Errorf("failed to lock timed out answer: %v", err)
+			}
+			continue
+		}
+		return &ServedQuestion{
+			QuestionID: questionID,
+			Number:     i + 1,
+			ServedAt:   servedAt,
+			ExpiresAt:  attempt.QuestionExpiresAt(servedAt),
+		}, nil
+	}
+	return nil, nil
+}
+
+// GetServedQuestions returns when each question served so far in an
+// attempt was served, keyed by question ID
+func GetServedQuestions(attemptID int) (map[int]time.Time, error) {
+	rows, err := DB.Query(`
+		SELECT question_id, served_at FROM attempt_questions WHERE attempt_id = ?
+	`, attemptID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get served questions: %v", err)
+	}
+	defer rows.Close()
+
+	served := make(map[int]time.Time)
+	for rows.Next() {
+		var questionID int
+		var servedAt time.Time
+		if err := rows.Scan(&questionID, &servedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan served question: %v", err)
+		}
+		served[questionID] = servedAt
+	}
+	return served, rows.Err()
+}
+
+// LockAnswer locks in the answer to a question of an attempt. The question
+// must have been served; an answer arriving after its time ran out is
+// locked in as timed out and earns nothing. Locking the same response
+// again is a no-op; locking a different one fails with ErrAnswerLocked.
+func LockAnswer(attempt *Attempt, answer LockedAnswer) (*LockedAnswer, error) {
+	now := time.Now().UTC()
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var submittedAt sql.NullTime
+	err = tx.QueryRow(`SELECT submitted_at FROM attempts WHERE id = ?`, attempt.ID).Scan(&submittedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attempt: %w", err)
+	}
+	if submittedAt.Valid {
+		return nil, ErrAttemptSubmitted
+	}
+
+	locked := LockedAnswer{QuestionID: answer.QuestionID}
+	var optionID sql.NullInt64
+	var response string
+	err = tx.QueryRow(`
+		SELECT response, option_id, answer, credit, is_correct, timed_out
+		FROM attempt_answers
+		WHERE attempt_id = ? AND question_id = ?
+	`, attempt.ID, answer.QuestionID).Scan(&response, &optionID, &locked.Answer, &locked.Credit, &locked.IsCorrect, &locked.TimedOut)
+	switch {
+	case err == nil:
+		locked.OptionID = int(optionID.Int64)
+		if response != "" {
+			locked.Response = json.RawMessage(response)
+		}
+		if response != string(answer.Response) {
+			return &locked, ErrAnswerLocked
+		}
+		return &locked, nil
+	case err != sql.ErrNoRows:
+		return nil, fmt.Errorf("failed to get locked answer: %v", err)
+	}
+
+	var servedAt time.Time
+	err = tx.QueryRow(`
+		SELECT served_at FROM attempt_questions WHERE attempt_id = ? AND question_id = ?
+	`, attempt.ID, answer.QuestionID).Scan(&servedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrQuestionNotServed
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get served question: %v", err)
+	}
+
+	timeTaken := int(now.Sub(servedAt).Milliseconds())
+	answer.TimeTakenMS = &timeTaken
+	if attempt.TimedOut(servedAt, now) {
+		answer.TimedOut = true
+		answer.IsCorrect = false
+		answer.Credit = 0
+	}
+
+	if err := insertAnswer(tx, attempt.ID, answer, false); err != nil {
+		return nil, fmt.Errorf("failed to lock answer: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return &answer, nil
+}
+
+// SubmitAttempt locks in any remaining answers and marks the attempt as
+// submitted with its score and points. An attempt can only be submitted
+// once.
+func SubmitAttempt(attemptID int, answers []LockedAnswer, score, points float64) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE attempts
+		SET submitted_at = ?, score = ?, points = ?
+		WHERE id = ? AND submitted_at IS NULL
+	`, time.Now().UTC(), score, points, attemptID)
+	if err != nil {
+		return fmt.Errorf("failed to submit attempt: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to submit attempt: %v", err)
+	} else if n == 0 {
+		return ErrAttemptSubmitted
+	}
+
+	for _, a := range answers {
+		if err := insertAnswer(tx, attemptID, a, true); err != nil {
+			return fmt.Errorf("failed to save answer: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// AttemptSummary is an attempt with how many of its answers were correct
+type AttemptSummary struct {
+	Attempt
+	QuizTitle string `json:"quiz_title"`
+	Answered  int    `json:"answered"`
+	Correct   int    `json:"correct"`
+}
+
+// ListUserAttempts returns one page of a user's attempts, newest first, and
+// the total number of attempts. quizID of zero lists attempts at any quiz.
+func ListUserAttempts(userID, quizID, limit, offset int) ([]AttemptSummary, int, error) {
+	cond := "a.user_id = ?"
+	args := []interface{}{userID}
+	if quizID != 0 {
+		cond += " AND a.quiz_id = ?"
+		args = append(args, quizID)
+	}
+
+	var total int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM attempts a WHERE `+cond, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count attempts: %v", err)
+	}
+
+	rows, err := DB.Query(`
+		SELECT a.id, a.user_id, a.quiz_id, a.started_at, a.submitted_at,
+			a.question_time_limit, a.time_limit, a.scoring_policy, a.score, a.points, q.title,
+			COUNT(aa.id), COALESCE(SUM(CASE WHEN aa.is_correct THEN 1 ELSE 0 END), 0)
+		FROM attempts a
+		JOIN quizzes q ON q.id = a.quiz_id
+		LEFT JOIN attempt_answers aa ON aa.attempt_id = a.id
+		WHERE `+cond+`
+		GROUP BY a.id, q.title
+		ORDER BY a.started_at DESC, a.id DESC
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list attempts: %v", err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	attempts := []AttemptSummary{}
+	for rows.Next() {
+		var a AttemptSummary
+		var submittedAt sql.NullTime
+		var score, points sql.NullFloat64
+		if err := rows.Scan(&a.ID, &a.UserID, &a.QuizID, &a.StartedAt, &submittedAt,
+			&a.TimeLimits.Question, &a.TimeLimits.Quiz, &a.ScoringPolicy, &score, &points,
+			&a.QuizTitle, &a.Answered, &a.Correct); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan attempt: %v", err)
+		}
+		if submittedAt.Valid {
+			a.SubmittedAt = &submittedAt.Time
+		}
+		if score.Valid {
+			a.Score = &score.Float64
+		}
+		if points.Valid {
+			a.Points = &points.Float64
+		}
+		a.setTiming(now)
+		attempts = append(attempts, a)
+	}
+	return attempts, total, rows.Err()
+}
+
+// QuizHistory sums up a user's submitted attempts at one quiz
+type QuizHistory struct {
+	QuizID       int     `json:"quiz_id"`
+	QuizTitle    string  `json:"quiz_title"`
+	Attempts     int     `json:"attempts"`
+	BestScore    float64 `json:"best_score"`
+	LatestScore  float64 `json:"latest_score"`
+	AverageScore float64 `json:"average_score"`
+	BestPoints   float64 `json:"best_points"`
+	Rank         int     `json:"rank"`
+}
+
+// GetUserQuizHistory returns the quizzes a user has submitted attempts at,
+// most recently played first. Rank is the rank of the best points among
+// all players of the quiz.
+func GetUserQuizHistory(userID int) ([]QuizHistory, error) {
+	rows, err := DB.Query(`
+		SELECT a.quiz_id, q.title, COUNT(*), MAX(a.score), AVG(a.score), COALESCE(MAX(a.points), 0),
+			(SELECT latest.score FROM attempts latest
+			 WHERE latest.user_id = a.user_id AND latest.quiz_id = a.quiz_id AND latest.score IS NOT NULL
+			 ORDER BY latest.submitted_at DESC, latest.id DESC
+			 LIMIT 1),
+			(SELECT COUNT(*) + 1 FROM best_scores other
+			 WHERE other.quiz_id = a.quiz_id AND other.points > MAX(a.points))
+		FROM attempts a
+		JOIN quizzes q ON q.id = a.quiz_id
+		WHERE a.user_id = ? AND a.score IS NOT NULL
+		GROUP BY a.user_id, a.quiz_id, q.title
+		ORDER BY MAX(a.submitted_at) DESC
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quiz history: %v", err)
+	}
+	defer rows.Close()
+
+	history := []QuizHistory{}
+	for rows.Next() {
+		var h QuizHistory
+		if err := rows.Scan(&h.QuizID, &h.QuizTitle, &h.Attempts, &h.BestScore, &h.AverageScore, &h.BestPoints, &h.LatestScore, &h.Rank); err != nil {
+			return nil, fmt.Errorf("failed to scan quiz history: %v", err)
+		}
+		history = append(history, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get quiz history: %v", err)
+	}
+	return history, nil
+}
+
+// GetAttemptAnswers returns the answers locked in for an attempt in the
+// order they were given
+func GetAttemptAnswers(attemptID int) ([]LockedAnswer, error) {
+	rows, err := DB.Query(`
+		SELECT question_id, response, COALESCE(option_id, 0), answer, credit, is_correct, time_taken_ms, timed_out
+		FROM attempt_answers
+		WHERE attempt_id = ?
+		ORDER BY answered_at, id
+	`, attemptID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attempt answers: %v", err)
+	}
+	defer rows.Close()
+
+	answers := []LockedAnswer{}
+	for rows.Next() {
+		var a LockedAnswer
+		var response string
+		if err := rows.Scan(&a.QuestionID, &response, &a.OptionID, &a.Answer, &a.Credit, &a.IsCorrect, &a.TimeTakenMS, &a.TimedOut); err != nil {
+			return nil, fmt.Errorf("failed to scan attempt answer: %v", err)
+		}
+		if response != "" {
+			a.Response = json.RawMessage(response)
+		}
+		answers = append(answers, a)
+	}
+	return answers, rows.Err()
+}
+
+// insertAnswer stores a locked answer. With keepExisting an answer already
+// locked in for the question is left alone instead of failing.
+func insertAnswer(db execer, attemptID int, a LockedAnswer, keepExisting bool) error {
+	var optionID interface{}
+	if a.OptionID != 0 {
+		optionID = a.OptionID
+	}
+	query := `
+		INSERT INTO attempt_answers (attempt_id, question_id, response, option_id, answer, credit, is_correct, time_taken_ms, timed_out, answered_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if keepExisting {
+		query += ` ON CONFLICT(attempt_id, question_id) DO NOTHING`
+	}
+	_, err := db.Exec(query, attemptID, a.QuestionID, string(a.Response), optionID, a.Answer, a.Credit, a.IsCorrect, a.TimeTakenMS, a.TimedOut, time.Now().UTC())
+	return err
+}
@@ -0,0 +1,727 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The tests below run the data layer through signing up, authoring,
+// playing and ranking. Each starts from an empty database and creates the
+// users and quizzes it needs with the helpers here.
+
+func createTestUser(t *testing.T, name string) *User {
+	t.Helper()
+	if err := CreateUser(name, name+"@example.com", "password123"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := GetUserByEmail(name + "@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// sampleQuestions are two multiple choice questions whose second option
+// is the correct one for the first and the wrong one for the second
+func sampleQuestions() []Question {
+	return []Question{
+		{Text: "2 + 2?", Options: []Option{{Text: "3"}, {Text: "4", IsCorrect: true}}},
+		{Text: "Capital of France?", Options: []Option{{Text: "Paris", IsCorrect: true}, {Text: "Rome"}}},
+	}
+}
+
+// createTestQuiz publishes a quiz by author with the given questions and
+// returns it as loaded back
+func createTestQuiz(t *testing.T, author *User, title string, questions []Question) *Quiz {
+	t.Helper()
+	created, err := CreateQuiz(Quiz{
+		Title:      title,
+		CreatedBy:  author.ID,
+		Status:     QuizPublished,
+		TimeLimits: DefaultTimeLimits,
+		Questions:  questions,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiz, err := GetQuizWithQuestions(strconv.Itoa(created.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return quiz
+}
+
+// submitTestAttempt starts an attempt and submits it with the given score
+// and points but no answers
+func submitTestAttempt(t *testing.T, user *User, quiz *Quiz, score, points float64) *Attempt {
+	t.Helper()
+	attempt, err := StartAttempt(user.ID, quiz.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SubmitAttempt(attempt.ID, nil, score, points); err != nil {
+		t.Fatal(err)
+	}
+	return attempt
+}
+
+func questionIDs(quiz *Quiz) []int {
+	ids := make([]int, len(quiz.Questions))
+	for i, q := range quiz.Questions {
+		ids[i] = q.ID
+	}
+	return ids
+}
+
+func TestUsers(t *testing.T) {
+	forEachMigratedDialect(t, testUsers)
+}
+
+func testUsers(t *testing.T) {
+	for _, name := range []string{"alice", "bob"} {
+		if err := CreateUser(name, name+"@example.com", "password123"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CreateUser("alice", "other@example.com", "password123"); err == nil {
+		t.Fatal("duplicate username was accepted")
+	}
+
+	if _, err := AuthenticateUser("alice", "password123"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetUserByEmail("BOB@example.com"); err != nil {
+		t.Fatalf("email lookup is not case-insensitive: %v", err)
+	}
+}
+
+func TestQuizzes(t *testing.T) {
+	forEachMigratedDialect(t, testQuizzes)
+}
+
+func testQuizzes(t *testing.T) {
+	alice := createTestUser(t, "alice")
+	createTestQuiz(t, alice, "History", []Question{sampleQuestions()[1]})
+	quiz := createTestQuiz(t, alice, "Self Test Quiz", sampleQuestions())
+
+	quizzes, total, err := ListQuizzes(QuizFilter{Search: "self test", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(quizzes) != 1 || quizzes[0].ID != quiz.ID || quizzes[0].QuestionCount != 2 {
+		t.Fatalf("search found %d quizzes, want the one created", total)
+	}
+
+	for _, q := range quiz.Questions {
+		if len(q.Options) != 2 || q.CorrectOption() == nil {
+			t.Fatalf("question %d lost its options", q.ID)
+		}
+		if q.Type != QuestionMultipleChoice {
+			t.Fatalf("question %d has type %q, want the default", q.ID, q.Type)
+		}
+	}
+}
+
+func TestUpdateQuiz(t *testing.T) {
+	forEachMigratedDialect(t, testUpdateQuiz)
+}
+
+func testUpdateQuiz(t *testing.T) {
+	alice := createTestUser(t, "alice")
+	quiz := createTestQuiz(t, alice, "Self Test Quiz", sampleQuestions())
+
+	// A bad scoring policy rejects the whole update, title included
+	rejected := *quiz
+	rejected.Title = "Renamed"
+	rejected.ScoringPolicy = "fastest"
+	if err := UpdateQuiz(&rejected); !errors.Is(err, ErrInvalidQuiz) {
+		t.Fatalf("an unknown scoring policy returned %v", err)
+	}
+	if stored, err := GetQuizSummary(quiz.ID); err != nil || stored.Title != quiz.Title {
+		t.Fatalf("rejected update was partly saved: %+v (%v)", stored, err)
+	}
+
+	updated := *quiz
+	updated.Title = "  Renamed "
+	updated.Status = QuizDraft
+	updated.TimeLimits = TimeLimits{Question: 10, Quiz: 60}
+	updated.ScoringPolicy = ScoringStreak
+	if err := UpdateQuiz(&updated); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := GetQuizSummary(quiz.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != "Renamed" || stored.Status != QuizDraft || stored.TimeLimits != updated.TimeLimits ||
+		stored.ScoringPolicy != ScoringStreak {
+		t.Fatalf("unexpected updated quiz %+v", stored)
+	}
+
+	empty, err := CreateQuiz(Quiz{Title: "Empty", CreatedBy: alice.ID, Status: QuizDraft})
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty.Status = QuizPublished
+	if err := UpdateQuiz(empty); !errors.Is(err, ErrInvalidQuiz) {
+		t.Fatalf("publishing a quiz without questions returned %v", err)
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	forEachMigratedDialect(t, testAttempts)
+}
+
+func testAttempts(t *testing.T) {
+	alice := createTestUser(t, "alice")
+	quiz := createTestQuiz(t, alice, "Self Test Quiz", sampleQuestions())
+	attempt, err := StartAttempt(alice.ID, quiz.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := quiz.Questions[0]
+	skipped := LockedAnswer{QuestionID: quiz.Questions[1].ID}
+	if _, err := LockAnswer(attempt, skipped); !errors.Is(err, ErrQuestionNotServed) {
+		t.Fatalf("answering a question not served yet returned %v", err)
+	}
+	served, err := NextQuestion(attempt, questionIDs(quiz))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served == nil || served.QuestionID != first.ID || served.Number != 1 || served.ExpiresAt == nil {
+		t.Fatalf("unexpected first question %+v", served)
+	}
+
+	correct := first.CorrectOption()
+	answer := LockedAnswer{
+		QuestionID: first.ID,
+		Response:   json.RawMessage(strconv.Itoa(correct.ID)),
+		OptionID:   correct.ID,
+		Answer:     correct.Text,
+		Credit:     1,
+		IsCorrect:  true,
+	}
+	if _, err := LockAnswer(attempt, answer); err != nil {
+		t.Fatal(err)
+	}
+	changed := answer
+	changed.OptionID = first.Options[0].ID
+	changed.Response = json.RawMessage(strconv.Itoa(changed.OptionID))
+	if _, err := LockAnswer(attempt, changed); !errors.Is(err, ErrAnswerLocked) {
+		t.Fatalf("changing a locked answer returned %v", err)
+	}
+
+	if err := SubmitAttempt(attempt.ID, []LockedAnswer{answer, skipped}, 50, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := SubmitAttempt(attempt.ID, nil, 100, 200); !errors.Is(err, ErrAttemptSubmitted) {
+		t.Fatalf("submitting twice returned %v", err)
+	}
+
+	answers, err := GetAttemptAnswers(attempt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 2 || answers[0].TimeTakenMS == nil || answers[1].TimeTakenMS != nil ||
+		answers[0].Credit != 1 || string(answers[0].Response) != strconv.Itoa(correct.ID) || answers[1].Answered() {
+		t.Fatalf("unexpected saved answers %+v", answers)
+	}
+
+	summaries, total, err := ListUserAttempts(alice.ID, 0, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(summaries) != 1 || summaries[0].Score == nil || *summaries[0].Score != 50 ||
+		summaries[0].Points == nil || *summaries[0].Points != 100 {
+		t.Fatalf("unexpected attempts %+v", summaries)
+	}
+}
+
+func TestTimeLimits(t *testing.T) {
+	forEachMigratedDialect(t, testTimeLimits)
+}
+
+func testTimeLimits(t *testing.T) {
+	bob := createTestUser(t, "bob")
+	quiz := createTestQuiz(t, bob, "Self Test Quiz", sampleQuestions())
+	if err := SetQuizTimeLimits(quiz.ID, TimeLimits{Question: 10, Quiz: 60}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetQuizTimeLimits(quiz.ID, TimeLimits{Question: -1}); !errors.Is(err, ErrInvalidQuiz) {
+		t.Fatalf("a negative time limit returned %v", err)
+	}
+	attempt, err := StartAttempt(bob.ID, quiz.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempt.Status != AttemptInProgress || attempt.Deadline == nil {
+		t.Fatalf("unexpected timed attempt %+v", attempt)
+	}
+
+	// Pretend the first question was served long enough ago for its time
+	// to have run out
+	if _, err := NextQuestion(attempt, questionIDs(quiz)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Exec(`UPDATE attempt_questions SET served_at = ? WHERE attempt_id = ?`,
+		time.Now().UTC().Add(-time.Minute), attempt.ID); err != nil {
+		t.Fatal(err)
+	}
+	first := quiz.Questions[0]
+	correct := first.CorrectOption()
+	late, err := LockAnswer(attempt, LockedAnswer{
+		QuestionID: first.ID,
+		Response:   json.RawMessage(strconv.Itoa(correct.ID)),
+		OptionID:   correct.ID,
+		Credit:     1,
+		IsCorrect:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !late.TimedOut || late.IsCorrect || late.Credit != 0 {
+		t.Fatalf("late answer was not timed out: %+v", late)
+	}
+
+	// A question left unanswered past its time is skipped when the next
+	// one is asked for
+	served, err := NextQuestion(attempt, questionIDs(quiz))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Exec(`UPDATE attempt_questions SET served_at = ? WHERE attempt_id = ? AND question_id = ?`,
+		time.Now().UTC().Add(-time.Minute), attempt.ID, served.QuestionID); err != nil {
+		t.Fatal(err)
+	}
+	if next, err := NextQuestion(attempt, questionIDs(quiz)); err != nil || next != nil {
+		t.Fatalf("expired question was served again: %+v (%v)", next, err)
+	}
+	answers, err := GetAttemptAnswers(attempt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 2 || !answers[1].TimedOut || answers[1].OptionID != 0 {
+		t.Fatalf("unexpected timed out answers %+v", answers)
+	}
+}
+
+func TestScores(t *testing.T) {
+	forEachMigratedDialect(t, testScores)
+}
+
+func testScores(t *testing.T) {
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	quiz := createTestQuiz(t, alice, "Self Test Quiz", sampleQuestions())
+	if err := SetScoringPolicy(quiz.ID, "fastest"); !errors.Is(err, ErrInvalidQuiz) {
+		t.Fatalf("an unknown scoring policy returned %v", err)
+	}
+	if err := SetScoringPolicy(quiz.ID, ScoringSpeedBonus); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice's 60% attempt earned the most points, so it is her best even
+	// though 80% is her top score
+	for _, played := range []struct {
+		user          *User
+		score, points float64
+	}{{alice, 50, 100}, {alice, 80, 160}, {alice, 60, 300}, {bob, 90, 180}} {
+		attempt := submitTestAttempt(t, played.user, quiz, played.score, played.points)
+		if attempt.ScoringPolicy != ScoringSpeedBonus {
+			t.Fatalf("attempt started under policy %q", attempt.ScoringPolicy)
+		}
+	}
+
+	quizzes, err := GetAvailableQuizzes(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quizzes) != 1 || quizzes[0].UserScore != 60 || quizzes[0].UserPoints != 300 || quizzes[0].Rank != 1 ||
+		quizzes[0].HighScore != 90 || quizzes[0].TotalAttempts != 4 {
+		t.Fatalf("unexpected best scores %+v", quizzes)
+	}
+
+	history, err := GetUserQuizHistory(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Attempts != 3 || history[0].BestScore != 80 || history[0].BestPoints != 300 ||
+		history[0].LatestScore != 60 || math.Abs(history[0].AverageScore-190.0/3) > 1e-9 || history[0].Rank != 1 {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	if rank, err := GetQuizRank(quiz.ID, bob.ID); err != nil || rank != 2 {
+		t.Fatalf("bob ranks %d (%v), want 2", rank, err)
+	}
+
+	entries, total, err := QueryLeaderboard(LeaderboardFilter{QuizID: quiz.ID, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(entries) != 2 || entries[0].Username != "alice" || entries[0].Rank != 1 || entries[0].Points != 300 {
+		t.Fatalf("unexpected leaderboard %+v", entries)
+	}
+
+	top, err := GetTopScores(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].Username != "alice" || top[0].Points != 300 {
+		t.Fatalf("unexpected top scores %+v", top)
+	}
+
+	stats, err := GetUserStats(bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.QuizzesTaken != 1 || stats.AverageScore != 90 || stats.TotalPoints != 180 || stats.GlobalRank != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	userQuizzes, err := GetUserQuizzes(bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userQuizzes) != 1 || userQuizzes[0].Rank != 2 || userQuizzes[0].UserPoints != 180 {
+		t.Fatalf("unexpected user quizzes %+v", userQuizzes)
+	}
+}
+
+func TestQuestionEditing(t *testing.T) {
+	forEachMigratedDialect(t, testQuestionEditing)
+}
+
+func testQuestionEditing(t *testing.T) {
+	alice := createTestUser(t, "alice")
+	quiz := createTestQuiz(t, alice, "Self Test Quiz", sampleQuestions())
+	q := quiz.Questions[0]
+	kept := q.Options[1].ID
+	q.Options = []Option{{Text: "5"}, q.Options[1], {Text: "22"}}
+	if err := UpdateQuestion(&q); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := GetQuestion(quiz.ID, q.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updated.Options) != 3 || updated.Options[1].ID != kept || !updated.Options[1].IsCorrect {
+		t.Fatalf("editing did not keep the correct option: %+v", updated.Options)
+	}
+}
+
+func TestQuestionTypes(t *testing.T) {
+	forEachMigratedDialect(t, testQuestionTypes)
+}
+
+func testQuestionTypes(t *testing.T) {
+	invalid := []Question{
+		{Text: "Too many", Type: QuestionTrueFalse, Options: []Option{{Text: "True", IsCorrect: true}, {Text: "False"}, {Text: "Maybe"}}},
+		{Text: "None correct", Type: QuestionMultiSelect, Options: []Option{{Text: "A"}, {Text: "B"}}},
+		{Text: "Nothing accepted", Type: QuestionFreeText},
+		{Text: "Unknown", Type: "essay", Options: []Option{{Text: "A", IsCorrect: true}, {Text: "B"}}},
+	}
+	for _, q := range invalid {
+		if err := ValidateQuestion(&q); !errors.Is(err, ErrInvalidQuiz) {
+			t.Fatalf("question %q returned %v", q.Text, err)
+		}
+	}
+
+	bob := createTestUser(t, "bob")
+	quiz := createTestQuiz(t, bob, "Self Test Quiz", sampleQuestions())
+	q := Question{Text: "Capital of Italy?", Type: QuestionFreeText, Options: []Option{{Text: "Rome"}, {Text: "Roma"}}}
+	if err := AddQuestion(quiz.ID, &q); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := GetQuestion(quiz.ID, q.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Type != QuestionFreeText || len(stored.CorrectOptions()) != 2 || len(stored.PlayerOptions()) != 0 {
+		t.Fatalf("unexpected free-text question %+v", stored)
+	}
+
+	attempt, err := StartAttempt(bob.ID, quiz.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NextQuestion(attempt, []int{q.ID}); err != nil {
+		t.Fatal(err)
+	}
+	answer := LockedAnswer{QuestionID: q.ID, Response: json.RawMessage(`"rome"`), Answer: "rome", Credit: 1, IsCorrect: true}
+	if _, err := LockAnswer(attempt, answer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockAnswer(attempt, answer); err != nil {
+		t.Fatalf("locking the same answer again returned %v", err)
+	}
+	changed := answer
+	changed.Response = json.RawMessage(`"paris"`)
+	if _, err := LockAnswer(attempt, changed); !errors.Is(err, ErrAnswerLocked) {
+		t.Fatalf("changing a locked answer returned %v", err)
+	}
+
+	answers, err := GetAttemptAnswers(attempt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 1 || string(answers[0].Response) != `"rome"` || answers[0].OptionID != 0 || answers[0].Credit != 1 {
+		t.Fatalf("unexpected saved answers %+v", answers)
+	}
+}
+
+func TestAnswerKeyQuestions(t *testing.T) {
+	forEachMigratedDialect(t, testAnswerKeyQuestions)
+}
+
+func testAnswerKeyQuestions(t *testing.T) {
+	invalid := []Question{
+		{Text: "Not a number", Type: QuestionNumeric, Options: []Option{{Text: "three"}}},
+		{Text: "Two values", Type: QuestionNumeric, Options: []Option{{Text: "3"}, {Text: "4"}}},
+		{Text: "Negative tolerance", Type: QuestionNumeric, Options: []Option{{Text: "3"}}, Tolerance: -1},
+		{Text: "One step", Type: QuestionOrdering, Options: []Option{{Text: "Build"}}},
+		{Text: "Unmatched", Type: QuestionMatching, Options: []Option{{Text: "api", Match: "Team A"}, {Text: "web"}}},
+		{Text: "Same match", Type: QuestionMatching, Options: []Option{{Text: "api", Match: "Team A"}, {Text: "web", Match: "Team A"}}},
+	}
+	for _, q := range invalid {
+		if err := ValidateQuestion(&q); !errors.Is(err, ErrInvalidQuiz) {
+			t.Fatalf("question %q returned %v", q.Text, err)
+		}
+	}
+
+	alice := createTestUser(t, "alice")
+	quiz := createTestQuiz(t, alice, "Self Test Quiz", sampleQuestions())
+	numeric := Question{Text: "How many replicas?", Type: QuestionNumeric, Options: []Option{{Text: "3"}}, Tolerance: 0.5}
+	if err := AddQuestion(quiz.ID, &numeric); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := GetQuestion(quiz.ID, numeric.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Tolerance != 0.5 || stored.CorrectOption() == nil || len(stored.PlayerOptions()) != 0 {
+		t.Fatalf("unexpected numeric question %+v", stored)
+	}
+
+	matching := Question{Text: "Who owns what?", Type: QuestionMatching, Options: []Option{
+		{Text: "web", Match: "Team B"},
+		{Text: "api", Match: "Team A"},
+	}}
+	if err := AddQuestion(quiz.ID, &matching); err != nil {
+		t.Fatal(err)
+	}
+	matching.Options[0].Match = "Team C"
+	if err := UpdateQuestion(&matching); err != nil {
+		t.Fatal(err)
+	}
+	stored, err = GetQuestion(quiz.ID, matching.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Options) != 2 || stored.Options[0].Match != "Team C" || len(stored.CorrectOptions()) != 2 {
+		t.Fatalf("unexpected matching question %+v", stored)
+	}
+	if matches := stored.PlayerMatches(); len(matches) != 2 || matches[0] != "Team A" {
+		t.Fatalf("unexpected matches %v", matches)
+	}
+	if o := stored.OptionMatching("Team C"); o == nil || o.Text != "web" {
+		t.Fatalf("unexpected option for Team C: %+v", o)
+	}
+}
+
+func TestQuestionDeletion(t *testing.T) {
+	forEachMigratedDialect(t, testQuestionDeletion)
+}
+
+func testQuestionDeletion(t *testing.T) {
+	bob := createTestUser(t, "bob")
+	questions := sampleQuestions()
+	questions[0].Options = append(questions[0].Options, Option{Text: "5"})
+	quiz := createTestQuiz(t, bob, "Self Test Quiz", questions)
+	q := &quiz.Questions[0]
+
+	attempt, err := StartAttempt(bob.ID, quiz.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NextQuestion(attempt, []int{q.ID}); err != nil {
+		t.Fatal(err)
+	}
+	removed := q.Options[0]
+	answer := LockedAnswer{
+		QuestionID: q.ID,
+		Response:   json.RawMessage(strconv.Itoa(removed.ID)),
+		OptionID:   removed.ID,
+		Answer:     removed.Text,
+	}
+	if _, err := LockAnswer(attempt, answer); err != nil {
+		t.Fatal(err)
+	}
+
+	// The answer outlives both the option it chose and its question
+	q.Options = q.Options[1:]
+	if err := UpdateQuestion(q); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := GetQuestion(quiz.ID, q.ID); err != nil || updated.Option(removed.ID) != nil {
+		t.Fatalf("removed option is still offered: %+v (%v)", updated, err)
+	}
+	if err := DeleteQuestion(quiz.ID, q.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteQuestion(quiz.ID, q.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("deleting a question twice returned %v", err)
+	}
+	if _, err := GetQuestion(quiz.ID, q.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("deleted question is still found: %v", err)
+	}
+	live, err := GetQuizWithQuestions(strconv.Itoa(quiz.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live.Questions) != 1 || live.Questions[0].ID == q.ID {
+		t.Fatalf("deleted question is still listed: %+v", live.Questions)
+	}
+	if err := DeleteQuestion(quiz.ID, live.Questions[0].ID); !errors.Is(err, ErrInvalidQuiz) {
+		t.Fatalf("deleting the last question of a published quiz returned %v", err)
+	}
+
+	answers, err := GetAttemptAnswers(attempt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 1 || answers[0].OptionID != removed.ID || answers[0].Answer != removed.Text {
+		t.Fatalf("answer to a deleted question was lost: %+v", answers)
+	}
+	played, err := GetAttemptQuiz(attempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(played.Questions) != 2 || played.Questions[0].ID != q.ID {
+		t.Fatalf("attempt lost its deleted question: %+v", played.Questions)
+	}
+}
+
+func TestLockoutsAndTOTP(t *testing.T) {
+	forEachMigratedDialect(t, testLockoutsAndTOTP)
+}
+
+func testLockoutsAndTOTP(t *testing.T) {
+	alice := createTestUser(t, "alice")
+	until := time.Now().Add(time.Hour)
+	for attempts := 5; attempts <= 6; attempts++ {
+		if err := LockAccount("alice", attempts, "127.0.0.1", until); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := LockAccount("nobody", 5, "127.0.0.1", until); err != nil {
+		t.Fatal(err)
+	}
+	lockout, err := GetActiveLockout("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockout == nil || lockout.FailedAttempts != 6 {
+		t.Fatalf("unexpected lockout %+v", lockout)
+	}
+	if err := UnlockAccount(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if lockout, err := GetActiveLockout("alice"); err != nil || lockout != nil {
+		t.Fatalf("account is still locked: %+v (%v)", lockout, err)
+	}
+
+	if err := StartTOTPEnrollment(alice.ID, "SECRET"); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnableTOTP(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartTOTPEnrollment(alice.ID, "OTHER"); !errors.Is(err, ErrTOTPEnabled) {
+		t.Fatalf("re-enrolling an enabled app returned %v", err)
+	}
+}
+
+func TestQuizDeletion(t *testing.T) {
+	forEachMigratedDialect(t, testQuizDeletion)
+}
+
+func testQuizDeletion(t *testing.T) {
+	alice := createTestUser(t, "alice")
+	quiz := createTestQuiz(t, alice, "Self Test Quiz", sampleQuestions())
+	submitTestAttempt(t, alice, quiz, 50, 100)
+	if err := DeleteQuestion(quiz.ID, quiz.Questions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteQuiz(quiz.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetQuestion(quiz.ID, quiz.Questions[1].ID); err == nil {
+		t.Fatal("question outlived its quiz")
+	}
+	entries, total, err := QueryLeaderboard(LeaderboardFilter{QuizID: quiz.ID, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 0 || len(entries) != 0 {
+		t.Fatal("results outlived their quiz")
+	}
+	var questions int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM questions`).Scan(&questions); err != nil {
+		t.Fatal(err)
+	}
+	if questions != 0 {
+		t.Fatalf("%d questions outlived their quiz", questions)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	forEachMigratedDialect(t, testSessions)
+}
+
+func testSessions(t *testing.T) {
+	alice := createTestUser(t, "alice")
+	store := NewSessionStore([]byte("0123456789abcdef0123456789abcdef"))
+
+	// Log in, then load the session again from the cookie that was set
+	login := httptest.NewRequest("POST", "/login", nil)
+	session, err := store.New(login, "quiz-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["userID"] = alice.ID
+	w := httptest.NewRecorder()
+	if err := store.Save(login, w, session); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	loaded, err := store.New(r, "quiz-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.IsNew || loaded.ID != session.ID || loaded.Values["userID"] != alice.ID {
+		t.Fatalf("session did not survive a round trip: %+v", loaded)
+	}
+
+	// Logging out everywhere while the request runs wins over its save
+	if err := RevokeUserSessions(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	loaded.Values["csrfToken"] = "token"
+	if err := store.Save(r, httptest.NewRecorder(), loaded); !errors.Is(err, ErrSessionRevoked) {
+		t.Fatalf("saving a revoked session returned %v", err)
+	}
+	if sessions, err := GetUserSessions(alice.ID); err != nil || len(sessions) != 0 {
+		t.Fatalf("revoked session was saved again: %+v (%v)", sessions, err)
+	}
+}
@@ -4,11 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"strings"
-
-	"quizapp/models"
-
-	_ "github.com/mattn/go-sqlite3"
+	"strconv"
+	"time"
 )
 
 var DB *sql.DB
@@ -19,38 +16,87 @@ type User struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Password string `json:"-"`
+	Role     string `json:"role"`
+	// EmailVerified is set once the user followed the link sent to Email
+	EmailVerified bool `json:"email_verified"`
 }
 
 type Quiz struct {
-	ID        int        `json:"id"`
-	Title     string     `json:"title"`
-	Questions []Question `json:"questions"`
+	ID         int        `json:"id"`
+	Title      string     `json:"title"`
+	CreatedBy  int        `json:"created_by"`
+	Status     string     `json:"status"`
+	TimeLimits TimeLimits `json:"time_limits"`
+	// ScoringPolicy is one of ScoringPolicies
+	ScoringPolicy string     `json:"scoring_policy"`
+	Questions     []Question `json:"questions"`
+}
+
+// TimeLimits are how long a player gets, in seconds, for each question and
+// for the whole quiz. Zero means no limit.
+type TimeLimits struct {
+	Question int `json:"question"`
+	Quiz     int `json:"quiz"`
 }
 
 type Question struct {
-	ID             int         `json:"id"`
-	QuizID         int         `json:"quiz_id"`
-	Text           string      `json:"text"`
-	Options        []string    `json:"options"`
-	Answer         string      `json:"answer"`
+	ID     int    `json:"id"`
+	QuizID int    `json:"quiz_id"`
+	Text   string `json:"text"`
+	// Type defaults to QuestionMultipleChoice
+	Type    string   `json:"type"`
+	Options []Option `json:"options"`
+	// Tolerance is how far a numeric answer may be from the question's
+	// value and still be correct
+	Tolerance      float64     `json:"tolerance,omitempty"`
 	ImageURL       string      `json:"image_url,omitempty"`
 	Context        string      `json:"context,omitempty"`
 	WordDefinition interface{} `json:"word_definition,omitempty"`
 }
 
+// PlayerQuiz is the view of a quiz sent to a player starting an attempt.
+// Questions are not included; they are served one at a time so the time
+// taken over each can be measured on the server.
+type PlayerQuiz struct {
+	ID            int        `json:"id"`
+	Title         string     `json:"title"`
+	AttemptID     int        `json:"attempt_id"`
+	QuestionCount int        `json:"question_count"`
+	TimeLimits    TimeLimits `json:"time_limits"`
+	ScoringPolicy string     `json:"scoring_policy"`
+	// Deadline is when the attempt ends if the quiz has a time limit
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+type PlayerQuestion struct {
+	ID      int            `json:"id"`
+	Text    string         `json:"text"`
+	Type    string         `json:"type"`
+	Options []PlayerOption `json:"options"`
+	// Matches are what the options of a matching question are matched
+	// with, in alphabetical order
+	Matches  []string `json:"matches,omitempty"`
+	ImageURL string   `json:"image_url,omitempty"`
+	Context  string   `json:"context,omitempty"`
+}
+
 type QuizWithScore struct {
 	ID            int     `json:"id"`
 	Title         string  `json:"title"`
 	UserScore     float64 `json:"user_score"`
+	UserPoints    float64 `json:"user_points"`
 	Rank          int     `json:"rank"`
 	TotalAttempts int     `json:"total_attempts"`
 	HighScore     float64 `json:"high_score"`
 }
 
+// TopScore ranks a player by the points of their best attempts at every
+// quiz. Score is their average percentage.
 type TopScore struct {
 	Rank     int     `json:"rank"`
 	Username string  `json:"username"`
 	Score    float64 `json:"score"`
+	Points   float64 `json:"points"`
 }
 
 // Add these types if not already present
@@ -58,6 +104,7 @@ type LeaderboardEntry struct {
 	Rank     int     `json:"rank"`
 	Username string  `json:"username"`
 	Score    float64 `json:"score"`
+	Points   float64 `json:"points"`
 	QuizName string  `json:"quiz_name"`
 }
 
@@ -65,34 +112,44 @@ type LeaderboardEntry struct {
 type UserStats struct {
 	QuizzesTaken int     `json:"quizzes_taken"`
 	AverageScore float64 `json:"average_score"`
+	TotalPoints  float64 `json:"total_points"`
 	GlobalRank   int     `json:"global_rank"`
 }
 
-// Initialize creates a new database connection and sets up the schema
-func Initialize(dbPath string) error {
-	var err error
-	DB, err = sql.Open("sqlite3", dbPath)
+// Open connects to the database named by dsn without touching its schema
+func Open(dsn string) error {
+	d, source := parseDSN(dsn)
+	db, err := d.open(source)
 	if err != nil {
+		return fmt.Errorf("failed to open %s database: %v", d.name, err)
+	}
+	DB, dbDialect, dataSource = db, d, dsn
+	return nil
+}
+
+// Initialize connects to the database and applies pending migrations
+func Initialize(dsn string) error {
+	if err := Open(dsn); err != nil {
 		return err
 	}
 
-	if err := createTables(); err != nil {
+	if _, err := MigrateUp(0); err != nil {
+		return err
+	}
+
+	if err := disableLegacyGithubPasswords(); err != nil {
 		return err
 	}
 
 	// Add a test user if none exists
 	var count int
-	err = DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	err := DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
 	if err != nil {
 		return err
 	}
 
 	if count == 0 {
-		_, err = DB.Exec(`
-			INSERT INTO users (username, email, password)
-			VALUES (?, ?, ?)
-		`, "test", "test@example.com", "test123")
-		if err != nil {
+		if err := CreateUser("test", "test@example.com", "test123"); err != nil {
 			return err
 		}
 	}
@@ -111,62 +168,38 @@ func Close() error {
 	return nil
 }
 
-func createTables() error {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT UNIQUE NOT NULL,
-			email TEXT UNIQUE NOT NULL,
-			password TEXT NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS quizzes (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			title TEXT NOT NULL,
-			created_by INTEGER,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (created_by) REFERENCES users(id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS questions (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			quiz_id INTEGER,
-			text TEXT NOT NULL,
-			options TEXT NOT NULL,
-			answer TEXT NOT NULL,
-			image_url TEXT,
-			context TEXT,
-			word_definition TEXT,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (quiz_id) REFERENCES quizzes(id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS scores (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER,
-			quiz_id INTEGER,
-			score REAL NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE(user_id, quiz_id),
-			FOREIGN KEY (user_id) REFERENCES users(id),
-			FOREIGN KEY (quiz_id) REFERENCES quizzes(id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS quiz_results (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			quiz_id INTEGER NOT NULL,
-			score REAL NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users(id),
-			FOREIGN KEY (quiz_id) REFERENCES quizzes(id),
-			UNIQUE(user_id, quiz_id)
-		)`,
-	}
-
-	for _, query := range queries {
-		if _, err := DB.Exec(query); err != nil {
-			return err
+func addColumnIfNotExists(table, column, definition string) error {
+	rows, err := DB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("failed to inspect table %s: %v", table, err)
 		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to inspect table %s: %v", table, err)
 	}
+	rows.Close()
 
+	_, err = DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %v", table, column, err)
+	}
 	return nil
 }
 
@@ -174,10 +207,24 @@ func createTables() error {
 func GetUserByUsername(username string) (*User, error) {
 	var user User
 	err := DB.QueryRow(`
-		SELECT id, username, email, password 
+		SELECT id, username, email, password, role, email_verified
 		FROM users 
 		WHERE username = ?
-	`, username).Scan(&user.ID, &user.Username, &user.Email, &user.Password)
+	`, username).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Role, &user.EmailVerified)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUserByEmail retrieves a user by email address
+func GetUserByEmail(email string) (*User, error) {
+	var user User
+	err := DB.QueryRow(`
+		SELECT id, username, email, password, role, email_verified
+		FROM users
+		WHERE LOWER(email) = LOWER(?)
+	`, email).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Role, &user.EmailVerified)
 	if err != nil {
 		return nil, err
 	}
@@ -202,14 +249,19 @@ func CreateUser(username, email, password string) error {
 		return fmt.Errorf("UNIQUE constraint failed: username or email already exists")
 	}
 
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
 	// If no existing user, insert the new user
 	_, err = DB.Exec(`
 		INSERT INTO users (username, email, password, created_at)
 		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
-	`, username, email, password)
+	`, username, email, hash)
 
 	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE") {
+		if dbDialect.isUniqueViolation(err) {
 			return fmt.Errorf("UNIQUE constraint failed: username or email already exists")
 		}
 		return fmt.Errorf("failed to create user: %v", err)
@@ -248,22 +300,35 @@ func GetUserCreatedQuizzes(userID int) ([]Quiz, error) {
 
 // GetQuizWithQuestions retrieves a quiz and its questions
 func GetQuizWithQuestions(quizID string) (*Quiz, error) {
+	return getQuiz(quizID, `deleted_at IS NULL`)
+}
+
+// GetAttemptQuiz retrieves the quiz of an attempt with its questions,
+// keeping those deleted since the attempt answered them so it can still be
+// reviewed as it was played
+func GetAttemptQuiz(attempt *Attempt) (*Quiz, error) {
+	return getQuiz(strconv.Itoa(attempt.QuizID),
+		`(deleted_at IS NULL OR id IN (SELECT question_id FROM attempt_answers WHERE attempt_id = ?))`, attempt.ID)
+}
+
+// getQuiz retrieves a quiz and those of its questions matching cond
+func getQuiz(quizID string, cond string, args ...interface{}) (*Quiz, error) {
 	var quiz Quiz
 	err := DB.QueryRow(`
-		SELECT id, title 
+		SELECT id, title, COALESCE(created_by, 0), status, question_time_limit, time_limit, scoring_policy
 		FROM quizzes 
 		WHERE id = ?
-	`, quizID).Scan(&quiz.ID, &quiz.Title)
+	`, quizID).Scan(&quiz.ID, &quiz.Title, &quiz.CreatedBy, &quiz.Status, &quiz.TimeLimits.Question, &quiz.TimeLimits.Quiz, &quiz.ScoringPolicy)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get quiz: %v", err)
 	}
 
 	rows, err := DB.Query(`
-		SELECT id, text, options, answer 
+		SELECT id, text, type, tolerance
 		FROM questions 
-		WHERE quiz_id = ? 
-		ORDER BY id
-	`, quizID)
+		WHERE quiz_id = ? AND `+cond+`
+		ORDER BY position, id
+	`, append([]interface{}{quizID}, args...)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get questions: %v", err)
 	}
@@ -271,62 +336,75 @@ func GetQuizWithQuestions(quizID string) (*Quiz, error) {
 
 	for rows.Next() {
 		var q Question
-		var optionsStr string
-		err := rows.Scan(&q.ID, &q.Text, &optionsStr, &q.Answer)
+		err := rows.Scan(&q.ID, &q.Text, &q.Type, &q.Tolerance)
 		if err != nil {
 			log.Printf("Error scanning question: %v", err)
 			continue
 		}
-		q.Options = strings.Split(optionsStr, "|")
+		q.QuizID = quiz.ID
 		quiz.Questions = append(quiz.Questions, q)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get questions: %v", err)
+	}
+
+	options, err := getOptions(`q.quiz_id = ?`, quiz.ID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range quiz.Questions {
+		quiz.Questions[i].Options = options.of(quiz.Questions[i].ID)
+	}
 
 	return &quiz, nil
 }
 
-// SaveQuizScore saves or updates a user's quiz score
-func SaveQuizScore(userID, quizID int, score float64) error {
-	log.Printf("Saving score for user %d, quiz %d: %.2f", userID, quizID, score)
-	result, err := DB.Exec(`
-		INSERT INTO quiz_results (user_id, quiz_id, score)
-		VALUES (?, ?, ?)
-		ON CONFLICT(user_id, quiz_id) 
-		DO UPDATE SET score = CASE WHEN score < ? THEN ? ELSE score END
-	`, userID, quizID, score, score, score)
-	if err != nil {
-		log.Printf("Error saving score: %v", err)
-		return err
+// GetQuizRank returns the rank of a user's best points on a quiz, or 0 if
+// they have no score for it
+func GetQuizRank(quizID, userID int) (int, error) {
+	var rank int
+	err := DB.QueryRow(`
+		WITH RankedScores AS (
+			SELECT user_id,
+				   RANK() OVER (ORDER BY points DESC) as rank
+			FROM best_scores
+			WHERE quiz_id = ?
+		)
+		SELECT COALESCE(rank, 0)
+		FROM RankedScores
+		WHERE user_id = ?
+	`, quizID, userID).Scan(&rank)
+	if err == sql.ErrNoRows {
+		return 0, nil
 	}
-
-	rows, err := result.RowsAffected()
 	if err != nil {
-		log.Printf("Error getting rows affected: %v", err)
-	} else {
-		log.Printf("Score saved successfully. Rows affected: %d", rows)
+		return 0, fmt.Errorf("failed to get rank: %v", err)
 	}
-	return nil
+	return rank, nil
 }
 
 // GetUserQuizzes retrieves all quizzes with user scores
 func GetUserQuizzes(userID int) ([]QuizWithScore, error) {
 	rows, err := DB.Query(`
 		WITH UserScores AS (
-			SELECT quiz_id, score,
-				   RANK() OVER (PARTITION BY quiz_id ORDER BY score DESC) as rank
-			FROM quiz_results
+			SELECT quiz_id, user_id,
+				   RANK() OVER (PARTITION BY quiz_id ORDER BY points DESC) as rank
+			FROM best_scores
 		)
 		SELECT 
 			q.id, 
 			q.title,
 			COALESCE(qr.score, 0) as user_score,
+			COALESCE(qr.points, 0) as user_points,
 			COALESCE(us.rank, 0) as rank,
 			COUNT(DISTINCT qr2.user_id) as total_attempts,
 			MAX(qr2.score) as high_score
 		FROM quizzes q
-		LEFT JOIN quiz_results qr ON q.id = qr.quiz_id AND qr.user_id = ?
-		LEFT JOIN UserScores us ON q.id = us.quiz_id AND qr.score = us.score
-		LEFT JOIN quiz_results qr2 ON q.id = qr2.quiz_id
-		GROUP BY q.id, q.title, qr.score, us.rank
+		LEFT JOIN best_scores qr ON q.id = qr.quiz_id AND qr.user_id = ?
+		LEFT JOIN UserScores us ON q.id = us.quiz_id AND us.user_id = qr.user_id
+		LEFT JOIN best_scores qr2 ON q.id = qr2.quiz_id
+		WHERE q.status = 'published'
+		GROUP BY q.id, q.title, qr.score, qr.points, us.rank
 		ORDER BY q.created_at DESC
 	`, userID)
 	if err != nil {
@@ -344,6 +422,7 @@ func GetUserQuizzes(userID int) ([]QuizWithScore, error) {
 			&quiz.ID,
 			&quiz.Title,
 			&quiz.UserScore,
+			&quiz.UserPoints,
 			&quiz.Rank,
 			&totalAttempts,
 			&highScore,
@@ -360,19 +439,20 @@ func GetUserQuizzes(userID int) ([]QuizWithScore, error) {
 	return quizzes, nil
 }
 
-// GetTopScores retrieves the top scoring users
+// GetTopScores retrieves the users with the most points
 func GetTopScores(limit int) ([]TopScore, error) {
 	rows, err := DB.Query(`
 		WITH UserScores AS (
 			SELECT 
 				u.username,
 				AVG(qr.score) as avg_score,
-				RANK() OVER (ORDER BY AVG(qr.score) DESC) as rank
+				SUM(qr.points) as total_points,
+				RANK() OVER (ORDER BY SUM(qr.points) DESC) as rank
 			FROM users u
-			JOIN quiz_results qr ON u.id = qr.user_id
+			JOIN best_scores qr ON u.id = qr.user_id
 			GROUP BY u.id, u.username
 		)
-		SELECT rank, username, avg_score
+		SELECT rank, username, avg_score, total_points
 		FROM UserScores
 		WHERE rank <= ?
 		ORDER BY rank
@@ -385,7 +465,7 @@ func GetTopScores(limit int) ([]TopScore, error) {
 	var scores []TopScore
 	for rows.Next() {
 		var score TopScore
-		err := rows.Scan(&score.Rank, &score.Username, &score.Score)
+		err := rows.Scan(&score.Rank, &score.Username, &score.Score, &score.Points)
 		if err != nil {
 			log.Printf("Error scanning top score: %v", err)
 			continue
@@ -396,30 +476,59 @@ func GetTopScores(limit int) ([]TopScore, error) {
 	return scores, nil
 }
 
+// LeaderboardFilter narrows down QueryLeaderboard. Zero values do not
+// filter.
+type LeaderboardFilter struct {
+	QuizID int
+	Limit  int
+	Offset int
+}
+
 // GetLeaderboard retrieves the leaderboard data
 func GetLeaderboard() ([]LeaderboardEntry, error) {
+	entries, _, err := QueryLeaderboard(LeaderboardFilter{Limit: 50})
+	return entries, err
+}
+
+// QueryLeaderboard returns one page of the per-quiz rankings and the total
+// number of entries matching the filter
+func QueryLeaderboard(filter LeaderboardFilter) ([]LeaderboardEntry, int, error) {
+	cond := "1 = 1"
+	var args []interface{}
+	if filter.QuizID != 0 {
+		cond = "qr.quiz_id = ?"
+		args = append(args, filter.QuizID)
+	}
+
+	var total int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM best_scores qr WHERE `+cond, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count leaderboard: %v", err)
+	}
+
 	rows, err := DB.Query(`
 		SELECT 
 			u.username,
 			q.title as quiz_name,
 			qr.score,
-			RANK() OVER (PARTITION BY qr.quiz_id ORDER BY qr.score DESC) as rank
-		FROM quiz_results qr
+			qr.points,
+			RANK() OVER (PARTITION BY qr.quiz_id ORDER BY qr.points DESC) as rank
+		FROM best_scores qr
 		JOIN users u ON qr.user_id = u.id
 		JOIN quizzes q ON qr.quiz_id = q.id
+		WHERE `+cond+`
 		ORDER BY qr.quiz_id, rank
-		LIMIT 50
-	`)
+		LIMIT ? OFFSET ?
+	`, append(args, filter.Limit, filter.Offset)...)
 	if err != nil {
 		log.Printf("Error fetching leaderboard: %v", err)
-		return nil, err
+		return nil, 0, err
 	}
 	defer rows.Close()
 
-	var entries []LeaderboardEntry
+	entries := []LeaderboardEntry{}
 	for rows.Next() {
 		var entry LeaderboardEntry
-		err := rows.Scan(&entry.Username, &entry.QuizName, &entry.Score, &entry.Rank)
+		err := rows.Scan(&entry.Username, &entry.QuizName, &entry.Score, &entry.Points, &entry.Rank)
 		if err != nil {
 			log.Printf("Error scanning leaderboard entry: %v", err)
 			continue
@@ -427,53 +536,7 @@ func GetLeaderboard() ([]LeaderboardEntry, error) {
 		entries = append(entries, entry)
 	}
 
-	return entries, nil
-}
-
-// Add this function to properly handle GitHub users
-func GetOrCreateGithubUser(githubUser *models.GithubUser) (*User, error) {
-	tx, err := DB.Begin()
-	if err != nil {
-		return nil, fmt.Errorf("failed to begin transaction: %v", err)
-	}
-	defer tx.Rollback()
-
-	var user User
-	err = tx.QueryRow(`
-		SELECT id, username, email 
-		FROM users 
-		WHERE email = ? OR username = ?
-	`, githubUser.Email, githubUser.Login).Scan(&user.ID, &user.Username, &user.Email)
-
-	if err == sql.ErrNoRows {
-		// Create new user
-		result, err := tx.Exec(`
-			INSERT INTO users (username, email, password)
-			VALUES (?, ?, ?)
-		`, githubUser.Login, githubUser.Email, "github-auth")
-		if err != nil {
-			return nil, fmt.Errorf("failed to create user: %v", err)
-		}
-
-		id, err := result.LastInsertId()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get user id: %v", err)
-		}
-
-		user = User{
-			ID:       int(id),
-			Username: githubUser.Login,
-			Email:    githubUser.Email,
-		}
-	} else if err != nil {
-		return nil, fmt.Errorf("failed to query user: %v", err)
-	}
-
-	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("failed to commit transaction: %v", err)
-	}
-
-	return &user, nil
+	return entries, total, nil
 }
 
 func GetAvailableQuizzes(userID int) ([]QuizWithScore, error) {
@@ -482,25 +545,28 @@ func GetAvailableQuizzes(userID int) ([]QuizWithScore, error) {
 			q.id,
 			q.title,
 			COALESCE(qr.score, 0) as user_score,
+			COALESCE(qr.points, 0) as user_points,
 			COALESCE(r.rank, 0) as rank,
 			COALESCE(a.attempts, 0) as total_attempts,
 			COALESCE(hs.high_score, 0) as high_score
 		FROM quizzes q
-		LEFT JOIN quiz_results qr ON q.id = qr.quiz_id AND qr.user_id = ?
+		LEFT JOIN best_scores qr ON q.id = qr.quiz_id AND qr.user_id = ?
 		LEFT JOIN (
-			SELECT quiz_id, user_id, RANK() OVER (PARTITION BY quiz_id ORDER BY score DESC) as rank
-			FROM quiz_results
+			SELECT quiz_id, user_id, RANK() OVER (PARTITION BY quiz_id ORDER BY points DESC) as rank
+			FROM best_scores
 		) r ON q.id = r.quiz_id AND r.user_id = ?
 		LEFT JOIN (
 			SELECT quiz_id, COUNT(*) as attempts
-			FROM quiz_results
+			FROM attempts
+			WHERE score IS NOT NULL
 			GROUP BY quiz_id
 		) a ON q.id = a.quiz_id
 		LEFT JOIN (
 			SELECT quiz_id, MAX(score) as high_score
-			FROM quiz_results
+			FROM best_scores
 			GROUP BY quiz_id
 		) hs ON q.id = hs.quiz_id
+		WHERE q.status = 'published'
 		ORDER BY q.id DESC
 	`, userID, userID)
 	if err != nil {
@@ -515,6 +581,7 @@ func GetAvailableQuizzes(userID int) ([]QuizWithScore, error) {
 			&quiz.ID,
 			&quiz.Title,
 			&quiz.UserScore,
+			&quiz.UserPoints,
 			&quiz.Rank,
 			&quiz.TotalAttempts,
 			&quiz.HighScore,
@@ -533,10 +600,10 @@ func GetAvailableQuizzes(userID int) ([]QuizWithScore, error) {
 func GetUserByID(userID int) (*User, error) {
 	var user User
 	err := DB.QueryRow(`
-		SELECT id, username, email 
+		SELECT id, username, email, role, email_verified
 		FROM users 
 		WHERE id = ?
-	`, userID).Scan(&user.ID, &user.Username, &user.Email)
+	`, userID).Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.EmailVerified)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %v", err)
 	}
@@ -546,24 +613,24 @@ func GetUserByID(userID int) (*User, error) {
 func GetUserStats(userID int) (*UserStats, error) {
 	var stats UserStats
 
-	// Get number of quizzes taken and average score
+	// Get number of quizzes taken, average score and points
 	err := DB.QueryRow(`
 		SELECT COUNT(DISTINCT quiz_id) as quizzes_taken,
-			   COALESCE(AVG(score), 0) as average_score
-		FROM quiz_results
+			   COALESCE(AVG(score), 0) as average_score,
+			   COALESCE(SUM(points), 0) as total_points
+		FROM best_scores
 		WHERE user_id = ?
-	`, userID).Scan(&stats.QuizzesTaken, &stats.AverageScore)
+	`, userID).Scan(&stats.QuizzesTaken, &stats.AverageScore, &stats.TotalPoints)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user stats: %v", err)
 	}
 
-	// Get global rank based on average score
+	// Get global rank based on points, as in GetTopScores
 	err = DB.QueryRow(`
 		WITH UserRanks AS (
 			SELECT user_id,
-				   AVG(score) as avg_score,
-				   RANK() OVER (ORDER BY AVG(score) DESC) as rank
-			FROM quiz_results
+				   RANK() OVER (ORDER BY SUM(points) DESC) as rank
+			FROM best_scores
 			GROUP BY user_id
 		)
 		SELECT COALESCE(rank, 0)
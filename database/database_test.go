@@ -0,0 +1,184 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// postgresURL is the Postgres server the tests also run against: the one
+// DATABASE_URL names, or else a throwaway one TestMain starts when the
+// Postgres server binaries are on the PATH. postgresSkip says why there is
+// none.
+var postgresURL, postgresSkip string
+
+func TestMain(m *testing.M) {
+	stop := startPostgres()
+	code := m.Run()
+	stop()
+	os.Exit(code)
+}
+
+// startPostgres sets postgresURL and returns the function that stops the
+// server it started, if any
+func startPostgres() (stop func()) {
+	stop = func() {}
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		if d, _ := parseDSN(dsn); d == postgresDialect {
+			postgresURL = dsn
+			return stop
+		}
+	}
+	pgCtl, err := exec.LookPath("pg_ctl")
+	if err != nil {
+		postgresSkip = "no Postgres server: set DATABASE_URL to one or put pg_ctl and initdb on the PATH"
+		return stop
+	}
+
+	dir, err := os.MkdirTemp("", "quizapp-pg")
+	if err != nil {
+		postgresSkip = fmt.Sprintf("failed to start Postgres: %v", err)
+		return stop
+	}
+	data := filepath.Join(dir, "data")
+	initdb := exec.Command(filepath.Join(filepath.Dir(pgCtl), "initdb"), "-D", data, "-U", "postgres", "--auth=trust")
+	if out, err := initdb.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		postgresSkip = fmt.Sprintf("failed to start Postgres: initdb: %v\n%s", err, out)
+		return stop
+	}
+	// The server only listens on a socket in dir, so it cannot clash with
+	// another one on the same port
+	options := fmt.Sprintf("-k %s -c listen_addresses=''", dir)
+	start := exec.Command(pgCtl, "-D", data, "-l", filepath.Join(dir, "log"), "-o", options, "-w", "start")
+	if out, err := start.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		postgresSkip = fmt.Sprintf("failed to start Postgres: pg_ctl: %v\n%s", err, out)
+		return stop
+	}
+
+	postgresURL = "postgres://postgres@/postgres?sslmode=disable&host=" + url.QueryEscape(dir)
+	return func() {
+		exec.Command(pgCtl, "-D", data, "-m", "immediate", "-w", "stop").Run()
+		os.RemoveAll(dir)
+	}
+}
+
+// forEachDialect runs test once for each database the app supports, with
+// DB pointing at an empty scratch database of that kind: in-memory SQLite,
+// and Postgres when there is a server to run against
+func forEachDialect(t *testing.T, test func(t *testing.T)) {
+	t.Helper()
+	t.Run("sqlite", func(t *testing.T) {
+		useScratchDB(t, ":memory:")
+		test(t)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		if postgresURL == "" {
+			t.Skip(postgresSkip)
+		}
+		useScratchDB(t, postgresURL)
+		test(t)
+	})
+}
+
+// forEachMigratedDialect is forEachDialect with every migration applied to
+// the scratch database
+func forEachMigratedDialect(t *testing.T, test func(t *testing.T)) {
+	t.Helper()
+	forEachDialect(t, func(t *testing.T) {
+		if _, err := migrateUp(DB, 0); err != nil {
+			t.Fatal(err)
+		}
+		test(t)
+	})
+}
+
+// useScratchDB points DB at an empty scratch database of the kind dsn
+// names for the length of the test
+func useScratchDB(t *testing.T, dsn string) {
+	t.Helper()
+	if err := Open(dsn); err != nil {
+		t.Fatal(err)
+	}
+	main := DB
+	scratch, cleanup, err := openScratch()
+	if err != nil {
+		main.Close()
+		t.Fatal(err)
+	}
+	DB = scratch
+	t.Cleanup(func() {
+		cleanup()
+		main.Close()
+		DB = nil
+	})
+}
+
+func TestRebind(t *testing.T) {
+	for query, want := range map[string]string{
+		`SELECT 1`:                               `SELECT 1`,
+		`a = ? AND b IN (?, ?)`:                  `a = $1 AND b IN ($2, $3)`,
+		`text = '?' AND id = ?`:                  `text = '?' AND id = $1`,
+		`"?" = ?`:                                `"?" = $1`,
+		`note = 'it''s ?' AND id = ?`:            `note = 'it''s ?' AND id = $1`,
+		`a = 'say "?"' AND "it's" = ? AND b = ?`: `a = 'say "?"' AND "it's" = $1 AND b = $2`,
+		`a LIKE ? || '%'`:                        `a LIKE $1 || '%'`,
+	} {
+		if got := rebind(query); got != want {
+			t.Errorf("rebind(%s) = %s, want %s", query, got, want)
+		}
+	}
+}
+
+// openScratch opens an empty database of the current dialect for tests
+// that must not touch real data. The returned function closes it and
+// throws away everything created in it.
+func openScratch() (*sql.DB, func(), error) {
+	if dbDialect != postgresDialect {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open scratch database: %v", err)
+		}
+		// Every connection to :memory: gets its own database
+		db.SetMaxOpenConns(1)
+		return db, func() { db.Close() }, nil
+	}
+
+	// Postgres gets a throwaway schema in the configured database
+	main := DB
+	schema := fmt.Sprintf("quizapp_scratch_%d", time.Now().UnixNano())
+	if _, err := main.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		return nil, nil, fmt.Errorf("failed to create scratch schema: %v", err)
+	}
+	dropSchema := func() {
+		if _, err := main.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			log.Printf("Failed to drop scratch schema %s: %v", schema, err)
+		}
+	}
+
+	u, err := url.Parse(dataSource)
+	if err != nil {
+		dropSchema()
+		return nil, nil, fmt.Errorf("failed to parse DATABASE_URL: %v", err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	db, err := postgresDialect.open(u.String())
+	if err != nil {
+		dropSchema()
+		return nil, nil, fmt.Errorf("failed to open scratch database: %v", err)
+	}
+	return db, func() {
+		db.Close()
+		dropSchema()
+	}, nil
+}
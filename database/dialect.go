@@ -0,0 +1,211 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// dialect holds what differs between the databases the app can run on.
+// Queries are written with ? placeholders and SQL both databases accept;
+// everything else goes through the current dialect.
+type dialect struct {
+	// name is also the directory of the dialect's migrations
+	name string
+	open func(source string) (*sql.DB, error)
+	// like is the case-insensitive LIKE operator
+	like string
+	// tablesQuery lists the tables of the current database or schema
+	tablesQuery string
+	// returningID marks databases that report new row IDs through
+	// RETURNING rather than LastInsertId
+	returningID       bool
+	isUniqueViolation func(error) bool
+}
+
+var sqliteDialect = &dialect{
+	name: "sqlite",
+	open: func(source string) (*sql.DB, error) {
+		return sql.Open("sqlite3", source)
+	},
+	like:        "LIKE",
+	tablesQuery: `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`,
+	isUniqueViolation: func(err error) bool {
+		var sqliteErr sqlite3.Error
+		return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	},
+}
+
+var postgresDialect = &dialect{
+	name: "postgres",
+	open: func(source string) (*sql.DB, error) {
+		connector, err := pq.NewConnector(source)
+		if err != nil {
+			return nil, err
+		}
+		return sql.OpenDB(rebindConnector{connector}), nil
+	},
+	like:        "ILIKE",
+	tablesQuery: `SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema()`,
+	returningID: true,
+	isUniqueViolation: func(err error) bool {
+		var pqErr *pq.Error
+		return errors.As(err, &pqErr) && pqErr.Code == "23505"
+	},
+}
+
+// dbDialect is the dialect of DB and dataSource the DSN it was opened with
+var (
+	dbDialect  = sqliteDialect
+	dataSource string
+)
+
+// parseDSN picks the dialect for a data source. postgres:// and
+// postgresql:// URLs select Postgres; anything else is a SQLite file,
+// optionally prefixed with sqlite://.
+func parseDSN(dsn string) (*dialect, string) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgresDialect, dsn
+	}
+	return sqliteDialect, strings.TrimPrefix(dsn, "sqlite://")
+}
+
+// insertID runs an INSERT and returns the ID of the new row
+func insertID(db execer, query string, args ...interface{}) (int, error) {
+	if dbDialect.returningID {
+		var id int
+		err := db.QueryRow(query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// listTables returns the names of the tables in db
+func listTables(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(dbDialect.tablesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+// rebind rewrites ? placeholders to Postgres' numbered $1, $2, ... form,
+// leaving quoted strings and identifiers alone
+func rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// rebindConnector hands out Postgres connections that accept ? placeholders
+type rebindConnector struct {
+	driver.Connector
+}
+
+func (c rebindConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &rebindConn{conn}, nil
+}
+
+type rebindConn struct {
+	driver.Conn
+}
+
+func (c *rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query))
+}
+
+func (c *rebindConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, rebind(query))
+	}
+	return c.Prepare(query)
+}
+
+func (c *rebindConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, rebind(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *rebindConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, rebind(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *rebindConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *rebindConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *rebindConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *rebindConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
@@ -0,0 +1,209 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"quizapp/models"
+)
+
+var (
+	// ErrIdentityConflict means an identity that is not linked yet shares
+	// its username or email with an existing account. The owner has to log
+	// in to that account to link it.
+	ErrIdentityConflict = errors.New("an account with this username or email already exists")
+	// ErrIdentityLinkedElsewhere means the identity already belongs to a
+	// different account
+	ErrIdentityLinkedElsewhere = errors.New("identity is linked to another account")
+	// ErrLastLoginMethod prevents unlinking the only way into an account
+	ErrLastLoginMethod = errors.New("cannot unlink the only login method of an account")
+)
+
+// Identity is an external identity linked to a user
+type Identity struct {
+	ID        int       `json:"id"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LinkExternalIdentity returns the user an external identity belongs to,
+// creating the user on first login. Identities are keyed by provider and
+// the provider's subject ID; an identity is never attached to an existing
+// account just because the username or email matches. That case fails with
+// ErrIdentityConflict instead.
+func LinkExternalIdentity(identity *models.ExternalIdentity) (*User, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var user User
+	err = tx.QueryRow(`
+		SELECT u.id, u.username, u.email
+		FROM user_identities i
+		JOIN users u ON u.id = i.user_id
+		WHERE i.provider = ? AND i.subject = ?
+	`, identity.Provider, identity.Subject).Scan(&user.ID, &user.Username, &user.Email)
+
+	switch {
+	case err == nil:
+		// Already linked
+	case err != sql.ErrNoRows:
+		return nil, fmt.Errorf("failed to query identity: %v", err)
+	default:
+		username := identity.Username
+		if username == "" {
+			username = identity.Provider + "-" + identity.Subject
+		}
+		// users.email is unique, so accounts without an address get a
+		// placeholder on the reserved .invalid domain
+		email := identity.Email
+		if email == "" {
+			email = identity.Subject + "@" + identity.Provider + ".invalid"
+		}
+
+		// Accounts created by GitHub logins before identities were tracked
+		// are not linked by username either, as GitHub logins can be renamed
+		// and taken by someone else. Their owners reset the password and
+		// log in to link them.
+		err = tx.QueryRow(`
+			SELECT id, username, email
+			FROM users
+			WHERE email = ? OR username = ?
+		`, email, username).Scan(&user.ID, &user.Username, &user.Email)
+
+		switch {
+		case err == sql.ErrNoRows:
+			id, err := insertID(tx, `
+				INSERT INTO users (username, email, password)
+				VALUES (?, ?, ?)
+			`, username, email, noPassword)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create user: %v", err)
+			}
+
+			user = User{
+				ID:       id,
+				Username: username,
+				Email:    email,
+			}
+		case err != nil:
+			return nil, fmt.Errorf("failed to query user: %v", err)
+		default:
+			return nil, ErrIdentityConflict
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO user_identities (user_id, provider, subject, username, email)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(provider, subject) DO UPDATE SET username = excluded.username, email = excluded.email
+	`, user.ID, identity.Provider, identity.Subject, identity.Username, identity.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to link identity: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return &user, nil
+}
+
+// AddIdentity links an external identity to an existing user, e.g. after
+// the user proved ownership of the account by logging in
+func AddIdentity(userID int, identity *models.ExternalIdentity) error {
+	var ownerID int
+	err := DB.QueryRow(`
+		SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?
+	`, identity.Provider, identity.Subject).Scan(&ownerID)
+	switch {
+	case err == nil && ownerID != userID:
+		return ErrIdentityLinkedElsewhere
+	case err != nil && err != sql.ErrNoRows:
+		return fmt.Errorf("failed to query identity: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		INSERT INTO user_identities (user_id, provider, subject, username, email)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(provider, subject) DO UPDATE SET username = excluded.username, email = excluded.email
+	`, userID, identity.Provider, identity.Subject, identity.Username, identity.Email)
+	if err != nil {
+		return fmt.Errorf("failed to link identity: %v", err)
+	}
+	return nil
+}
+
+// GetUserIdentities lists the external identities linked to a user
+func GetUserIdentities(userID int) ([]Identity, error) {
+	rows, err := DB.Query(`
+		SELECT id, provider, subject, COALESCE(username, ''), COALESCE(email, ''), created_at
+		FROM user_identities
+		WHERE user_id = ?
+		ORDER BY provider, created_at
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get identities: %v", err)
+	}
+	defer rows.Close()
+
+	var identities []Identity
+	for rows.Next() {
+		var i Identity
+		if err := rows.Scan(&i.ID, &i.Provider, &i.Subject, &i.Username, &i.Email, &i.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan identity: %v", err)
+		}
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
+
+// UnlinkIdentity removes an external identity from a user. The last
+// identity of an account without a password cannot be removed.
+func UnlinkIdentity(userID, identityID int) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var password string
+	var linked int
+	err = tx.QueryRow(`
+		SELECT u.password, (SELECT COUNT(*) FROM user_identities WHERE user_id = u.id)
+		FROM users u
+		WHERE u.id = ?
+	`, userID).Scan(&password, &linked)
+	if err != nil {
+		return fmt.Errorf("failed to get user: %v", err)
+	}
+
+	hasPassword := password != "" && password != noPassword && password != legacyGithubPassword
+	if !hasPassword && linked <= 1 {
+		return ErrLastLoginMethod
+	}
+
+	result, err := tx.Exec(`
+		DELETE FROM user_identities WHERE id = ? AND user_id = ?
+	`, identityID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to unlink identity: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to unlink identity: %v", err)
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
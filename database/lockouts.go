@@ -0,0 +1,101 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Lockout records an account that was locked after too many failed logins
+type Lockout struct {
+	UserID         int       `json:"user_id"`
+	Username       string    `json:"username"`
+	FailedAttempts int       `json:"failed_attempts"`
+	LastIP         string    `json:"last_ip"`
+	LockedAt       time.Time `json:"locked_at"`
+	LockedUntil    time.Time `json:"locked_until"`
+}
+
+// NormalizeUsername is the form of a username that failed logins are
+// counted under. Lockouts match usernames the same way, ignoring case.
+func NormalizeUsername(username string) string {
+	return strings.ToLower(username)
+}
+
+// LockAccount locks the account with the given username, in any case,
+// until the given time. Unknown usernames are ignored so that lockouts do
+// not reveal which accounts exist.
+func LockAccount(username string, failedAttempts int, ip string, until time.Time) error {
+	_, err := DB.Exec(`
+		INSERT INTO account_lockouts (user_id, failed_attempts, last_ip, locked_at, locked_until)
+		SELECT id, ?, ?, ?, ? FROM users WHERE LOWER(username) = LOWER(?)
+		ON CONFLICT(user_id) DO UPDATE SET
+			failed_attempts = excluded.failed_attempts,
+			last_ip = excluded.last_ip,
+			locked_at = excluded.locked_at,
+			locked_until = excluded.locked_until
+	`, failedAttempts, ip, time.Now().UTC(), until.UTC(), NormalizeUsername(username))
+	if err != nil {
+		return fmt.Errorf("failed to lock account: %v", err)
+	}
+	return nil
+}
+
+// GetActiveLockout returns the lockout of the account with the given
+// username, in any case, or nil if the account is not currently locked
+func GetActiveLockout(username string) (*Lockout, error) {
+	var l Lockout
+	var lastIP sql.NullString
+	err := DB.QueryRow(`
+		SELECT l.user_id, u.username, l.failed_attempts, l.last_ip, l.locked_at, l.locked_until
+		FROM account_lockouts l
+		JOIN users u ON u.id = l.user_id
+		WHERE LOWER(u.username) = LOWER(?) AND l.locked_until > ?
+		ORDER BY l.locked_until DESC
+	`, NormalizeUsername(username), time.Now().UTC()).Scan(&l.UserID, &l.Username, &l.FailedAttempts, &lastIP, &l.LockedAt, &l.LockedUntil)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lockout: %v", err)
+	}
+	l.LastIP = lastIP.String
+	return &l, nil
+}
+
+// GetActiveLockouts lists all accounts that are currently locked
+func GetActiveLockouts() ([]Lockout, error) {
+	rows, err := DB.Query(`
+		SELECT l.user_id, u.username, l.failed_attempts, l.last_ip, l.locked_at, l.locked_until
+		FROM account_lockouts l
+		JOIN users u ON u.id = l.user_id
+		WHERE l.locked_until > ?
+		ORDER BY l.locked_at DESC
+	`, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lockouts: %v", err)
+	}
+	defer rows.Close()
+
+	var lockouts []Lockout
+	for rows.Next() {
+		var l Lockout
+		var lastIP sql.NullString
+		if err := rows.Scan(&l.UserID, &l.Username, &l.FailedAttempts, &lastIP, &l.LockedAt, &l.LockedUntil); err != nil {
+			return nil, fmt.Errorf("failed to scan lockout: %v", err)
+		}
+		l.LastIP = lastIP.String
+		lockouts = append(lockouts, l)
+	}
+	return lockouts, rows.Err()
+}
+
+// UnlockAccount lifts the lockout of a user
+func UnlockAccount(userID int) error {
+	_, err := DB.Exec(`DELETE FROM account_lockouts WHERE user_id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to unlock account: %v", err)
+	}
+	return nil
+}
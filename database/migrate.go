@@ -0,0 +1,328 @@
+package database
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Migrations are numbered pairs of files in migrations/<dialect>/, e.g.
+// 0003_add_tags.up.sql and 0003_add_tags.down.sql. They are applied in
+// order and recorded in schema_migrations. Every dialect has the same
+// versions, each written in its own SQL.
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one versioned change to the schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a known migration and when it was applied, if it was
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// LoadMigrations returns the embedded migrations for the current database
+// in version order
+func LoadMigrations() ([]Migration, error) {
+	dir := path.Join("migrations", dbDialect.name)
+	files, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %v", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, f := range files {
+		m := migrationName.FindStringSubmatch(f.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s is not named NNNN_name.up.sql or NNNN_name.down.sql", f.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		body, err := migrationFiles.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %v", f.Name(), err)
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		} else if migration.Name != m[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, migration.Name, m[2])
+		}
+		if m[3] == "up" {
+			migration.Up = string(body)
+		} else {
+			migration.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// MigrateUp applies pending migrations up to and including target, or all
+// of them when target is zero. It returns the migrations it applied.
+func MigrateUp(target int) ([]Migration, error) {
+	if err := adoptLegacySchema(); err != nil {
+		return nil, err
+	}
+	return migrateUp(DB, target)
+}
+
+// MigrateDown reverts the last steps applied migrations and returns them
+func MigrateDown(steps int) ([]Migration, error) {
+	if err := adoptLegacySchema(); err != nil {
+		return nil, err
+	}
+	return migrateDown(DB, steps)
+}
+
+// GetMigrationStatus lists every known migration and whether it has been
+// applied
+func GetMigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	// Reading the status must not start tracking a database that still
+	// needs adopting
+	applied := map[int]time.Time{}
+	if tracked, err := tableExists("schema_migrations"); err != nil {
+		return nil, err
+	} else if tracked {
+		if applied, err = appliedMigrations(DB); err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{Migration: m}
+		if at, ok := applied[m.Version]; ok {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func migrateUp(db *sql.DB, target int) ([]Migration, error) {
+	migrations, applied, err := loadMigrationState(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range migrations {
+		if target != 0 && m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		err := runMigration(db, m.Up, `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.Version, m.Name)
+		if err != nil {
+			return done, fmt.Errorf("failed to apply migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+func migrateDown(db *sql.DB, steps int) ([]Migration, error) {
+	migrations, applied, err := loadMigrationState(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		err := runMigration(db, m.Down, `DELETE FROM schema_migrations WHERE version = ?`, m.Version)
+		if err != nil {
+			return done, fmt.Errorf("failed to revert migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+		log.Printf("Reverted migration %04d_%s", m.Version, m.Name)
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// loadMigrationState returns the known migrations and the applied ones. A
+// database carrying migrations this build does not know is refused.
+func loadMigrationState(db *sql.DB) ([]Migration, map[int]time.Time, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := createMigrationsTable(db); err != nil {
+		return nil, nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	known := make(map[int]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = true
+	}
+	for version := range applied {
+		if !known[version] {
+			return nil, nil, fmt.Errorf("database has migration %d applied, which this build does not know", version)
+		}
+	}
+	return migrations, applied, nil
+}
+
+// runMigration runs a migration script and records it in one transaction
+func runMigration(db *sql.DB, script, record string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func createMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+	return nil
+}
+
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("failed to read schema_migrations: %v", err)
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// adoptLegacySchema brings a database created before migrations existed up
+// to the initial migration and records it as applied. Such databases have
+// tables but no schema_migrations. Only SQLite databases predate
+// migrations.
+func adoptLegacySchema() error {
+	if dbDialect != sqliteDialect {
+		return nil
+	}
+	legacy, err := tableExists("users")
+	if err != nil {
+		return err
+	}
+	tracked, err := tableExists("schema_migrations")
+	if err != nil {
+		return err
+	}
+	if !legacy || tracked {
+		return nil
+	}
+
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return err
+	}
+	initial := migrations[0]
+
+	log.Printf("Adopting existing database at migration %04d_%s", initial.Version, initial.Name)
+	// The initial migration only creates what is missing
+	if _, err := DB.Exec(initial.Up); err != nil {
+		return fmt.Errorf("failed to create missing tables: %v", err)
+	}
+
+	// Columns added to tables after they were first released
+	columns := []struct {
+		table, column, definition string
+	}{
+		{"attempts", "seed", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "role", "TEXT NOT NULL DEFAULT 'player'"},
+		{"users", "email_verified", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"quizzes", "status", "TEXT NOT NULL DEFAULT 'published'"},
+		{"questions", "position", "INTEGER NOT NULL DEFAULT 0"},
+		{"attempt_answers", "option_id", "INTEGER REFERENCES question_options(id)"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfNotExists(c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	if err := convertLegacyOptions(); err != nil {
+		return err
+	}
+
+	if err := createMigrationsTable(DB); err != nil {
+		return err
+	}
+	_, err = DB.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, initial.Version, initial.Name)
+	if err != nil {
+		return fmt.Errorf("failed to record migration %04d_%s: %v", initial.Version, initial.Name, err)
+	}
+	return nil
+}
+
+func tableExists(name string) (bool, error) {
+	tables, err := listTables(DB)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect database: %v", err)
+	}
+	for _, table := range tables {
+		if table == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,37 @@
+package database
+
+import "testing"
+
+// TestMigrations applies every migration to an empty database, reverts them
+// all and applies them again, so a migration that does not run cleanly or
+// whose down file leaves tables behind fails here rather than in production
+func TestMigrations(t *testing.T) {
+	forEachDialect(t, testMigrations)
+}
+
+func testMigrations(t *testing.T) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateUp(DB, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateDown(DB, len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+
+	tables, err := listTables(DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if table != "schema_migrations" {
+			t.Errorf("table %s is left after reverting every migration", table)
+		}
+	}
+
+	if _, err := migrateUp(DB, 0); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,3 @@
+-- The old values are not restored; options stay in question_options
+ALTER TABLE questions ADD COLUMN options TEXT NOT NULL DEFAULT '';
+ALTER TABLE questions ADD COLUMN answer TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+-- Options live in question_options since they were converted out of these
+-- "|"-joined columns
+ALTER TABLE questions DROP COLUMN options;
+ALTER TABLE questions DROP COLUMN answer;
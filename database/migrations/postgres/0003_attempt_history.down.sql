@@ -0,0 +1,16 @@
+-- Attempts added for old best scores are kept
+CREATE TABLE quiz_results (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    quiz_id INTEGER NOT NULL REFERENCES quizzes(id),
+    score DOUBLE PRECISION NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, quiz_id)
+);
+
+INSERT INTO quiz_results (user_id, quiz_id, score)
+SELECT user_id, quiz_id, score FROM best_scores;
+
+DROP VIEW best_scores;
+ALTER TABLE attempt_answers DROP COLUMN time_taken_ms;
+ALTER TABLE attempts DROP COLUMN score;
@@ -0,0 +1,32 @@
+-- Every submitted attempt keeps its score, and best scores are derived from
+-- them instead of being kept in quiz_results
+ALTER TABLE attempts ADD COLUMN score DOUBLE PRECISION;
+ALTER TABLE attempt_answers ADD COLUMN time_taken_ms INTEGER;
+
+-- Attempts submitted before scores were stored are scored from their
+-- answers against the quiz as it is now
+UPDATE attempts SET score = (
+    SELECT 100.0 * COUNT(CASE WHEN aa.is_correct THEN 1 END)
+        / NULLIF((SELECT COUNT(*) FROM questions WHERE quiz_id = attempts.quiz_id), 0)
+    FROM attempt_answers aa
+    WHERE aa.attempt_id = attempts.id
+)
+WHERE submitted_at IS NOT NULL;
+
+-- Best scores no attempt accounts for, e.g. from before attempts were
+-- recorded, become attempts without answers
+INSERT INTO attempts (user_id, quiz_id, started_at, submitted_at, seed, score)
+SELECT qr.user_id, qr.quiz_id, COALESCE(qr.created_at, CURRENT_TIMESTAMP), COALESCE(qr.created_at, CURRENT_TIMESTAMP), 0, qr.score
+FROM quiz_results qr
+WHERE NOT EXISTS (
+    SELECT 1 FROM attempts a
+    WHERE a.user_id = qr.user_id AND a.quiz_id = qr.quiz_id AND a.score >= qr.score
+);
+
+DROP TABLE quiz_results;
+
+CREATE VIEW best_scores AS
+SELECT user_id, quiz_id, MAX(score) AS score
+FROM attempts
+WHERE score IS NOT NULL
+GROUP BY user_id, quiz_id;
@@ -0,0 +1,10 @@
+DROP VIEW best_scores;
+CREATE VIEW best_scores AS
+SELECT user_id, quiz_id, MAX(score) AS score
+FROM attempts
+WHERE score IS NOT NULL
+GROUP BY user_id, quiz_id;
+
+ALTER TABLE attempts DROP COLUMN points;
+ALTER TABLE attempts DROP COLUMN scoring_policy;
+ALTER TABLE quizzes DROP COLUMN scoring_policy;
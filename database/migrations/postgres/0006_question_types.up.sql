@@ -0,0 +1,11 @@
+-- Questions come in several types. The options of a free-text question
+-- are the answers it accepts.
+ALTER TABLE questions ADD COLUMN type TEXT NOT NULL DEFAULT 'multiple_choice';
+
+-- Answers keep what the player sent, as JSON, and the share of the
+-- question's points it earned, since some types give partial credit
+ALTER TABLE attempt_answers ADD COLUMN response TEXT NOT NULL DEFAULT '';
+ALTER TABLE attempt_answers ADD COLUMN credit DOUBLE PRECISION NOT NULL DEFAULT 0;
+
+UPDATE attempt_answers SET response = CAST(option_id AS TEXT) WHERE option_id IS NOT NULL;
+UPDATE attempt_answers SET credit = 1 WHERE is_correct;
@@ -0,0 +1,4 @@
+-- Deleted questions and options are only marked as such, since the answers
+-- of past attempts still refer to them
+ALTER TABLE questions ADD COLUMN deleted_at TIMESTAMPTZ;
+ALTER TABLE question_options ADD COLUMN deleted_at TIMESTAMPTZ;
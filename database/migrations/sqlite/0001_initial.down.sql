@@ -0,0 +1,15 @@
+DROP TABLE IF EXISTS account_lockouts;
+DROP TABLE IF EXISTS question_options;
+DROP TABLE IF EXISTS api_tokens;
+DROP TABLE IF EXISTS user_tokens;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS user_totp;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS user_identities;
+DROP TABLE IF EXISTS attempt_answers;
+DROP TABLE IF EXISTS attempts;
+DROP TABLE IF EXISTS quiz_results;
+DROP TABLE IF EXISTS scores;
+DROP TABLE IF EXISTS questions;
+DROP TABLE IF EXISTS quizzes;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,18 @@
+-- Attempts added for old best scores are kept
+CREATE TABLE quiz_results (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    quiz_id INTEGER NOT NULL,
+    score REAL NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (quiz_id) REFERENCES quizzes(id),
+    UNIQUE(user_id, quiz_id)
+);
+
+INSERT INTO quiz_results (user_id, quiz_id, score)
+SELECT user_id, quiz_id, score FROM best_scores;
+
+DROP VIEW best_scores;
+ALTER TABLE attempt_answers DROP COLUMN time_taken_ms;
+ALTER TABLE attempts DROP COLUMN score;
@@ -0,0 +1,6 @@
+DROP TABLE attempt_questions;
+ALTER TABLE attempt_answers DROP COLUMN timed_out;
+ALTER TABLE attempts DROP COLUMN time_limit;
+ALTER TABLE attempts DROP COLUMN question_time_limit;
+ALTER TABLE quizzes DROP COLUMN time_limit;
+ALTER TABLE quizzes DROP COLUMN question_time_limit;
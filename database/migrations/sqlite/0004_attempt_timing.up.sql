@@ -0,0 +1,18 @@
+-- Time limits are kept on the quiz in seconds, zero meaning no limit, and
+-- copied onto each attempt when it starts so editing a quiz does not
+-- change the rules of attempts already under way
+ALTER TABLE quizzes ADD COLUMN question_time_limit INTEGER NOT NULL DEFAULT 40;
+ALTER TABLE quizzes ADD COLUMN time_limit INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE attempts ADD COLUMN question_time_limit INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE attempts ADD COLUMN time_limit INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE attempt_answers ADD COLUMN timed_out BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- When each question of an attempt was first sent to the player
+CREATE TABLE attempt_questions (
+    attempt_id INTEGER NOT NULL,
+    question_id INTEGER NOT NULL,
+    served_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (attempt_id, question_id),
+    FOREIGN KEY (attempt_id) REFERENCES attempts(id),
+    FOREIGN KEY (question_id) REFERENCES questions(id)
+);
@@ -0,0 +1,27 @@
+-- How a quiz turns answers into points. Attempts keep the policy they
+-- started with, like their time limits, and store the points they scored
+-- next to the percentage.
+ALTER TABLE quizzes ADD COLUMN scoring_policy TEXT NOT NULL DEFAULT 'percentage';
+ALTER TABLE attempts ADD COLUMN scoring_policy TEXT NOT NULL DEFAULT 'percentage';
+ALTER TABLE attempts ADD COLUMN points REAL;
+
+-- Under the percentage policy every correct answer is worth 100 points.
+-- Attempts without recorded answers are worked out from their score.
+UPDATE attempts SET points = CASE
+    WHEN EXISTS (SELECT 1 FROM attempt_answers aa WHERE aa.attempt_id = attempts.id)
+    THEN 100.0 * (SELECT COUNT(*) FROM attempt_answers aa WHERE aa.attempt_id = attempts.id AND aa.is_correct)
+    ELSE ROUND(score * (SELECT COUNT(*) FROM questions WHERE quiz_id = attempts.quiz_id) / 100.0) * 100
+END
+WHERE score IS NOT NULL;
+
+-- A player's best attempt at a quiz is the one with the most points
+DROP VIEW best_scores;
+CREATE VIEW best_scores AS
+SELECT user_id, quiz_id, score, points
+FROM (
+    SELECT user_id, quiz_id, score, points,
+        ROW_NUMBER() OVER (PARTITION BY user_id, quiz_id ORDER BY points DESC, score DESC, id) AS n
+    FROM attempts
+    WHERE score IS NOT NULL
+) ranked
+WHERE n = 1;
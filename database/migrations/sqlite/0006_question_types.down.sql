@@ -0,0 +1,3 @@
+ALTER TABLE attempt_answers DROP COLUMN credit;
+ALTER TABLE attempt_answers DROP COLUMN response;
+ALTER TABLE questions DROP COLUMN type;
@@ -0,0 +1,2 @@
+ALTER TABLE question_options DROP COLUMN match_text;
+ALTER TABLE questions DROP COLUMN tolerance;
@@ -0,0 +1,6 @@
+-- A numeric question accepts answers within its tolerance of the value of
+-- its only option
+ALTER TABLE questions ADD COLUMN tolerance REAL NOT NULL DEFAULT 0;
+
+-- Each option of a matching question is paired with the text it matches
+ALTER TABLE question_options ADD COLUMN match_text TEXT NOT NULL DEFAULT '';
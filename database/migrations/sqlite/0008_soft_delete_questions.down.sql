@@ -0,0 +1,12 @@
+-- Without the columns deleted rows would come back, so they are removed
+-- together with the answers that refer to them
+UPDATE attempt_answers SET option_id = NULL
+WHERE option_id IN (SELECT id FROM question_options WHERE deleted_at IS NOT NULL);
+DELETE FROM attempt_answers WHERE question_id IN (SELECT id FROM questions WHERE deleted_at IS NOT NULL);
+DELETE FROM attempt_questions WHERE question_id IN (SELECT id FROM questions WHERE deleted_at IS NOT NULL);
+DELETE FROM question_options
+WHERE deleted_at IS NOT NULL OR question_id IN (SELECT id FROM questions WHERE deleted_at IS NOT NULL);
+DELETE FROM questions WHERE deleted_at IS NOT NULL;
+
+ALTER TABLE question_options DROP COLUMN deleted_at;
+ALTER TABLE questions DROP COLUMN deleted_at;
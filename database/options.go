@@ -0,0 +1,325 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Option is one of the choices offered for a question
+type Option struct {
+	ID        int    `json:"id"`
+	Text      string `json:"text"`
+	IsCorrect bool   `json:"is_correct"`
+	// Match is the text the option is paired with in a matching question
+	Match string `json:"match,omitempty"`
+}
+
+// PlayerOption is an option as shown to a player, without saying whether
+// it is correct
+type PlayerOption struct {
+	ID   int    `json:"id"`
+	Text string `json:"text"`
+}
+
+// Option returns the option of q with the given ID, or nil
+func (q *Question) Option(optionID int) *Option {
+	for i := range q.Options {
+		if q.Options[i].ID == optionID {
+			return &q.Options[i]
+		}
+	}
+	return nil
+}
+
+// CorrectOption returns the option marked as the correct answer, or nil
+func (q *Question) CorrectOption() *Option {
+	for i := range q.Options {
+		if q.Options[i].IsCorrect {
+			return &q.Options[i]
+		}
+	}
+	return nil
+}
+
+// CorrectOptions returns every option marked correct
+func (q *Question) CorrectOptions() []Option {
+	var correct []Option
+	for _, o := range q.Options {
+		if o.IsCorrect {
+			correct = append(correct, o)
+		}
+	}
+	return correct
+}
+
+// PlayerOptions returns the options of q without their correctness or
+// matches. Free-text and numeric questions have none to show, as their
+// options are the answer.
+func (q *Question) PlayerOptions() []PlayerOption {
+	options := make([]PlayerOption, 0, len(q.Options))
+	if q.Type == QuestionFreeText || q.Type == QuestionNumeric {
+		return options
+	}
+	for _, o := range q.Options {
+		options = append(options, PlayerOption{ID: o.ID, Text: o.Text})
+	}
+	return options
+}
+
+// PlayerMatches returns the matches of a matching question in alphabetical
+// order, so their order says nothing about which option they belong to
+func (q *Question) PlayerMatches() []string {
+	if q.Type != QuestionMatching {
+		return nil
+	}
+	matches := make([]string, 0, len(q.Options))
+	for _, o := range q.Options {
+		matches = append(matches, o.Match)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// OptionMatching returns the option of q whose match is the given text, or
+// nil
+func (q *Question) OptionMatching(match string) *Option {
+	for i := range q.Options {
+		if q.Options[i].Match == match {
+			return &q.Options[i]
+		}
+	}
+	return nil
+}
+
+// optionsByQuestion groups loaded options by question ID
+type optionsByQuestion map[int][]Option
+
+func (o optionsByQuestion) of(questionID int) []Option {
+	if options, ok := o[questionID]; ok {
+		return options
+	}
+	return []Option{}
+}
+
+// getOptions loads the options of the questions matching cond, which may
+// refer to the question as q
+func getOptions(cond string, args ...interface{}) (optionsByQuestion, error) {
+	rows, err := DB.Query(`
+		SELECT o.id, o.question_id, o.text, o.is_correct, o.match_text
+		FROM question_options o
+		JOIN questions q ON q.id = o.question_id
+		WHERE o.deleted_at IS NULL AND `+cond+`
+		ORDER BY o.question_id, o.position, o.id
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get options: %v", err)
+	}
+	defer rows.Close()
+
+	options := make(optionsByQuestion)
+	for rows.Next() {
+		var o Option
+		var questionID int
+		if err := rows.Scan(&o.ID, &questionID, &o.Text, &o.IsCorrect, &o.Match); err != nil {
+			return nil, fmt.Errorf("failed to scan option: %v", err)
+		}
+		options[questionID] = append(options[questionID], o)
+	}
+	return options, rows.Err()
+}
+
+// insertOptions stores the options of a new question in order and fills in
+// their IDs
+func insertOptions(db execer, questionID int, options []Option) error {
+	for i := range options {
+		id, err := insertID(db, `
+			INSERT INTO question_options (question_id, position, text, is_correct, match_text)
+			VALUES (?, ?, ?, ?, ?)
+		`, questionID, i+1, options[i].Text, options[i].IsCorrect, options[i].Match)
+		if err != nil {
+			return fmt.Errorf("failed to insert option: %v", err)
+		}
+		options[i].ID = id
+	}
+	return nil
+}
+
+// replaceOptions makes the stored options of a question match options.
+// An option keeps its ID when it is given with that ID or, failing that,
+// with the same text, so answers already locked in still point at it.
+// Options left out are only marked deleted, as past answers may have
+// chosen them.
+func replaceOptions(tx *sql.Tx, questionID int, options []Option) error {
+	rows, err := tx.Query(`SELECT id, text FROM question_options WHERE question_id = ? AND deleted_at IS NULL`, questionID)
+	if err != nil {
+		return fmt.Errorf("failed to get options: %v", err)
+	}
+	existing := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var text string
+		if err := rows.Scan(&id, &text); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan option: %v", err)
+		}
+		existing[id] = text
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to get options: %v", err)
+	}
+
+	// Claim options given by ID before matching the rest by text
+	kept := make(map[int]bool)
+	for i := range options {
+		if _, ok := existing[options[i].ID]; ok && !kept[options[i].ID] {
+			kept[options[i].ID] = true
+		} else {
+			options[i].ID = 0
+		}
+	}
+	for i := range options {
+		if options[i].ID != 0 {
+			continue
+		}
+		for id, text := range existing {
+			if text == options[i].Text && !kept[id] {
+				options[i].ID = id
+				kept[id] = true
+				break
+			}
+		}
+	}
+
+	now := time.Now().UTC()
+	for id := range existing {
+		if !kept[id] {
+			if _, err := tx.Exec(`UPDATE question_options SET deleted_at = ? WHERE id = ?`, now, id); err != nil {
+				return fmt.Errorf("failed to delete option: %v", err)
+			}
+		}
+	}
+	for i, o := range options {
+		if o.ID == 0 {
+			if err := insertOptions(tx, questionID, options[i:i+1]); err != nil {
+				return err
+			}
+			o = options[i]
+		}
+		_, err := tx.Exec(`
+			UPDATE question_options SET position = ?, text = ?, is_correct = ?, match_text = ?
+			WHERE id = ?
+		`, i+1, o.Text, o.IsCorrect, o.Match, o.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update option: %v", err)
+		}
+	}
+	return nil
+}
+
+// convertLegacyOptions moves options still stored "|"-joined in
+// questions.options into question_options and links the answers already
+// locked in for them to the new rows. Converted questions have the old
+// columns cleared, so this only does work once.
+func convertLegacyOptions() error {
+	type legacyQuestion struct {
+		id              int
+		options, answer string
+	}
+
+	rows, err := DB.Query(`SELECT id, options, answer FROM questions WHERE options != ''`)
+	if err != nil {
+		return fmt.Errorf("failed to find legacy options: %v", err)
+	}
+	var legacy []legacyQuestion
+	for rows.Next() {
+		var q legacyQuestion
+		if err := rows.Scan(&q.id, &q.options, &q.answer); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan legacy options: %v", err)
+		}
+		legacy = append(legacy, q)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to find legacy options: %v", err)
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to convert options: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, q := range legacy {
+		options := splitLegacyOptions(q.options, q.answer)
+		if (&Question{Options: options}).CorrectOption() == nil {
+			log.Printf("Question %d: answer %q is not one of its options", q.id, q.answer)
+		}
+		// This runs on the initial schema, before later migrations add
+		// columns to question_options, so only its original columns are set
+		for i, o := range options {
+			_, err := tx.Exec(`
+				INSERT INTO question_options (question_id, position, text, is_correct)
+				VALUES (?, ?, ?, ?)
+			`, q.id, i+1, o.Text, o.IsCorrect)
+			if err != nil {
+				return fmt.Errorf("failed to insert option: %v", err)
+			}
+		}
+		if _, err := tx.Exec(`UPDATE questions SET options = '', answer = '' WHERE id = ?`, q.id); err != nil {
+			return fmt.Errorf("failed to convert options: %v", err)
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE attempt_answers
+		SET option_id = (
+			SELECT o.id FROM question_options o
+			WHERE o.question_id = attempt_answers.question_id AND o.text = attempt_answers.answer
+			ORDER BY o.position
+			LIMIT 1
+		)
+		WHERE option_id IS NULL AND answer != ''
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to link answers to options: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to convert options: %v", err)
+	}
+	log.Printf("Converted the options of %d questions", len(legacy))
+	return nil
+}
+
+// splitLegacyOptions splits "|"-joined options. An answer that itself
+// contained "|" was split along with the options, so the run of pieces
+// that spells it is joined back together.
+func splitLegacyOptions(joined, answer string) []Option {
+	parts := strings.Split(joined, "|")
+	if n := strings.Count(answer, "|") + 1; n > 1 {
+		for i := 0; i+n <= len(parts); i++ {
+			if strings.Join(parts[i:i+n], "|") == answer {
+				parts = append(parts[:i:i], append([]string{answer}, parts[i+n:]...)...)
+				break
+			}
+		}
+	}
+
+	options := make([]Option, 0, len(parts))
+	marked := false
+	for _, text := range parts {
+		correct := !marked && text == answer
+		marked = marked || correct
+		options = append(options, Option{Text: text, IsCorrect: correct})
+	}
+	return options
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Stored passwords are prefixed with the algorithm that produced them. The
+// bcrypt hash itself carries the cost it was generated with.
+const (
+	bcryptPrefix = "bcrypt:"
+	bcryptCost   = 12
+
+	// noPassword marks accounts that can only be used through an external
+	// identity provider. It never matches any password.
+	noPassword = "!"
+
+	// legacyGithubPassword is the placeholder GitHub accounts used to be
+	// created with
+	legacyGithubPassword = "github-auth"
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// compareDummyHash spends as long as checking a real password does, so
+// failed logins take the same time whether or not the account exists
+func compareDummyHash(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcryptCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// HashPassword hashes a password for storage
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %v", err)
+	}
+	return bcryptPrefix + string(hash), nil
+}
+
+// checkPassword compares a password against its stored form. needsRehash is
+// set when the password matched but was stored as plaintext or with weaker
+// parameters than are used today.
+func checkPassword(stored, password string) (ok, needsRehash bool) {
+	switch {
+	case stored == "" || stored == noPassword || stored == legacyGithubPassword:
+		compareDummyHash(password)
+		return false, false
+	case strings.HasPrefix(stored, bcryptPrefix):
+		hash := []byte(strings.TrimPrefix(stored, bcryptPrefix))
+		if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost(hash)
+		return true, err != nil || cost < bcryptCost
+	default:
+		// Rows written before passwords were hashed
+		compareDummyHash(password)
+		ok := subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+}
+
+// AuthenticateUser checks a username and password. Passwords that are still
+// stored in plaintext are rehashed on a successful login.
+func AuthenticateUser(username, password string) (*User, error) {
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			compareDummyHash(password)
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	ok, needsRehash := checkPassword(user.Password, password)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	if needsRehash {
+		if err := SetPassword(user.ID, password); err != nil {
+			log.Printf("Failed to rehash password for user %d: %v", user.ID, err)
+		}
+	}
+
+	return user, nil
+}
+
+// SetPassword hashes and stores a new password for a user
+func SetPassword(userID int, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Exec(`
+		UPDATE users SET password = ? WHERE id = ?
+	`, hash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %v", err)
+	}
+	return nil
+}
+
+// disableLegacyGithubPasswords replaces the shared placeholder password of
+// GitHub-created accounts so it can never be used to log in
+func disableLegacyGithubPasswords() error {
+	_, err := DB.Exec(`
+		UPDATE users SET password = ? WHERE password = ?
+	`, noPassword, legacyGithubPassword)
+	if err != nil {
+		return fmt.Errorf("failed to disable placeholder passwords: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,703 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Publication states of a quiz. Drafts are only visible to the people who
+// can edit them and cannot be played.
+const (
+	QuizDraft     = "draft"
+	QuizPublished = "published"
+)
+
+// ErrInvalidQuiz wraps the reasons a quiz or question is rejected
+var ErrInvalidQuiz = errors.New("invalid quiz")
+
+// DefaultTimeLimits are the time limits of a new quiz
+var DefaultTimeLimits = TimeLimits{Question: 40}
+
+// Scoring policies decide how many points the answers of an attempt are
+// worth. Every policy gives 100 points for a correct answer; speed bonus
+// adds up to 50 for answering quickly, streak multiplies the points of
+// consecutive correct answers and negative marking takes 50 off for each
+// wrong one.
+const (
+	ScoringPercentage = "percentage"
+	ScoringSpeedBonus = "speed_bonus"
+	ScoringStreak     = "streak"
+	ScoringNegative   = "negative_marking"
+)
+
+// ScoringPolicies lists the scoring policies in the order they are offered
+var ScoringPolicies = []string{ScoringPercentage, ScoringSpeedBonus, ScoringStreak, ScoringNegative}
+
+// Types of question. True/false and multiple choice questions have one
+// correct option and multi-select ones any number, with partial credit for
+// getting some of them. The options of a free-text question are the
+// answers it accepts, and the only option of a numeric one is its value;
+// neither is shown to players. An ordering question lists its options in
+// the correct order, and each option of a matching question carries the
+// text it is matched with.
+const (
+	QuestionMultipleChoice = "multiple_choice"
+	QuestionTrueFalse      = "true_false"
+	QuestionMultiSelect    = "multi_select"
+	QuestionFreeText       = "free_text"
+	QuestionNumeric        = "numeric"
+	QuestionOrdering       = "ordering"
+	QuestionMatching       = "matching"
+)
+
+// QuestionTypes lists the question types in the order they are offered
+var QuestionTypes = []string{
+	QuestionMultipleChoice, QuestionTrueFalse, QuestionMultiSelect, QuestionFreeText,
+	QuestionNumeric, QuestionOrdering, QuestionMatching,
+}
+
+// answerKeyTypes are the question types whose options all make up the
+// answer rather than being choices that may be wrong
+var answerKeyTypes = []string{QuestionFreeText, QuestionNumeric, QuestionOrdering, QuestionMatching}
+
+// Longest time limits an author can set, in seconds
+const (
+	maxQuestionTimeLimit = 60 * 60
+	maxQuizTimeLimit     = 24 * 60 * 60
+)
+
+// IsPublished reports whether players can see and take the quiz
+func (q *Quiz) IsPublished() bool {
+	return q.Status == QuizPublished
+}
+
+// QuizSummary is a quiz without its questions, as shown in listings
+type QuizSummary struct {
+	ID            int        `json:"id"`
+	Title         string     `json:"title"`
+	CreatedBy     int        `json:"created_by"`
+	Status        string     `json:"status"`
+	QuestionCount int        `json:"question_count"`
+	TimeLimits    TimeLimits `json:"time_limits"`
+	ScoringPolicy string     `json:"scoring_policy"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// QuizFilter narrows down ListQuizzes. Zero values do not filter.
+type QuizFilter struct {
+	Search    string
+	CreatedBy int
+	// Viewer hides the drafts that user cannot edit
+	Viewer *User
+	Limit  int
+	Offset int
+}
+
+// ListQuizzes returns one page of quizzes, newest first, and the total
+// number of quizzes matching the filter
+func ListQuizzes(filter QuizFilter) ([]QuizSummary, int, error) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if filter.Search != "" {
+		where = append(where, "q.title "+dbDialect.like+" ? ESCAPE '\\'")
+		args = append(args, "%"+escapeLike(filter.Search)+"%")
+	}
+	if filter.CreatedBy != 0 {
+		where = append(where, "q.created_by = ?")
+		args = append(args, filter.CreatedBy)
+	}
+	if filter.Viewer != nil && !filter.Viewer.HasRole(RoleAdmin) {
+		where = append(where, "(q.status = ? OR q.created_by = ?)")
+		args = append(args, QuizPublished, filter.Viewer.ID)
+	}
+	cond := strings.Join(where, " AND ")
+
+	var total int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM quizzes q WHERE `+cond, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count quizzes: %v", err)
+	}
+
+	rows, err := DB.Query(`
+		SELECT q.id, q.title, COALESCE(q.created_by, 0), q.status, COUNT(qs.id), q.question_time_limit, q.time_limit, q.scoring_policy, q.created_at
+		FROM quizzes q
+		LEFT JOIN questions qs ON qs.quiz_id = q.id AND qs.deleted_at IS NULL
+		WHERE `+cond+`
+		GROUP BY q.id
+		ORDER BY q.created_at DESC, q.id DESC
+		LIMIT ? OFFSET ?
+	`, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list quizzes: %v", err)
+	}
+	defer rows.Close()
+
+	quizzes := []QuizSummary{}
+	for rows.Next() {
+		var q QuizSummary
+		if err := rows.Scan(&q.ID, &q.Title, &q.CreatedBy, &q.Status, &q.QuestionCount, &q.TimeLimits.Question, &q.TimeLimits.Quiz, &q.ScoringPolicy, &q.CreatedAt); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan quiz: %v", err)
+		}
+		quizzes = append(quizzes, q)
+	}
+	return quizzes, total, rows.Err()
+}
+
+// GetQuizSummary returns a quiz without its questions
+func GetQuizSummary(quizID int) (*QuizSummary, error) {
+	var q QuizSummary
+	err := DB.QueryRow(`
+		SELECT q.id, q.title, COALESCE(q.created_by, 0), q.status, COUNT(qs.id), q.question_time_limit, q.time_limit, q.scoring_policy, q.created_at
+		FROM quizzes q
+		LEFT JOIN questions qs ON qs.quiz_id = q.id AND qs.deleted_at IS NULL
+		WHERE q.id = ?
+		GROUP BY q.id
+	`, quizID).Scan(&q.ID, &q.Title, &q.CreatedBy, &q.Status, &q.QuestionCount, &q.TimeLimits.Question, &q.TimeLimits.Quiz, &q.ScoringPolicy, &q.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// CreateQuiz stores a new quiz and its questions. The scoring policy
+// defaults to ScoringPercentage.
+func CreateQuiz(quiz Quiz) (*Quiz, error) {
+	quiz.Title = strings.TrimSpace(quiz.Title)
+	if quiz.Title == "" {
+		return nil, fmt.Errorf("%w: title is required", ErrInvalidQuiz)
+	}
+	if quiz.ScoringPolicy == "" {
+		quiz.ScoringPolicy = ScoringPercentage
+	}
+	if err := validateStatus(quiz.Status, len(quiz.Questions)); err != nil {
+		return nil, err
+	}
+	if err := validateTimeLimits(quiz.TimeLimits); err != nil {
+		return nil, err
+	}
+	if err := validateScoringPolicy(quiz.ScoringPolicy); err != nil {
+		return nil, err
+	}
+	questions := quiz.Questions
+	for i := range questions {
+		if err := ValidateQuestion(&questions[i]); err != nil {
+			return nil, fmt.Errorf("question %d: %w", i+1, err)
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create quiz: %v", err)
+	}
+	defer tx.Rollback()
+
+	quiz.ID, err = insertID(tx, `
+		INSERT INTO quizzes (title, created_by, status, question_time_limit, time_limit, scoring_policy)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, quiz.Title, quiz.CreatedBy, quiz.Status, quiz.TimeLimits.Question, quiz.TimeLimits.Quiz, quiz.ScoringPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create quiz: %v", err)
+	}
+
+	quiz.Questions = []Question{}
+	for _, q := range questions {
+		q.QuizID = quiz.ID
+		if err := insertQuestion(tx, &q); err != nil {
+			return nil, err
+		}
+		quiz.Questions = append(quiz.Questions, q)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to create quiz: %v", err)
+	}
+	return &quiz, nil
+}
+
+// UpdateQuizTitle renames a quiz
+func UpdateQuizTitle(quizID int, title string) error {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return fmt.Errorf("%w: title is required", ErrInvalidQuiz)
+	}
+	result, err := DB.Exec(`UPDATE quizzes SET title = ? WHERE id = ?`, title, quizID)
+	if err != nil {
+		return fmt.Errorf("failed to update quiz: %v", err)
+	}
+	return expectOneRow(result)
+}
+
+// UpdateQuiz saves the title, status, time limits and scoring policy of a
+// quiz together, after checking all of them, so a rejected field leaves
+// the others unchanged too. The title is trimmed in place.
+func UpdateQuiz(quiz *Quiz) error {
+	quiz.Title = strings.TrimSpace(quiz.Title)
+	if quiz.Title == "" {
+		return fmt.Errorf("%w: title is required", ErrInvalidQuiz)
+	}
+	if err := validateTimeLimits(quiz.TimeLimits); err != nil {
+		return err
+	}
+	if err := validateScoringPolicy(quiz.ScoringPolicy); err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to update quiz: %v", err)
+	}
+	defer tx.Rollback()
+
+	var questions int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM questions WHERE quiz_id = ? AND deleted_at IS NULL`, quiz.ID).Scan(&questions); err != nil {
+		return fmt.Errorf("failed to count questions: %v", err)
+	}
+	if err := validateStatus(quiz.Status, questions); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE quizzes SET title = ?, status = ?, question_time_limit = ?, time_limit = ?, scoring_policy = ?
+		WHERE id = ?
+	`, quiz.Title, quiz.Status, quiz.TimeLimits.Question, quiz.TimeLimits.Quiz, quiz.ScoringPolicy, quiz.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update quiz: %v", err)
+	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetQuizStatus publishes a quiz or takes it back to draft. Only quizzes
+// with at least one question can be published.
+func SetQuizStatus(quizID int, status string) error {
+	var questions int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM questions WHERE quiz_id = ? AND deleted_at IS NULL`, quizID).Scan(&questions); err != nil {
+		return fmt.Errorf("failed to count questions: %v", err)
+	}
+	if err := validateStatus(status, questions); err != nil {
+		return err
+	}
+
+	result, err := DB.Exec(`UPDATE quizzes SET status = ? WHERE id = ?`, status, quizID)
+	if err != nil {
+		return fmt.Errorf("failed to update quiz status: %v", err)
+	}
+	return expectOneRow(result)
+}
+
+// SetQuizTimeLimits changes the time limits of a quiz. Attempts already
+// started keep the limits they started with.
+func SetQuizTimeLimits(quizID int, limits TimeLimits) error {
+	if err := validateTimeLimits(limits); err != nil {
+		return err
+	}
+	result, err := DB.Exec(`
+		UPDATE quizzes SET question_time_limit = ?, time_limit = ? WHERE id = ?
+	`, limits.Question, limits.Quiz, quizID)
+	if err != nil {
+		return fmt.Errorf("failed to update time limits: %v", err)
+	}
+	return expectOneRow(result)
+}
+
+// SetScoringPolicy changes how a quiz is scored. Attempts already started
+// are scored under the policy they started with.
+func SetScoringPolicy(quizID int, policy string) error {
+	if err := validateScoringPolicy(policy); err != nil {
+		return err
+	}
+	result, err := DB.Exec(`UPDATE quizzes SET scoring_policy = ? WHERE id = ?`, policy, quizID)
+	if err != nil {
+		return fmt.Errorf("failed to update scoring policy: %v", err)
+	}
+	return expectOneRow(result)
+}
+
+func validateScoringPolicy(policy string) error {
+	for _, p := range ScoringPolicies {
+		if policy == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: scoring policy must be one of %s", ErrInvalidQuiz, strings.Join(ScoringPolicies, ", "))
+}
+
+func validateTimeLimits(limits TimeLimits) error {
+	if limits.Question < 0 || limits.Question > maxQuestionTimeLimit {
+		return fmt.Errorf("%w: the time limit per question must be between 0 and %d seconds", ErrInvalidQuiz, maxQuestionTimeLimit)
+	}
+	if limits.Quiz < 0 || limits.Quiz > maxQuizTimeLimit {
+		return fmt.Errorf("%w: the time limit for the quiz must be between 0 and %d seconds", ErrInvalidQuiz, maxQuizTimeLimit)
+	}
+	return nil
+}
+
+func validateStatus(status string, questions int) error {
+	switch status {
+	case QuizDraft:
+		return nil
+	case QuizPublished:
+		if questions == 0 {
+			return fmt.Errorf("%w: a quiz needs at least one question to be published", ErrInvalidQuiz)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: status must be %q or %q", ErrInvalidQuiz, QuizDraft, QuizPublished)
+	}
+}
+
+// DeleteQuiz removes a quiz together with its questions, attempts and
+// scores
+func DeleteQuiz(quizID int) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to delete quiz: %v", err)
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`DELETE FROM attempt_answers WHERE attempt_id IN (SELECT id FROM attempts WHERE quiz_id = ?)`,
+		`DELETE FROM attempt_questions WHERE attempt_id IN (SELECT id FROM attempts WHERE quiz_id = ?)`,
+		`DELETE FROM attempts WHERE quiz_id = ?`,
+		`DELETE FROM scores WHERE quiz_id = ?`,
+		`DELETE FROM question_options WHERE question_id IN (SELECT id FROM questions WHERE quiz_id = ?)`,
+		`DELETE FROM questions WHERE quiz_id = ?`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, quizID); err != nil {
+			return fmt.Errorf("failed to delete quiz: %v", err)
+		}
+	}
+
+	result, err := tx.Exec(`DELETE FROM quizzes WHERE id = ?`, quizID)
+	if err != nil {
+		return fmt.Errorf("failed to delete quiz: %v", err)
+	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ValidateQuestion checks that a question can be stored and answered. It
+// needs text and distinct options: at least two for the choice types, with
+// exactly one marked correct, two for true/false and one or more correct
+// for multi-select. A free-text question needs at least one accepted
+// answer, and all of its options are marked correct. The type defaults to
+// QuestionMultipleChoice.
+func ValidateQuestion(q *Question) error {
+	q.Text = strings.TrimSpace(q.Text)
+	if q.Text == "" {
+		return fmt.Errorf("%w: text is required", ErrInvalidQuiz)
+	}
+	if q.Type == "" {
+		q.Type = QuestionMultipleChoice
+	}
+
+	seen := make(map[string]bool, len(q.Options))
+	seenMatch := make(map[string]bool, len(q.Options))
+	correct := 0
+	for i := range q.Options {
+		option := &q.Options[i]
+		option.Text = strings.TrimSpace(option.Text)
+		option.Match = strings.TrimSpace(option.Match)
+		switch {
+		case option.Text == "":
+			return fmt.Errorf("%w: options cannot be empty", ErrInvalidQuiz)
+		case seen[option.Text]:
+			return fmt.Errorf("%w: option %q appears twice", ErrInvalidQuiz, option.Text)
+		}
+		seen[option.Text] = true
+		if q.Type == QuestionMatching {
+			switch {
+			case option.Match == "":
+				return fmt.Errorf("%w: option %q needs a match", ErrInvalidQuiz, option.Text)
+			case seenMatch[option.Match]:
+				return fmt.Errorf("%w: match %q appears twice", ErrInvalidQuiz, option.Match)
+			}
+			seenMatch[option.Match] = true
+		} else {
+			option.Match = ""
+		}
+		if slices.Contains(answerKeyTypes, q.Type) {
+			option.IsCorrect = true
+		}
+		if option.IsCorrect {
+			correct++
+		}
+	}
+	if q.Type != QuestionNumeric {
+		q.Tolerance = 0
+	}
+
+	switch q.Type {
+	case QuestionMultipleChoice, QuestionMultiSelect:
+		if len(q.Options) < 2 {
+			return fmt.Errorf("%w: at least two options are required", ErrInvalidQuiz)
+		}
+	case QuestionTrueFalse:
+		if len(q.Options) != 2 {
+			return fmt.Errorf("%w: a true/false question has exactly two options", ErrInvalidQuiz)
+		}
+	case QuestionFreeText:
+		if len(q.Options) == 0 {
+			return fmt.Errorf("%w: at least one accepted answer is required", ErrInvalidQuiz)
+		}
+	case QuestionNumeric:
+		if len(q.Options) != 1 {
+			return fmt.Errorf("%w: a numeric question has exactly one option, its value", ErrInvalidQuiz)
+		}
+		if _, err := ParseNumber(q.Options[0].Text); err != nil {
+			return fmt.Errorf("%w: %q is not a number", ErrInvalidQuiz, q.Options[0].Text)
+		}
+		if q.Tolerance < 0 || math.IsInf(q.Tolerance, 0) || math.IsNaN(q.Tolerance) {
+			return fmt.Errorf("%w: tolerance must be a number of at least 0", ErrInvalidQuiz)
+		}
+	case QuestionOrdering, QuestionMatching:
+		if len(q.Options) < 2 {
+			return fmt.Errorf("%w: at least two options are required", ErrInvalidQuiz)
+		}
+	default:
+		return fmt.Errorf("%w: type must be one of %s", ErrInvalidQuiz, strings.Join(QuestionTypes, ", "))
+	}
+
+	switch {
+	case q.Type == QuestionMultiSelect && correct == 0:
+		return fmt.Errorf("%w: at least one option must be marked correct", ErrInvalidQuiz)
+	case q.Type != QuestionMultiSelect && !slices.Contains(answerKeyTypes, q.Type) && correct != 1:
+		return fmt.Errorf("%w: exactly one option must be marked as the correct answer", ErrInvalidQuiz)
+	}
+	return nil
+}
+
+// ParseNumber reads a number as authors and players write it, e.g. "3" or
+// "-2.5". Infinity and NaN are not accepted.
+func ParseNumber(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err == nil && (math.IsInf(v, 0) || math.IsNaN(v)) {
+		err = fmt.Errorf("%q is not a finite number", s)
+	}
+	return v, err
+}
+
+// GetQuestion returns a question of a quiz
+func GetQuestion(quizID, questionID int) (*Question, error) {
+	var q Question
+	var imageURL, context sql.NullString
+	err := DB.QueryRow(`
+		SELECT id, quiz_id, text, type, tolerance, image_url, context
+		FROM questions
+		WHERE id = ? AND quiz_id = ? AND deleted_at IS NULL
+	`, questionID, quizID).Scan(&q.ID, &q.QuizID, &q.Text, &q.Type, &q.Tolerance, &imageURL, &context)
+	if err != nil {
+		return nil, err
+	}
+	q.ImageURL = imageURL.String
+	q.Context = context.String
+
+	options, err := getOptions(`q.id = ?`, q.ID)
+	if err != nil {
+		return nil, err
+	}
+	q.Options = options.of(q.ID)
+	return &q, nil
+}
+
+// AddQuestion appends a question to a quiz
+func AddQuestion(quizID int, q *Question) error {
+	if err := ValidateQuestion(q); err != nil {
+		return err
+	}
+	q.QuizID = quizID
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to add question: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := insertQuestion(tx, q); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateQuestion replaces the text, type, tolerance and options of a
+// question
+func UpdateQuestion(q *Question) error {
+	if err := ValidateQuestion(q); err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to update question: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE questions SET text = ?, type = ?, tolerance = ?, image_url = ?, context = ?
+		WHERE id = ? AND quiz_id = ? AND deleted_at IS NULL
+	`, q.Text, q.Type, q.Tolerance, q.ImageURL, q.Context, q.ID, q.QuizID)
+	if err != nil {
+		return fmt.Errorf("failed to update question: %v", err)
+	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
+	if err := replaceOptions(tx, q.ID, q.Options); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteQuestion removes a question from a quiz. It is only marked
+// deleted, so the answers past attempts gave to it are kept and can still
+// be reviewed. The last question of a published quiz cannot be deleted.
+func DeleteQuestion(quizID, questionID int) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to delete question: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE questions SET deleted_at = ? WHERE id = ? AND quiz_id = ? AND deleted_at IS NULL`,
+		time.Now().UTC(), questionID, quizID)
+	if err != nil {
+		return fmt.Errorf("failed to delete question: %v", err)
+	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
+
+	var status string
+	var questions int
+	err = tx.QueryRow(`
+		SELECT q.status, COUNT(qs.id)
+		FROM quizzes q
+		LEFT JOIN questions qs ON qs.quiz_id = q.id AND qs.deleted_at IS NULL
+		WHERE q.id = ?
+		GROUP BY q.id
+	`, quizID).Scan(&status, &questions)
+	if err != nil {
+		return fmt.Errorf("failed to count questions: %v", err)
+	}
+	if status == QuizPublished && questions == 0 {
+		return fmt.Errorf("%w: a published quiz needs at least one question", ErrInvalidQuiz)
+	}
+	return tx.Commit()
+}
+
+// ReorderQuestions puts the questions of a quiz in the given order. The IDs
+// must name every question of the quiz exactly once.
+func ReorderQuestions(quizID int, questionIDs []int) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to reorder questions: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id FROM questions WHERE quiz_id = ? AND deleted_at IS NULL`, quizID)
+	if err != nil {
+		return fmt.Errorf("failed to get questions: %v", err)
+	}
+	existing := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan question: %v", err)
+		}
+		existing[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to get questions: %v", err)
+	}
+
+	if len(questionIDs) != len(existing) {
+		return fmt.Errorf("%w: the new order must list all %d questions", ErrInvalidQuiz, len(existing))
+	}
+	seen := make(map[int]bool, len(questionIDs))
+	for _, id := range questionIDs {
+		if !existing[id] || seen[id] {
+			return fmt.Errorf("%w: question %d is unknown or listed twice", ErrInvalidQuiz, id)
+		}
+		seen[id] = true
+	}
+
+	for i, id := range questionIDs {
+		if _, err := tx.Exec(`UPDATE questions SET position = ? WHERE id = ?`, i+1, id); err != nil {
+			return fmt.Errorf("failed to reorder questions: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// MoveQuestion moves a question up (negative offset) or down the order of
+// its quiz. Moving past either end leaves it at that end.
+func MoveQuestion(quizID, questionID, offset int) error {
+	quiz, err := GetQuizWithQuestions(strconv.Itoa(quizID))
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int, 0, len(quiz.Questions))
+	from := -1
+	for i, q := range quiz.Questions {
+		ids = append(ids, q.ID)
+		if q.ID == questionID {
+			from = i
+		}
+	}
+	if from < 0 {
+		return sql.ErrNoRows
+	}
+
+	to := min(max(from+offset, 0), len(ids)-1)
+	ids = append(ids[:from], ids[from+1:]...)
+	ids = append(ids[:to], append([]int{questionID}, ids[to:]...)...)
+	return ReorderQuestions(quizID, ids)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// insertQuestion stores a question and its options at the end of its quiz
+func insertQuestion(db execer, q *Question) error {
+	id, err := insertID(db, `
+		INSERT INTO questions (quiz_id, text, type, tolerance, image_url, context, position)
+		VALUES (?, ?, ?, ?, ?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM questions WHERE quiz_id = ?))
+	`, q.QuizID, q.Text, q.Type, q.Tolerance, q.ImageURL, q.Context, q.QuizID)
+	if err != nil {
+		return fmt.Errorf("failed to insert question: %v", err)
+	}
+	q.ID = id
+	return insertOptions(db, q.ID, q.Options)
+}
+
+// expectOneRow turns an update or delete that matched nothing into
+// sql.ErrNoRows
+func expectOneRow(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"fmt"
+)
+
+// Roles in increasing order of privilege. Each role includes the
+// permissions of the ones before it.
+const (
+	RolePlayer = "player"
+	RoleAuthor = "author"
+	RoleAdmin  = "admin"
+)
+
+var roleRank = map[string]int{
+	RolePlayer: 1,
+	RoleAuthor: 2,
+	RoleAdmin:  3,
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// HasRole reports whether the user has at least the given role
+func (u *User) HasRole(role string) bool {
+	return roleRank[u.Role] >= roleRank[role] && ValidRole(role)
+}
+
+// CanEditQuiz reports whether the user may change a quiz: admins may edit
+// any quiz, authors only the ones they created
+func (u *User) CanEditQuiz(quiz *Quiz) bool {
+	if u.HasRole(RoleAdmin) {
+		return true
+	}
+	return u.HasRole(RoleAuthor) && quiz.CreatedBy == u.ID
+}
+
+// SetUserRole changes the role of the user with the given username
+func SetUserRole(username, role string) error {
+	if !ValidRole(role) {
+		return fmt.Errorf("unknown role %q", role)
+	}
+
+	result, err := DB.Exec(`
+		UPDATE users SET role = ? WHERE username = ?
+	`, role, username)
+	if err != nil {
+		return fmt.Errorf("failed to set role: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to set role: %v", err)
+	} else if n == 0 {
+		return fmt.Errorf("user %q not found", username)
+	}
+	return nil
+}
+
+// CountUsersWithRole returns how many users have exactly the given role
+func CountUsersWithRole(role string) (int, error) {
+	var count int
+	err := DB.QueryRow(`
+		SELECT COUNT(*) FROM users WHERE role = ?
+	`, role).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count users: %v", err)
+	}
+	return count, nil
+}
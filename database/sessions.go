@@ -0,0 +1,279 @@
+package database
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// sessionTouchInterval limits how often last_seen_at is written
+const sessionTouchInterval = time.Minute
+
+// anonymousSessionMaxAge caps the lifetime, in seconds, of sessions nobody
+// is logged in to, which only carry a CSRF token or a login in progress
+const anonymousSessionMaxAge = 2 * 60 * 60
+
+// ErrSessionRevoked is returned when saving a session that was deleted,
+// e.g. by logging out everywhere, after the request loaded it
+var ErrSessionRevoked = errors.New("session has been revoked")
+
+// SessionStore is a sessions.Store that keeps session data in the sessions
+// table. The cookie only carries a signed session ID, so a session can be
+// revoked server-side.
+type SessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+// SessionInfo describes a session for display on the settings page
+type SessionInfo struct {
+	ID         string    `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// NewSessionStore creates a store whose cookies are signed (and optionally
+// encrypted) with the given key pairs, as for sessions.NewCookieStore
+func NewSessionStore(keyPairs ...[]byte) *SessionStore {
+	return &SessionStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   86400 * 30,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+	}
+}
+
+// Get returns the session for the request, cached for the request's lifetime
+func (s *SessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the request's cookie. A missing, tampered,
+// expired or revoked session yields a fresh one rather than an error.
+func (s *SessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	if err := securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...); err != nil {
+		log.Printf("Ignoring invalid session cookie: %v", err)
+		return session, nil
+	}
+
+	var data []byte
+	var lastSeen time.Time
+	err = DB.QueryRow(`
+		SELECT data, last_seen_at
+		FROM sessions
+		WHERE id = ? AND expires_at > ?
+	`, id, time.Now().UTC()).Scan(&data, &lastSeen)
+	if err == sql.ErrNoRows {
+		return session, nil
+	}
+	if err != nil {
+		return session, fmt.Errorf("failed to load session: %v", err)
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values); err != nil {
+		log.Printf("Ignoring undecodable session %s: %v", id, err)
+		return session, nil
+	}
+	session.ID = id
+	session.IsNew = false
+
+	if time.Since(lastSeen) > sessionTouchInterval {
+		_, err := DB.Exec(`
+			UPDATE sessions SET last_seen_at = ? WHERE id = ?
+		`, time.Now().UTC(), id)
+		if err != nil {
+			log.Printf("Failed to update session last seen: %v", err)
+		}
+	}
+
+	return session, nil
+}
+
+// Save writes the session to the database and sets the ID cookie. A
+// negative MaxAge deletes the session, and one nobody is logged in to
+// lasts at most anonymousSessionMaxAge. A session that was revoked while
+// the request was running stays revoked: its cookie is cleared and Save
+// returns ErrSessionRevoked.
+func (s *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := DeleteSession(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return fmt.Errorf("failed to encode session: %v", err)
+	}
+
+	var userID sql.NullInt64
+	if id, ok := session.Values["userID"].(int); ok {
+		userID = sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+
+	opts := *session.Options
+	if !userID.Valid && (opts.MaxAge == 0 || opts.MaxAge > anonymousSessionMaxAge) {
+		opts.MaxAge = anonymousSessionMaxAge
+	}
+
+	// Browser-session cookies (MaxAge 0) still expire server-side
+	lifetime := time.Duration(opts.MaxAge) * time.Second
+	if lifetime == 0 {
+		lifetime = 24 * time.Hour
+	}
+
+	// Only a new ID is inserted. An existing session is updated in place,
+	// so one deleted in the meantime is not brought back.
+	now := time.Now().UTC()
+	if session.ID == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("failed to generate session id: %v", err)
+		}
+		session.ID = base64.RawURLEncoding.EncodeToString(b)
+
+		_, err := DB.Exec(`
+			INSERT INTO sessions (id, user_id, data, user_agent, ip, created_at, last_seen_at, expires_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, session.ID, userID, buf.Bytes(), r.UserAgent(), ClientIP(r), now, now, now.Add(lifetime))
+		if err != nil {
+			return fmt.Errorf("failed to save session: %v", err)
+		}
+	} else {
+		result, err := DB.Exec(`
+			UPDATE sessions
+			SET user_id = ?, data = ?, user_agent = ?, ip = ?, last_seen_at = ?, expires_at = ?
+			WHERE id = ? AND expires_at > ?
+		`, userID, buf.Bytes(), r.UserAgent(), ClientIP(r), now, now.Add(lifetime), session.ID, now)
+		if err != nil {
+			return fmt.Errorf("failed to save session: %v", err)
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to save session: %v", err)
+		} else if n == 0 {
+			expired := *session.Options
+			expired.MaxAge = -1
+			http.SetCookie(w, sessions.NewCookie(session.Name(), "", &expired))
+			return ErrSessionRevoked
+		}
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return fmt.Errorf("failed to encode session cookie: %v", err)
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, &opts))
+	return nil
+}
+
+// GetUserSessions lists the active sessions of a user, most recent first
+func GetUserSessions(userID int) ([]SessionInfo, error) {
+	rows, err := DB.Query(`
+		SELECT id, COALESCE(user_agent, ''), COALESCE(ip, ''), created_at, last_seen_at, expires_at
+		FROM sessions
+		WHERE user_id = ? AND expires_at > ?
+		ORDER BY last_seen_at DESC
+	`, userID, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %v", err)
+	}
+	defer rows.Close()
+
+	var list []SessionInfo
+	for rows.Next() {
+		var s SessionInfo
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %v", err)
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// DeleteSession removes a session, logging out whoever holds its ID
+func DeleteSession(id string) error {
+	if _, err := DB.Exec(`DELETE FROM sessions WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete session: %v", err)
+	}
+	return nil
+}
+
+// RevokeUserSessions logs a user out on every device
+func RevokeUserSessions(userID int) error {
+	_, err := DB.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %v", err)
+	}
+	return nil
+}
+
+// DeleteExpiredSessions removes sessions past their expiry
+func DeleteExpiredSessions() (int64, error) {
+	result, err := DB.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired sessions: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+// SweepExpiredSessions deletes expired sessions every interval until stop
+// is closed
+func SweepExpiredSessions(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n, err := DeleteExpiredSessions()
+			if err != nil {
+				log.Printf("Session sweep failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Deleted %d expired sessions", n)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ClientIP returns the address of the peer that sent the request
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
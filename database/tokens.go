@@ -0,0 +1,135 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Purposes of the tokens sent out by email. The purpose is part of the
+// signature, so a token issued for one cannot be used for another.
+const (
+	TokenVerifyEmail   = "verify-email"
+	TokenResetPassword = "reset-password"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+var tokenCodec *securecookie.SecureCookie
+
+// SetTokenKey sets the key emailed tokens are signed with
+func SetTokenKey(key []byte) {
+	// Derive a separate key so a token can never be replayed as a cookie
+	sum := sha256.Sum256(append([]byte("user-tokens:"), key...))
+	tokenCodec = securecookie.New(sum[:], nil)
+}
+
+// UserToken is a single-use token that was emailed to a user
+type UserToken struct {
+	UserID int
+	Email  string
+}
+
+// IssueToken creates a token for the given purpose that is valid for ttl.
+// The token is signed and its nonce is stored hashed, so it can be used
+// only once.
+func IssueToken(userID int, purpose, email string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+
+	token, err := tokenCodec.Encode(purpose, nonce)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %v", err)
+	}
+
+	now := time.Now().UTC()
+	_, err = DB.Exec(`
+		INSERT INTO user_tokens (user_id, purpose, token_hash, email, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, userID, purpose, hashToken(nonce), email, now, now.Add(ttl))
+	if err != nil {
+		return "", fmt.Errorf("failed to store token: %v", err)
+	}
+	return token, nil
+}
+
+// CheckToken reports whether token carries a valid signature for purpose,
+// without using it up
+func CheckToken(purpose, token string) bool {
+	var nonce string
+	return tokenCodec.Decode(purpose, token, &nonce) == nil
+}
+
+// ConsumeToken validates a token and marks it as used
+func ConsumeToken(purpose, token string) (*UserToken, error) {
+	var nonce string
+	if err := tokenCodec.Decode(purpose, token, &nonce); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to use token: %v", err)
+	}
+	defer tx.Rollback()
+
+	var id int
+	var t UserToken
+	err = tx.QueryRow(`
+		SELECT id, user_id, email FROM user_tokens
+		WHERE purpose = ? AND token_hash = ? AND used_at IS NULL AND expires_at > ?
+	`, purpose, hashToken(nonce), time.Now().UTC()).Scan(&id, &t.UserID, &t.Email)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to use token: %v", err)
+	}
+
+	if _, err := tx.Exec(`UPDATE user_tokens SET used_at = ? WHERE id = ?`, time.Now().UTC(), id); err != nil {
+		return nil, fmt.Errorf("failed to use token: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to use token: %v", err)
+	}
+	return &t, nil
+}
+
+// InvalidateTokens discards the unused tokens of a user for a purpose, for
+// example all reset links once the password was changed
+func InvalidateTokens(userID int, purpose string) error {
+	_, err := DB.Exec(`
+		UPDATE user_tokens SET used_at = ? WHERE user_id = ? AND purpose = ? AND used_at IS NULL
+	`, time.Now().UTC(), userID, purpose)
+	if err != nil {
+		return fmt.Errorf("failed to invalidate tokens: %v", err)
+	}
+	return nil
+}
+
+// MarkEmailVerified records that the user proved they receive mail at email.
+// Nothing happens if the user changed their address since.
+func MarkEmailVerified(userID int, email string) error {
+	_, err := DB.Exec(`
+		UPDATE users SET email_verified = TRUE WHERE id = ? AND email = ?
+	`, userID, email)
+	if err != nil {
+		return fmt.Errorf("failed to verify email: %v", err)
+	}
+	return nil
+}
+
+func hashToken(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// recoveryCodeCount is the number of recovery codes issued at a time
+const recoveryCodeCount = 10
+
+var ErrTOTPEnabled = errors.New("two-factor authentication is already enabled")
+
+// TOTP is the authenticator app enrolled for a user. Enabled stays false
+// until the user has proven the app works by entering a code.
+type TOTP struct {
+	UserID   int
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+// GetTOTP returns the TOTP enrollment of a user, or nil if there is none
+func GetTOTP(userID int) (*TOTP, error) {
+	t := TOTP{UserID: userID}
+	err := DB.QueryRow(`
+		SELECT secret, enabled, last_step FROM user_totp WHERE user_id = ?
+	`, userID).Scan(&t.Secret, &t.Enabled, &t.LastStep)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get TOTP: %v", err)
+	}
+	return &t, nil
+}
+
+// HasTOTP reports whether a user has to enter a code when logging in
+func HasTOTP(userID int) (bool, error) {
+	t, err := GetTOTP(userID)
+	if err != nil {
+		return false, err
+	}
+	return t != nil && t.Enabled, nil
+}
+
+// StartTOTPEnrollment stores a new, not yet enabled secret for a user,
+// replacing an unfinished enrollment
+func StartTOTPEnrollment(userID int, secret string) error {
+	result, err := DB.Exec(`
+		INSERT INTO user_totp (user_id, secret, enabled, last_step, created_at)
+		VALUES (?, ?, FALSE, 0, ?)
+		ON CONFLICT(user_id) DO UPDATE SET
+			secret = excluded.secret,
+			last_step = 0,
+			created_at = excluded.created_at
+		WHERE NOT user_totp.enabled
+	`, userID, secret, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to store TOTP secret: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrTOTPEnabled
+	}
+	return nil
+}
+
+// EnableTOTP turns on the enrolled secret
+func EnableTOTP(userID int) error {
+	_, err := DB.Exec(`UPDATE user_totp SET enabled = TRUE WHERE user_id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to enable TOTP: %v", err)
+	}
+	return nil
+}
+
+// DisableTOTP removes the TOTP secret and recovery codes of a user
+func DisableTOTP(userID int) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to disable TOTP: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM user_totp WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to disable TOTP: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %v", err)
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that the code for a time step was used. It returns
+// false if that step or a later one was already used, so every code works
+// only once.
+func UseTOTPStep(userID int, step int64) (bool, error) {
+	result, err := DB.Exec(`
+		UPDATE user_totp SET last_step = ? WHERE user_id = ? AND last_step < ?
+	`, step, userID, step)
+	if err != nil {
+		return false, fmt.Errorf("failed to record TOTP use: %v", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to record TOTP use: %v", err)
+	}
+	return n == 1, nil
+}
+
+// ReplaceRecoveryCodes invalidates the recovery codes of a user and issues
+// new ones. Only their hashes are stored, so the returned codes have to be
+// shown to the user now.
+func ReplaceRecoveryCodes(userID int) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %v", err)
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %v", err)
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec(`
+			INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)
+		`, userID, hashRecoveryCode(code), time.Now().UTC()); err != nil {
+			return nil, fmt.Errorf("failed to store recovery codes: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %v", err)
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode consumes one of the recovery codes of a user. It returns
+// false if the code is unknown or was used before.
+func UseRecoveryCode(userID int, code string) (bool, error) {
+	result, err := DB.Exec(`
+		UPDATE recovery_codes SET used_at = ?
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, time.Now().UTC(), userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %v", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %v", err)
+	}
+	return n == 1, nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func CountRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := DB.QueryRow(`
+		SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL
+	`, userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %v", err)
+	}
+	return count, nil
+}
+
+// Recovery codes are random, so a fast hash is enough to keep them from
+// being usable if the database leaks
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,413 @@
+package grading
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"quizapp/database"
+)
+
+var (
+	ErrUnknownQuestion = errors.New("unknown question")
+	ErrDuplicateAnswer = errors.New("duplicate answer")
+	ErrInvalidOption   = errors.New("answer is not one of the question's options")
+	ErrInvalidAnswer   = errors.New("answer does not fit the question")
+)
+
+// Answers maps a question ID to the player's answer to it, in the form the
+// question's type takes: an option ID for multiple choice and true/false,
+// a list of option IDs for multi-select, text for free text, a number for
+// numeric, every option ID in order for ordering and an object from option
+// ID to match for matching. Null (or nil) means the question was skipped
+// or timed out, as does an option ID of zero.
+type Answers map[int]json.RawMessage
+
+// UnmarshalJSON decodes a JSON object keyed by question ID. Unlike the
+// default map decoding it rejects keys that are not integers and keys that
+// name the same question twice (e.g. "3" and "03").
+func (a *Answers) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		*a = nil
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("answers must be an object keyed by question ID")
+	}
+
+	answers := make(Answers)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("invalid question ID %q", key)
+		}
+
+		var answer json.RawMessage
+		if err := dec.Decode(&answer); err != nil {
+			return fmt.Errorf("invalid answer for question %d", id)
+		}
+
+		if _, exists := answers[id]; exists {
+			return fmt.Errorf("%w for question %d", ErrDuplicateAnswer, id)
+		}
+		answers[id] = nil
+		if !isBlank(answer) {
+			answers[id] = answer
+		}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+
+	*a = answers
+	return nil
+}
+
+// QuestionResult is the outcome of grading a single question.
+// UserOptionID and CorrectOptionID are set for questions with a single
+// correct option; UserOptionIDs and CorrectOptionIDs list every option
+// chosen and every correct one for the types answered by choosing options.
+// Credit is the share of the question's points the answer earned.
+type QuestionResult struct {
+	QuestionID       int                     `json:"questionId"`
+	Text             string                  `json:"text"`
+	Type             string                  `json:"type"`
+	Options          []database.PlayerOption `json:"options"`
+	IsCorrect        bool                    `json:"isCorrect"`
+	Credit           float64                 `json:"credit"`
+	UserOptionID     int                     `json:"userOptionId"`
+	UserOptionIDs    []int                   `json:"userOptionIds,omitempty"`
+	UserAnswer       string                  `json:"userAnswer"`
+	CorrectOptionID  int                     `json:"correctOptionId"`
+	CorrectOptionIDs []int                   `json:"correctOptionIds,omitempty"`
+	CorrectAnswer    string                  `json:"correctAnswer"`
+	// TimedOut is set when the answer arrived after the question's time
+	// ran out
+	TimedOut bool    `json:"timedOut,omitempty"`
+	Points   float64 `json:"points"`
+}
+
+// Solution starts the result of q with its correct answer filled in
+func Solution(q *database.Question) QuestionResult {
+	qr := QuestionResult{
+		QuestionID:    q.ID,
+		Text:          q.Text,
+		Type:          q.Type,
+		Options:       q.PlayerOptions(),
+		CorrectAnswer: CorrectAnswer(q),
+	}
+	if qr.ChoosesOptions() {
+		for _, o := range q.CorrectOptions() {
+			qr.CorrectOptionIDs = append(qr.CorrectOptionIDs, o.ID)
+		}
+	}
+	if q.Type != database.QuestionMultiSelect && len(qr.CorrectOptionIDs) == 1 {
+		qr.CorrectOptionID = qr.CorrectOptionIDs[0]
+	}
+	return qr
+}
+
+// ChoosesOptions reports whether the question is answered by choosing
+// among its options, some of which are wrong
+func (qr QuestionResult) ChoosesOptions() bool {
+	switch qr.Type {
+	case database.QuestionFreeText, database.QuestionNumeric, database.QuestionOrdering, database.QuestionMatching:
+		return false
+	}
+	return true
+}
+
+// setResponse records the answer the player gave
+func (qr *QuestionResult) setResponse(r Response) {
+	qr.UserOptionID = r.OptionID
+	if qr.ChoosesOptions() {
+		qr.UserOptionIDs = r.OptionIDs
+	}
+	qr.UserAnswer = r.Answer
+	qr.Credit = r.Credit
+	qr.IsCorrect = r.Credit >= 1
+}
+
+// setLocked records an answer as it was graded when it was locked in
+func (qr *QuestionResult) setLocked(a database.LockedAnswer) {
+	qr.UserOptionID = a.OptionID
+	if qr.ChoosesOptions() {
+		qr.UserOptionIDs = chosenOptions(a)
+	}
+	qr.UserAnswer = a.Answer
+	qr.IsCorrect = a.IsCorrect
+	qr.Credit = a.Credit
+	qr.TimedOut = a.TimedOut
+}
+
+// Chose reports whether the player chose the option
+func (qr QuestionResult) Chose(optionID int) bool {
+	return slices.Contains(qr.UserOptionIDs, optionID)
+}
+
+// IsCorrectOption reports whether the option is, or is one of, the correct
+// answers
+func (qr QuestionResult) IsCorrectOption(optionID int) bool {
+	return slices.Contains(qr.CorrectOptionIDs, optionID)
+}
+
+// Result is the outcome of grading a whole submission. Score is the
+// credit earned as a percentage of the questions, and Points what the
+// answers are worth under the scoring policy. Answers are the graded
+// answers in the order they were given, ready to be stored.
+type Result struct {
+	Score          float64                 `json:"score"`
+	Points         float64                 `json:"points"`
+	ScoringPolicy  string                  `json:"scoringPolicy"`
+	CorrectAnswers int                     `json:"correctAnswers"`
+	TotalQuestions int                     `json:"totalQuestions"`
+	Questions      []QuestionResult        `json:"questions"`
+	Answers        []database.LockedAnswer `json:"-"`
+}
+
+// Timing is how an answer stood against the clock of its question
+type Timing struct {
+	TimeTakenMS *int
+	TimedOut    bool
+}
+
+// Grade scores an attempt under its scoring policy. Answers locked in
+// during the attempt, in the order they were given, keep the grading they
+// were given, since the quiz may have been edited since, and take
+// precedence over answers submitted for the same question. The other
+// answers are checked against the quiz's questions: each must refer to a
+// question of the quiz and fit its type. Questions without an answer earn
+// nothing, as do timed out ones.
+func Grade(quiz *database.Quiz, attempt *database.Attempt, locked []database.LockedAnswer, answers Answers, timing map[int]Timing) (*Result, error) {
+	if len(quiz.Questions) == 0 {
+		return nil, fmt.Errorf("quiz %d has no questions", quiz.ID)
+	}
+
+	questions := make(map[int]*database.Question, len(quiz.Questions))
+	for i := range quiz.Questions {
+		questions[quiz.Questions[i].ID] = &quiz.Questions[i]
+	}
+	given := make(map[int]database.LockedAnswer, len(locked))
+	for _, a := range locked {
+		given[a.QuestionID] = a
+	}
+
+	responses := make(map[int]Response, len(answers))
+	for id, answer := range answers {
+		q, ok := questions[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: %d", ErrUnknownQuestion, id)
+		}
+		if _, ok := given[id]; ok {
+			continue
+		}
+		r, err := Check(q, answer)
+		if err != nil {
+			return nil, err
+		}
+		responses[id] = r
+	}
+
+	result := &Result{
+		ScoringPolicy:  attempt.ScoringPolicy,
+		TotalQuestions: len(quiz.Questions),
+		Questions:      make([]QuestionResult, 0, len(quiz.Questions)),
+	}
+	received := make([]database.LockedAnswer, 0, len(quiz.Questions))
+
+	var credit float64
+	for i := range quiz.Questions {
+		q := &quiz.Questions[i]
+		qr := Solution(q)
+		if a, ok := given[q.ID]; ok {
+			qr.setLocked(a)
+		} else {
+			r := responses[q.ID]
+			qr.setResponse(r)
+			if timing[q.ID].TimedOut {
+				qr.TimedOut = true
+				qr.IsCorrect = false
+				qr.Credit = 0
+			}
+			received = append(received, database.LockedAnswer{
+				QuestionID:  q.ID,
+				Response:    r.Raw,
+				OptionID:    qr.UserOptionID,
+				Answer:      qr.UserAnswer,
+				Credit:      qr.Credit,
+				IsCorrect:   qr.IsCorrect,
+				TimedOut:    qr.TimedOut,
+				TimeTakenMS: timing[q.ID].TimeTakenMS,
+			})
+		}
+		if qr.IsCorrect {
+			result.CorrectAnswers++
+		}
+		credit += qr.Credit
+		result.Questions = append(result.Questions, qr)
+	}
+
+	// Points needs the answers in the order they were given: the locked ones
+	// first, then those received with the submission
+	ordered := make([]database.LockedAnswer, 0, len(quiz.Questions))
+	for _, a := range locked {
+		if _, ok := questions[a.QuestionID]; ok {
+			ordered = append(ordered, a)
+		}
+	}
+	ordered = append(ordered, received...)
+	points, total := Points(attempt, ordered)
+	earned := make(map[int]float64, len(ordered))
+	for i, a := range ordered {
+		earned[a.QuestionID] = points[i]
+	}
+	for i := range result.Questions {
+		result.Questions[i].Points = earned[result.Questions[i].QuestionID]
+	}
+	result.Answers = ordered
+	result.Points = total
+	result.Score = credit / float64(result.TotalQuestions) * 100
+	return result, nil
+}
+
+// ReviewedQuestion is a question of a past attempt with the answer the
+// player gave
+type ReviewedQuestion struct {
+	QuestionResult
+	Answered    bool `json:"answered"`
+	TimeTakenMS *int `json:"timeTakenMs,omitempty"`
+	// Parts lays out the answer to an ordering or matching question: the
+	// options in the order the player put them, or those the player
+	// matched, each with the match given
+	Parts []ReviewedPart `json:"parts,omitempty"`
+}
+
+// ReviewedPart is one part of the answer to an ordering or matching
+// question, and whether it was right
+type ReviewedPart struct {
+	Text    string `json:"text"`
+	Correct bool   `json:"correct"`
+}
+
+// OptionRemoved reports whether an option the player chose has since been
+// removed from the question
+func (q ReviewedQuestion) OptionRemoved() bool {
+	for _, id := range q.UserOptionIDs {
+		if !slices.ContainsFunc(q.Options, func(o database.PlayerOption) bool { return o.ID == id }) {
+			return true
+		}
+	}
+	return false
+}
+
+// Review lays out a past attempt question by question. Answers are shown
+// as they were graded when given, since the quiz may have been edited
+// since.
+func Review(quiz *database.Quiz, answers []database.LockedAnswer) []ReviewedQuestion {
+	given := make(map[int]database.LockedAnswer, len(answers))
+	for _, a := range answers {
+		given[a.QuestionID] = a
+	}
+
+	review := make([]ReviewedQuestion, 0, len(quiz.Questions))
+	for i := range quiz.Questions {
+		q := &quiz.Questions[i]
+		rq := ReviewedQuestion{QuestionResult: Solution(q)}
+		if a, ok := given[q.ID]; ok {
+			rq.Answered = true
+			rq.setLocked(a)
+			rq.TimeTakenMS = a.TimeTakenMS
+			rq.Parts = answerParts(q, a)
+		}
+		review = append(review, rq)
+	}
+	return review
+}
+
+// chosenOptions returns the options a stored answer to a question answered
+// by choosing options chose. Its response is read as one option ID or a
+// list of them, whichever of those types the question is now, since the
+// question may have been edited since.
+func chosenOptions(a database.LockedAnswer) []int {
+	var ids []int
+	if err := json.Unmarshal(a.Response, &ids); err == nil {
+		return ids
+	}
+	if a.OptionID != 0 {
+		return []int{a.OptionID}
+	}
+	return nil
+}
+
+// answerParts breaks a stored answer to an ordering or matching question
+// into its parts. It returns nil for other questions, and for answers that
+// no longer fit the question because it was edited since.
+func answerParts(q *database.Question, a database.LockedAnswer) []ReviewedPart {
+	switch q.Type {
+	case database.QuestionOrdering:
+		var ids []int
+		if err := json.Unmarshal(a.Response, &ids); err != nil || len(ids) != len(q.Options) {
+			return nil
+		}
+		parts := make([]ReviewedPart, 0, len(ids))
+		for i, id := range ids {
+			o := q.Option(id)
+			if o == nil {
+				return nil
+			}
+			parts = append(parts, ReviewedPart{Text: o.Text, Correct: q.Options[i].ID == id})
+		}
+		return parts
+	case database.QuestionMatching:
+		var pairs map[int]string
+		if err := json.Unmarshal(a.Response, &pairs); err != nil {
+			return nil
+		}
+		parts := make([]ReviewedPart, 0, len(pairs))
+		for _, o := range q.Options {
+			if match, ok := pairs[o.ID]; ok {
+				parts = append(parts, ReviewedPart{Text: o.Text + " = " + match, Correct: match == o.Match})
+			}
+		}
+		if len(parts) != len(pairs) {
+			return nil
+		}
+		return parts
+	}
+	return nil
+}
+
+// FindQuestion returns the question of quiz with the given ID
+func FindQuestion(quiz *database.Quiz, questionID int) (*database.Question, error) {
+	for i := range quiz.Questions {
+		if quiz.Questions[i].ID == questionID {
+			return &quiz.Questions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnknownQuestion, questionID)
+}
+
+// IsClientError reports whether err was caused by an invalid submission
+// rather than a server-side failure
+func IsClientError(err error) bool {
+	return errors.Is(err, ErrUnknownQuestion) ||
+		errors.Is(err, ErrDuplicateAnswer) ||
+		errors.Is(err, ErrInvalidOption) ||
+		errors.Is(err, ErrInvalidAnswer)
+}
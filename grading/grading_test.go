@@ -0,0 +1,247 @@
+package grading
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+
+	"quizapp/database"
+)
+
+// TestGradeScoresInAnswerOrder checks that a streak counts the answers in
+// the order they were given rather than the order of the quiz, so the
+// points of a submission match those shown while it was played
+func TestGradeScoresInAnswerOrder(t *testing.T) {
+	quiz := &database.Quiz{ID: 1}
+	for id := 1; id <= 3; id++ {
+		quiz.Questions = append(quiz.Questions, database.Question{
+			ID:      id,
+			Type:    database.QuestionMultipleChoice,
+			Options: []database.Option{{ID: id * 10, IsCorrect: true}, {ID: id*10 + 1}},
+		})
+	}
+	attempt := &database.Attempt{ScoringPolicy: database.ScoringStreak}
+
+	// The last two questions were answered first, last one first, and the
+	// first comes in with the submission
+	locked := []database.LockedAnswer{
+		{QuestionID: 3, Response: json.RawMessage(`30`), OptionID: 30, Credit: 1, IsCorrect: true},
+		{QuestionID: 2, Response: json.RawMessage(`20`), OptionID: 20, Credit: 1, IsCorrect: true},
+	}
+	answers := Answers{1: json.RawMessage(`10`)}
+
+	result, err := Grade(quiz, attempt, locked, answers, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]float64{3: 100, 2: 150, 1: 200}
+	for _, q := range result.Questions {
+		if q.Points != want[q.QuestionID] {
+			t.Errorf("question %d earned %v points, want %v", q.QuestionID, q.Points, want[q.QuestionID])
+		}
+	}
+	if result.Points != 450 {
+		t.Errorf("total is %v points, want 450", result.Points)
+	}
+
+	points, _ := Points(attempt, result.Answers)
+	for i, a := range result.Answers {
+		if points[i] != want[a.QuestionID] {
+			t.Errorf("stored answer to question %d is worth %v points, want %v", a.QuestionID, points[i], want[a.QuestionID])
+		}
+	}
+}
+
+// TestReviewOrderingAnswer checks that the options of an ordering answer
+// are laid out in the player's order rather than shown as chosen
+func TestReviewOrderingAnswer(t *testing.T) {
+	quiz := &database.Quiz{ID: 1, Questions: []database.Question{{
+		ID:      1,
+		Type:    database.QuestionOrdering,
+		Options: []database.Option{{ID: 10, Text: "A"}, {ID: 11, Text: "B"}, {ID: 12, Text: "C"}},
+	}}}
+	answers := []database.LockedAnswer{{QuestionID: 1, Response: json.RawMessage(`[11,10,12]`), Answer: "B → A → C"}}
+
+	review := Review(quiz, answers)
+	if len(review) != 1 {
+		t.Fatalf("got %d reviewed questions, want 1", len(review))
+	}
+	q := review[0]
+	if len(q.UserOptionIDs) != 0 || q.Chose(10) {
+		t.Errorf("ordering answer was shown as chosen options %v", q.UserOptionIDs)
+	}
+	want := []ReviewedPart{{"B", false}, {"A", false}, {"C", true}}
+	if len(q.Parts) != len(want) {
+		t.Fatalf("got parts %+v, want %+v", q.Parts, want)
+	}
+	for i := range want {
+		if q.Parts[i] != want[i] {
+			t.Errorf("part %d is %+v, want %+v", i, q.Parts[i], want[i])
+		}
+	}
+}
+
+// checkCase is an answer to pass to Check and the credit it should earn,
+// or the error it should be rejected with
+type checkCase struct {
+	name   string
+	answer string
+	credit float64
+	err    error
+}
+
+func runCheckCases(t *testing.T, q *database.Question, cases []checkCase) {
+	t.Helper()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := Check(q, json.RawMessage(c.answer))
+			if c.err != nil {
+				if !errors.Is(err, c.err) {
+					t.Fatalf("Check(%s) returned %v, want %v", c.answer, err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Check(%s) returned %v", c.answer, err)
+			}
+			if math.Abs(r.Credit-c.credit) > 1e-9 {
+				t.Errorf("Check(%s) earned %v, want %v", c.answer, r.Credit, c.credit)
+			}
+		})
+	}
+}
+
+func TestCheckChoice(t *testing.T) {
+	q := &database.Question{ID: 1, Type: database.QuestionMultipleChoice, Options: []database.Option{
+		{ID: 1, Text: "Paris", IsCorrect: true},
+		{ID: 2, Text: "Rome"},
+	}}
+	runCheckCases(t, q, []checkCase{
+		{name: "correct", answer: `1`, credit: 1},
+		{name: "wrong", answer: `2`},
+		{name: "no option", answer: `0`},
+		{name: "skipped", answer: `null`},
+		{name: "unknown option", answer: `9`, err: ErrInvalidOption},
+		{name: "not an ID", answer: `"1"`, err: ErrInvalidAnswer},
+	})
+}
+
+func TestCheckMultiSelect(t *testing.T) {
+	q := &database.Question{ID: 1, Type: database.QuestionMultiSelect, Options: []database.Option{
+		{ID: 1, Text: "2", IsCorrect: true},
+		{ID: 2, Text: "3", IsCorrect: true},
+		{ID: 3, Text: "5", IsCorrect: true},
+		{ID: 4, Text: "4"},
+		{ID: 5, Text: "6"},
+	}}
+	runCheckCases(t, q, []checkCase{
+		{name: "all correct", answer: `[3,1,2]`, credit: 1},
+		{name: "partly correct", answer: `[1,2]`, credit: 2.0 / 3},
+		{name: "chosen twice", answer: `[1,1]`, credit: 1.0 / 3},
+		{name: "extra wrong pick", answer: `[1,2,3,4]`, credit: 2.0 / 3},
+		{name: "as many wrong as right", answer: `[1,4]`},
+		{name: "more wrong than right", answer: `[1,4,5]`},
+		{name: "empty selection", answer: `[]`},
+		{name: "unknown option", answer: `[1,9]`, err: ErrInvalidOption},
+		{name: "not a list", answer: `1`, err: ErrInvalidAnswer},
+		{name: "invalid JSON", answer: `[1,`, err: ErrInvalidAnswer},
+	})
+}
+
+func TestCheckFreeText(t *testing.T) {
+	q := &database.Question{ID: 1, Type: database.QuestionFreeText, Options: []database.Option{
+		{ID: 1, Text: "Mount Everest", IsCorrect: true},
+		{ID: 2, Text: "Rome", IsCorrect: true},
+		{ID: 3, Text: "Apollo 11", IsCorrect: true},
+	}}
+	runCheckCases(t, q, []checkCase{
+		{name: "exact", answer: `"Mount Everest"`, credit: 1},
+		{name: "case, spacing and punctuation", answer: `"  mount   EVEREST! "`, credit: 1},
+		{name: "leading article", answer: `"The Mount Everest"`, credit: 1},
+		{name: "typo within the allowance", answer: `"Mont Everst"`, credit: 1},
+		{name: "typos beyond the allowance", answer: `"Mnt Evrst"`},
+		{name: "no typos in short answers", answer: `"Rom"`},
+		{name: "any accepted answer", answer: `"rome"`, credit: 1},
+		{name: "digits", answer: `"apollo 11"`, credit: 1},
+		{name: "wrong number", answer: `"Apollo 12"`},
+		{name: "no typos with digits", answer: `"Apolo 11"`},
+		{name: "blank", answer: `"   "`},
+		{name: "not text", answer: `42`, err: ErrInvalidAnswer},
+		{name: "invalid JSON", answer: `"Rome`, err: ErrInvalidAnswer},
+	})
+}
+
+func TestNormalizeText(t *testing.T) {
+	for in, want := range map[string]string{
+		"The Beatles":        "beatles",
+		"  Rock-and-Roll! ":  "rock and roll",
+		"The":                "the",
+		"an Apple a day":     "apple a day",
+		"São Paulo, Brazil.": "são paulo brazil",
+	} {
+		if got := normalizeText(in); got != want {
+			t.Errorf("normalizeText(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCheckNumeric(t *testing.T) {
+	q := &database.Question{ID: 1, Type: database.QuestionNumeric, Tolerance: 0.5,
+		Options: []database.Option{{ID: 1, Text: "10", IsCorrect: true}}}
+	runCheckCases(t, q, []checkCase{
+		{name: "exact", answer: `10`, credit: 1},
+		{name: "within tolerance", answer: `10.25`, credit: 1},
+		{name: "exactly above", answer: `10.5`, credit: 1},
+		{name: "exactly below", answer: `9.5`, credit: 1},
+		{name: "within the slack", answer: `10.500000001`, credit: 1},
+		{name: "beyond the slack", answer: `10.5000001`},
+		{name: "outside tolerance", answer: `11`},
+		{name: "text", answer: `"10"`, err: ErrInvalidAnswer},
+		{name: "invalid JSON", answer: `10.`, err: ErrInvalidAnswer},
+	})
+
+	exact := &database.Question{ID: 2, Type: database.QuestionNumeric,
+		Options: []database.Option{{ID: 1, Text: "0.3", IsCorrect: true}}}
+	runCheckCases(t, exact, []checkCase{
+		{name: "rounding", answer: `0.30000000000000004`, credit: 1},
+		{name: "no tolerance", answer: `0.31`},
+	})
+}
+
+func TestCheckOrdering(t *testing.T) {
+	q := &database.Question{ID: 1, Type: database.QuestionOrdering, Options: []database.Option{
+		{ID: 1, Text: "Plan"}, {ID: 2, Text: "Build"}, {ID: 3, Text: "Test"}, {ID: 4, Text: "Ship"},
+	}}
+	runCheckCases(t, q, []checkCase{
+		{name: "in order", answer: `[1,2,3,4]`, credit: 1},
+		{name: "one adjacent swap", answer: `[2,1,3,4]`, credit: 4.0 / 6},
+		{name: "last two swapped", answer: `[1,2,4,3]`, credit: 4.0 / 6},
+		{name: "no better than chance", answer: `[3,4,1,2]`},
+		{name: "fully reversed", answer: `[4,3,2,1]`},
+		{name: "empty", answer: `[]`},
+		{name: "duplicate ID", answer: `[1,1,2,3]`, err: ErrInvalidAnswer},
+		{name: "missing ID", answer: `[1,2,3]`, err: ErrInvalidAnswer},
+		{name: "unknown ID", answer: `[1,2,3,9]`, err: ErrInvalidOption},
+		{name: "not a list", answer: `{"1":1}`, err: ErrInvalidAnswer},
+	})
+}
+
+func TestCheckMatching(t *testing.T) {
+	q := &database.Question{ID: 1, Type: database.QuestionMatching, Options: []database.Option{
+		{ID: 1, Text: "api", Match: "Team A"},
+		{ID: 2, Text: "web", Match: "Team B"},
+		{ID: 3, Text: "db", Match: "Team C"},
+	}}
+	runCheckCases(t, q, []checkCase{
+		{name: "all matched", answer: `{"1":"Team A","2":"Team B","3":"Team C"}`, credit: 1},
+		{name: "one pair", answer: `{"1":"Team A"}`, credit: 1.0 / 3},
+		{name: "pairs swapped", answer: `{"1":"Team B","2":"Team A","3":"Team C"}`, credit: 1.0 / 3},
+		{name: "match reused", answer: `{"1":"Team A","2":"Team A","3":"Team A"}`, credit: 1.0 / 3},
+		{name: "blank match", answer: `{"1":""}`},
+		{name: "nothing matched", answer: `{}`},
+		{name: "unknown match", answer: `{"1":"Team Z"}`, err: ErrInvalidAnswer},
+		{name: "unknown option", answer: `{"9":"Team A"}`, err: ErrInvalidOption},
+		{name: "not an object", answer: `[1,2]`, err: ErrInvalidAnswer},
+	})
+}
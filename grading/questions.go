@@ -0,0 +1,410 @@
+package grading
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"quizapp/database"
+)
+
+// Response is a player's answer to a question, checked against it. Raw is
+// the answer in canonical JSON form and is nil when the question was
+// skipped. OptionIDs are the options chosen, in the order the question
+// lists them or, for ordering questions, in the order given. OptionID is
+// the one chosen for types answered with a single option. Answer is what
+// was answered, as shown to the player. Credit is the share of the
+// question's points earned, from 0 to 1.
+type Response struct {
+	Raw       json.RawMessage
+	OptionID  int
+	OptionIDs []int
+	Answer    string
+	Credit    float64
+}
+
+// grader checks the answers to one type of question
+type grader interface {
+	// grade decodes an answer and works out the credit it earns. A blank
+	// answer is a skip and earns nothing.
+	grade(q *database.Question, answer json.RawMessage) (Response, error)
+	// correctAnswer describes the correct answer to show after the fact
+	correctAnswer(q *database.Question) string
+}
+
+var graders = map[string]grader{
+	database.QuestionMultipleChoice: choiceGrader{},
+	database.QuestionTrueFalse:      choiceGrader{},
+	database.QuestionMultiSelect:    multiSelectGrader{},
+	database.QuestionFreeText:       freeTextGrader{},
+	database.QuestionNumeric:        numericGrader{},
+	database.QuestionOrdering:       orderingGrader{},
+	database.QuestionMatching:       matchingGrader{},
+}
+
+func graderFor(q *database.Question) grader {
+	if g, ok := graders[q.Type]; ok {
+		return g
+	}
+	return choiceGrader{}
+}
+
+// Check grades a single answer to q. Answers that do not fit the question,
+// such as an option it does not have, are rejected with ErrInvalidAnswer
+// or ErrInvalidOption.
+func Check(q *database.Question, answer json.RawMessage) (Response, error) {
+	if isBlank(answer) {
+		return Response{}, nil
+	}
+	return graderFor(q).grade(q, answer)
+}
+
+// CorrectAnswer describes the correct answer to q
+func CorrectAnswer(q *database.Question) string {
+	return graderFor(q).correctAnswer(q)
+}
+
+func isBlank(answer json.RawMessage) bool {
+	s := strings.TrimSpace(string(answer))
+	return s == "" || s == "null"
+}
+
+func invalidAnswer(q *database.Question, want string) error {
+	return fmt.Errorf("%w (question %d): must be %s", ErrInvalidAnswer, q.ID, want)
+}
+
+// choiceGrader grades questions answered with a single option ID, where
+// zero means no option was chosen
+type choiceGrader struct{}
+
+func (choiceGrader) grade(q *database.Question, answer json.RawMessage) (Response, error) {
+	var optionID int
+	if err := json.Unmarshal(answer, &optionID); err != nil {
+		return Response{}, invalidAnswer(q, "an option ID")
+	}
+	if optionID == 0 {
+		return Response{}, nil
+	}
+	option := q.Option(optionID)
+	if option == nil {
+		return Response{}, fmt.Errorf("%w (question %d)", ErrInvalidOption, q.ID)
+	}
+
+	r := Response{
+		Raw:       json.RawMessage(strconv.Itoa(option.ID)),
+		OptionID:  option.ID,
+		OptionIDs: []int{option.ID},
+		Answer:    option.Text,
+	}
+	if option.IsCorrect {
+		r.Credit = 1
+	}
+	return r, nil
+}
+
+func (choiceGrader) correctAnswer(q *database.Question) string {
+	if correct := q.CorrectOption(); correct != nil {
+		return correct.Text
+	}
+	return ""
+}
+
+// multiSelectGrader grades questions answered with a list of option IDs.
+// Each correct option chosen earns its share of the credit and each wrong
+// one takes a share away, down to nothing.
+type multiSelectGrader struct{}
+
+func (multiSelectGrader) grade(q *database.Question, answer json.RawMessage) (Response, error) {
+	var ids []int
+	if err := json.Unmarshal(answer, &ids); err != nil {
+		return Response{}, invalidAnswer(q, "a list of option IDs")
+	}
+	chosen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if q.Option(id) == nil {
+			return Response{}, fmt.Errorf("%w (question %d)", ErrInvalidOption, q.ID)
+		}
+		chosen[id] = true
+	}
+	if len(chosen) == 0 {
+		return Response{}, nil
+	}
+
+	var r Response
+	var texts []string
+	right, wrong := 0, 0
+	for _, o := range q.Options {
+		if !chosen[o.ID] {
+			continue
+		}
+		r.OptionIDs = append(r.OptionIDs, o.ID)
+		texts = append(texts, o.Text)
+		if o.IsCorrect {
+			right++
+		} else {
+			wrong++
+		}
+	}
+	r.Answer = strings.Join(texts, ", ")
+
+	sorted := append([]int(nil), r.OptionIDs...)
+	sort.Ints(sorted)
+	r.Raw, _ = json.Marshal(sorted)
+
+	if correct := len(q.CorrectOptions()); correct > 0 && right > wrong {
+		r.Credit = float64(right-wrong) / float64(correct)
+	}
+	return r, nil
+}
+
+func (multiSelectGrader) correctAnswer(q *database.Question) string {
+	var texts []string
+	for _, o := range q.CorrectOptions() {
+		texts = append(texts, o.Text)
+	}
+	return strings.Join(texts, ", ")
+}
+
+// freeTextGrader grades typed answers against the answers a question
+// accepts. Case, punctuation, spacing and a leading article are ignored,
+// and a few typos are forgiven in longer answers.
+type freeTextGrader struct{}
+
+func (freeTextGrader) grade(q *database.Question, answer json.RawMessage) (Response, error) {
+	var text string
+	if err := json.Unmarshal(answer, &text); err != nil {
+		return Response{}, invalidAnswer(q, "text")
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return Response{}, nil
+	}
+
+	r := Response{Answer: text}
+	r.Raw, _ = json.Marshal(text)
+	for _, accepted := range q.CorrectOptions() {
+		if textMatches(text, accepted.Text) {
+			r.Credit = 1
+			break
+		}
+	}
+	return r, nil
+}
+
+func (freeTextGrader) correctAnswer(q *database.Question) string {
+	if correct := q.CorrectOption(); correct != nil {
+		return correct.Text
+	}
+	return ""
+}
+
+// numericGrader grades numbers against the value of a question, accepting
+// any within its tolerance
+type numericGrader struct{}
+
+func (numericGrader) grade(q *database.Question, answer json.RawMessage) (Response, error) {
+	var v float64
+	if err := json.Unmarshal(answer, &v); err != nil {
+		return Response{}, invalidAnswer(q, "a number")
+	}
+
+	r := Response{Answer: formatNumber(v)}
+	r.Raw, _ = json.Marshal(v)
+	if len(q.Options) == 0 {
+		return r, nil
+	}
+	want, err := database.ParseNumber(q.Options[0].Text)
+	if err != nil {
+		return r, nil
+	}
+	// Allow for rounding in values such as 0.1 + 0.2
+	slack := 1e-9 * math.Max(1, math.Abs(want))
+	if math.Abs(v-want) <= q.Tolerance+slack {
+		r.Credit = 1
+	}
+	return r, nil
+}
+
+func (numericGrader) correctAnswer(q *database.Question) string {
+	if len(q.Options) == 0 {
+		return ""
+	}
+	if q.Tolerance > 0 {
+		return q.Options[0].Text + " ± " + formatNumber(q.Tolerance)
+	}
+	return q.Options[0].Text
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// orderingGrader grades questions answered by putting every option in
+// order. Credit follows the Kendall tau distance: the share of pairs of
+// options in the right order less the share in the wrong order, so an
+// answer no better than a random shuffle earns nothing.
+type orderingGrader struct{}
+
+func (orderingGrader) grade(q *database.Question, answer json.RawMessage) (Response, error) {
+	var ids []int
+	if err := json.Unmarshal(answer, &ids); err != nil {
+		return Response{}, invalidAnswer(q, "a list of option IDs")
+	}
+	if len(ids) == 0 {
+		return Response{}, nil
+	}
+
+	position := make(map[int]int, len(q.Options))
+	for i, o := range q.Options {
+		position[o.ID] = i
+	}
+	if len(ids) != len(q.Options) {
+		return Response{}, invalidAnswer(q, "every option ID once, in order")
+	}
+	seen := make(map[int]bool, len(ids))
+	texts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := position[id]; !ok {
+			return Response{}, fmt.Errorf("%w (question %d)", ErrInvalidOption, q.ID)
+		}
+		if seen[id] {
+			return Response{}, invalidAnswer(q, "every option ID once, in order")
+		}
+		seen[id] = true
+		texts = append(texts, q.Option(id).Text)
+	}
+
+	r := Response{OptionIDs: ids, Answer: strings.Join(texts, " → ")}
+	r.Raw, _ = json.Marshal(ids)
+
+	concordant, discordant := 0, 0
+	for i := range ids {
+		for j := i + 1; j < len(ids); j++ {
+			if position[ids[i]] < position[ids[j]] {
+				concordant++
+			} else {
+				discordant++
+			}
+		}
+	}
+	if pairs := concordant + discordant; pairs > 0 && concordant > discordant {
+		r.Credit = float64(concordant-discordant) / float64(pairs)
+	}
+	return r, nil
+}
+
+func (orderingGrader) correctAnswer(q *database.Question) string {
+	texts := make([]string, 0, len(q.Options))
+	for _, o := range q.Options {
+		texts = append(texts, o.Text)
+	}
+	return strings.Join(texts, " → ")
+}
+
+// matchingGrader grades questions answered by pairing options with their
+// matches, given as an object from option ID to match. Each pair matched
+// correctly earns its share of the credit; options may be left unmatched.
+type matchingGrader struct{}
+
+func (matchingGrader) grade(q *database.Question, answer json.RawMessage) (Response, error) {
+	var pairs map[int]string
+	if err := json.Unmarshal(answer, &pairs); err != nil {
+		return Response{}, invalidAnswer(q, "an object from option ID to match")
+	}
+	for id, match := range pairs {
+		if q.Option(id) == nil {
+			return Response{}, fmt.Errorf("%w (question %d)", ErrInvalidOption, q.ID)
+		}
+		if match == "" {
+			delete(pairs, id)
+		} else if q.OptionMatching(match) == nil {
+			return Response{}, invalidAnswer(q, "options paired with its matches")
+		}
+	}
+	if len(pairs) == 0 {
+		return Response{}, nil
+	}
+
+	var r Response
+	var texts []string
+	right := 0
+	for _, o := range q.Options {
+		match, ok := pairs[o.ID]
+		if !ok {
+			continue
+		}
+		r.OptionIDs = append(r.OptionIDs, o.ID)
+		texts = append(texts, o.Text+" = "+match)
+		if match == o.Match {
+			right++
+		}
+	}
+	r.Answer = strings.Join(texts, ", ")
+	r.Raw, _ = json.Marshal(pairs)
+	r.Credit = float64(right) / float64(len(q.Options))
+	return r, nil
+}
+
+func (matchingGrader) correctAnswer(q *database.Question) string {
+	texts := make([]string, 0, len(q.Options))
+	for _, o := range q.Options {
+		texts = append(texts, o.Text+" = "+o.Match)
+	}
+	return strings.Join(texts, ", ")
+}
+
+// textMatches reports whether a typed answer is close enough to an accepted
+// one. Answers containing digits must match exactly once normalized, as a
+// typo there changes the answer.
+func textMatches(answer, accepted string) bool {
+	answer, accepted = normalizeText(answer), normalizeText(accepted)
+	if answer == accepted {
+		return true
+	}
+	if strings.ContainsFunc(accepted, unicode.IsDigit) {
+		return false
+	}
+	allowed := min(len([]rune(accepted))/5, 3)
+	return editDistance(answer, accepted) <= allowed
+}
+
+// normalizeText lowercases s, reduces it to its words and drops a leading
+// article
+func normalizeText(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > 1 {
+		switch words[0] {
+		case "the", "a", "an":
+			words = words[1:]
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// editDistance is the Levenshtein distance between a and b in runes
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur := make([]int, len(br)+1)
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(br)]
+}
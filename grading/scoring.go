@@ -0,0 +1,74 @@
+package grading
+
+import (
+	"math"
+	"time"
+
+	"quizapp/database"
+)
+
+const (
+	// pointsPerQuestion is what a correct answer is worth under every
+	// policy. Partly correct answers earn their share of it.
+	pointsPerQuestion = 100
+	// maxSpeedBonus is added to a correct answer given straight away, and
+	// shrinks to nothing as the question's time runs out
+	maxSpeedBonus = 50
+	// speedBonusWindow stands in for the time limit of questions without one
+	speedBonusWindow = 30 * time.Second
+	// maxStreakMultiplier caps the multiplier of consecutive correct answers,
+	// which grows by half a point with each one. A partly correct answer
+	// ends the streak.
+	maxStreakMultiplier = 3
+	// wrongAnswerPenalty is taken off for each answer that earns nothing
+	// under negative marking. Skipped and timed out questions cost nothing.
+	wrongAnswerPenalty = 50
+)
+
+// Points works out what each answer of an attempt is worth under the
+// attempt's scoring policy, in whole points, and their total. Answers must
+// be in the order they were given. The total never drops below zero.
+func Points(attempt *database.Attempt, answers []database.LockedAnswer) ([]float64, float64) {
+	points := make([]float64, len(answers))
+	var total float64
+	streak := 0
+	for i, a := range answers {
+		if a.IsCorrect {
+			streak++
+		} else {
+			streak = 0
+		}
+
+		switch {
+		case a.Credit > 0:
+			points[i] = pointsPerQuestion * a.Credit
+			switch attempt.ScoringPolicy {
+			case database.ScoringSpeedBonus:
+				points[i] += speedBonus(attempt.TimeLimits.Question, a.TimeTakenMS) * a.Credit
+			case database.ScoringStreak:
+				if a.IsCorrect {
+					points[i] *= math.Min(1+0.5*float64(streak-1), maxStreakMultiplier)
+				}
+			}
+			points[i] = math.Round(points[i])
+		case attempt.ScoringPolicy == database.ScoringNegative && a.Answered() && !a.TimedOut:
+			points[i] = -wrongAnswerPenalty
+		}
+		total += points[i]
+	}
+	return points, math.Max(total, 0)
+}
+
+// speedBonus scales maxSpeedBonus by the share of the question's time that
+// was left. No bonus is given when the time taken is unknown.
+func speedBonus(limitSeconds int, timeTakenMS *int) float64 {
+	if timeTakenMS == nil {
+		return 0
+	}
+	window := speedBonusWindow
+	if limitSeconds > 0 {
+		window = time.Duration(limitSeconds) * time.Second
+	}
+	left := 1 - float64(*timeTakenMS)/float64(window.Milliseconds())
+	return math.Round(maxSpeedBonus * math.Max(left, 0))
+}
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"crypto/subtle"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	texttemplate "text/template"
+	"time"
 
 	"quizapp/database"
+	"quizapp/grading"
 	"quizapp/middleware"
+	"quizapp/models"
 	"quizapp/services"
 
 	"github.com/gorilla/mux"
@@ -18,9 +28,25 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Accounts are locked after this many failed logins inside the limiter's
+// window
+const (
+	lockoutThreshold = 10
+	lockoutDuration  = 30 * time.Minute
+)
+
+// How long the links sent by email stay valid
+const (
+	verifyEmailTTL   = 48 * time.Hour
+	resetPasswordTTL = time.Hour
+)
+
 var (
-	store         *sessions.CookieStore
+	store         *database.SessionStore
+	loginLimiter  middleware.LoginLimiter = middleware.NewLoginLimiter(middleware.SystemClock{})
+	mailer        services.Mailer
 	templates     *template.Template
+	mailTemplates *texttemplate.Template
 	templateFuncs = template.FuncMap{
 		"add": func(a, b int) int {
 			return a + b
@@ -31,27 +57,82 @@ var (
 		"formatScore": func(score float64) string {
 			return fmt.Sprintf("%.1f", score)
 		},
+		"formatSeconds": func(ms int) string {
+			return fmt.Sprintf("%.1fs", float64(ms)/1000)
+		},
+		"formatPercent": func(share float64) string {
+			return fmt.Sprintf("%.0f%%", share*100)
+		},
+		"formatPoints": func(points float64) string {
+			return fmt.Sprintf("%.0f", points)
+		},
+		"questionTypeName": func(questionType string) string {
+			return questionTypeNames[questionType]
+		},
+		"scoringPolicyName": func(policy string) string {
+			return scoringPolicies[policy].name
+		},
+		"scoringPolicyHelp": func(policy string) string {
+			return scoringPolicies[policy].help
+		},
+		"formatDuration": func(seconds int) string {
+			if seconds%60 == 0 {
+				return fmt.Sprintf("%d min", seconds/60)
+			}
+			return (time.Duration(seconds) * time.Second).String()
+		},
 		"split": strings.Split,
+		"join":  strings.Join,
+		"providerName": func(name string) string {
+			if provider, err := services.GetProvider(name); err == nil {
+				return provider.DisplayName()
+			}
+			return name
+		},
 	}
 )
 
-func init() {
+// setup configures sessions, login providers, the database and templates
+// from the environment
+func setup() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	production := os.Getenv("APP_ENV") == "production"
+
 	// Set default session key
 	sessionKey := "development-secret-key-123"
 	if key := os.Getenv("SESSION_KEY"); key != "" {
 		sessionKey = key
+	} else if production {
+		log.Fatal("SESSION_KEY must be set when APP_ENV=production")
 	} else {
 		log.Println("Warning: Using default session key. This is not secure for production.")
 	}
 
-	store = sessions.NewCookieStore([]byte(sessionKey))
+	store = database.NewSessionStore([]byte(sessionKey))
+	store.Options.Secure = production
 	middleware.SetStore(store)
+	database.SetTokenKey([]byte(sessionKey))
+	mailer = services.NewMailerFromEnv()
+
+	// Register external login providers
+	services.RegisterProvider(services.NewGithubProvider())
+	if oidc := services.NewOIDCProviderFromEnv(); oidc != nil {
+		services.RegisterProvider(oidc)
+	}
 
-	// Initialize database
+	// Initialize database. DATABASE_URL picks SQLite or Postgres; the
+	// migrate command manages the schema itself.
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		dsn = "quiz.db"
+	}
+	initialize := database.Initialize
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		initialize = database.Open
+	}
 	log.Println("Initializing database...")
-	if err := database.Initialize("quiz.db"); err != nil {
+	if err := initialize(dsn); err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
 	log.Println("Database initialized successfully")
@@ -59,12 +140,39 @@ func init() {
 	// Parse templates with functions
 	log.Println("Parsing templates...")
 	templates = template.Must(template.New("").Funcs(templateFuncs).ParseGlob("templates/*.html"))
+	mailTemplates = texttemplate.Must(texttemplate.ParseGlob("templates/email/*.txt"))
 	log.Println("Templates parsed successfully")
 }
 
 func main() {
+	setup()
 	defer database.Close()
+
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if admins, err := database.CountUsersWithRole(database.RoleAdmin); err == nil && admins == 0 {
+		log.Println("No admin account exists yet. Promote one with: quizapp set-role <username> admin")
+	}
+
+	r := newRouter()
+
+	// Add logging
+	port := ":8080"
+	go database.SweepExpiredSessions(15*time.Minute, nil)
+
+	log.Printf("Server starting on http://localhost%s", port)
+	log.Fatal(http.ListenAndServe(port, r))
+}
+
+// newRouter registers every route the app serves
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(middleware.CSRFProtect)
 
 	// Serve static files
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
@@ -72,36 +180,71 @@ func main() {
 	// Auth routes
 	r.HandleFunc("/register", handleRegister).Methods("GET", "POST")
 	r.HandleFunc("/login", handleLogin).Methods("GET", "POST")
+	r.HandleFunc("/login/2fa", handleLoginTwoFactor).Methods("GET", "POST")
 	r.HandleFunc("/logout", handleLogout).Methods("POST")
+	r.HandleFunc("/forgot-password", handleForgotPassword).Methods("GET", "POST")
+	r.HandleFunc("/reset-password", handleResetPassword).Methods("GET", "POST")
+	r.HandleFunc("/verify-email", handleVerifyEmail).Methods("GET")
 
 	// Quiz routes
 	r.HandleFunc("/", middleware.RequireAuth(handleHome)).Methods("GET")
-	r.HandleFunc("/quiz/{id}", middleware.RequireAuth(handleQuiz)).Methods("GET")
-	r.HandleFunc("/api/submit-quiz", middleware.RequireAuth(handleQuizSubmission)).Methods("POST")
+	r.HandleFunc("/quiz/{id}", middleware.RequireScope(database.ScopePlay, handleQuiz)).Methods("GET")
+	r.HandleFunc("/api/submit-quiz", middleware.RequireScope(database.ScopePlay, handleQuizSubmission)).Methods("POST")
+	r.HandleFunc("/api/next-question", middleware.RequireScope(database.ScopePlay, handleNextQuestion)).Methods("POST")
+	r.HandleFunc("/api/check-answer", middleware.RequireScope(database.ScopePlay, handleCheckAnswer)).Methods("POST")
 
 	// Admin routes (protected)
-	r.HandleFunc("/admin/create-quiz", middleware.RequireAuth(handleCreateQuiz)).Methods("GET", "POST")
+	r.HandleFunc("/admin/create-quiz", middleware.RequireScope(database.ScopeWrite, middleware.RequireRole(database.RoleAuthor, handleCreateQuiz))).Methods("GET", "POST")
+	r.HandleFunc("/admin/quizzes", middleware.RequireRole(database.RoleAuthor, handleAuthorQuizzes)).Methods("GET")
+	r.HandleFunc("/admin/quizzes", middleware.RequireRole(database.RoleAuthor, handleCreateDraftQuiz)).Methods("POST")
+	r.HandleFunc("/admin/quizzes/{id}/edit", middleware.RequireRole(database.RoleAuthor, handleEditQuiz)).Methods("GET")
+	r.HandleFunc("/admin/quizzes/{id}", middleware.RequireRole(database.RoleAuthor, handleRenameQuiz)).Methods("POST")
+	r.HandleFunc("/admin/quizzes/{id}/status", middleware.RequireRole(database.RoleAuthor, handleSetQuizStatus)).Methods("POST")
+	r.HandleFunc("/admin/quizzes/{id}/time-limits", middleware.RequireRole(database.RoleAuthor, handleSetQuizTimeLimits)).Methods("POST")
+	r.HandleFunc("/admin/quizzes/{id}/scoring", middleware.RequireRole(database.RoleAuthor, handleSetScoringPolicy)).Methods("POST")
+	r.HandleFunc("/admin/quizzes/{id}/delete", middleware.RequireRole(database.RoleAuthor, handleDeleteQuiz)).Methods("POST")
+	r.HandleFunc("/admin/quizzes/{id}/questions", middleware.RequireRole(database.RoleAuthor, handleAddQuestion)).Methods("POST")
+	r.HandleFunc("/admin/quizzes/{id}/questions/{questionId}", middleware.RequireRole(database.RoleAuthor, handleUpdateQuestion)).Methods("POST")
+	r.HandleFunc("/admin/quizzes/{id}/questions/{questionId}/delete", middleware.RequireRole(database.RoleAuthor, handleDeleteQuestion)).Methods("POST")
+	r.HandleFunc("/admin/quizzes/{id}/questions/{questionId}/move", middleware.RequireRole(database.RoleAuthor, handleMoveQuestion)).Methods("POST")
+	r.HandleFunc("/admin/lockouts", middleware.RequireRole(database.RoleAdmin, handleLockouts)).Methods("GET")
+	r.HandleFunc("/admin/lockouts/{id}/unlock", middleware.RequireRole(database.RoleAdmin, handleUnlockAccount)).Methods("POST")
 
 	// Leaderboard route
-	r.HandleFunc("/leaderboard", middleware.RequireAuth(handleLeaderboard)).Methods("GET")
+	r.HandleFunc("/leaderboard", middleware.RequireScope(database.ScopeRead, handleLeaderboard)).Methods("GET")
 
 	// Past quizzes route
-	r.HandleFunc("/past-quizzes", middleware.RequireAuth(handlePastQuizzes)).Methods("GET")
-
-	// GitHub routes
-	r.HandleFunc("/auth/github", handleGithubAuth)
-	r.HandleFunc("/auth/github/callback", handleGithubCallback)
-
-	// Add logging
-	port := ":8080"
-	log.Printf("Server starting on http://localhost%s", port)
-	log.Fatal(http.ListenAndServe(port, r))
+	r.HandleFunc("/past-quizzes", middleware.RequireScope(database.ScopeRead, handlePastQuizzes)).Methods("GET")
+	r.HandleFunc("/past-quizzes/attempts/{id:[0-9]+}", middleware.RequireScope(database.ScopeRead, handleAttemptReview)).Methods("GET")
+
+	// Account settings
+	r.HandleFunc("/settings", middleware.RequireAuth(handleSettings)).Methods("GET")
+	r.HandleFunc("/settings/identities/{id}/unlink", middleware.RequireAuth(handleUnlinkIdentity)).Methods("POST")
+	r.HandleFunc("/settings/sessions/revoke", middleware.RequireAuth(handleLogoutEverywhere)).Methods("POST")
+	r.HandleFunc("/settings/verify-email", middleware.RequireAuth(handleResendVerification)).Methods("POST")
+	r.HandleFunc("/settings/tokens", middleware.RequireAuth(handleCreateAPIToken)).Methods("POST")
+	r.HandleFunc("/settings/tokens/{id}/revoke", middleware.RequireAuth(handleRevokeAPIToken)).Methods("POST")
+	r.HandleFunc("/settings/2fa/setup", middleware.RequireAuth(handleTOTPSetup)).Methods("POST")
+	r.HandleFunc("/settings/2fa/enable", middleware.RequireAuth(handleTOTPEnable)).Methods("POST")
+	r.HandleFunc("/settings/2fa/disable", middleware.RequireAuth(handleTOTPDisable)).Methods("POST")
+	r.HandleFunc("/settings/2fa/recovery-codes", middleware.RequireAuth(handleRecoveryCodes)).Methods("POST")
+
+	// JSON API
+	r.HandleFunc("/api/openapi.json", handleOpenAPI).Methods("GET")
+	registerAPIRoutes(r)
+
+	// External login routes
+	r.HandleFunc("/auth/{provider}", handleOAuthLogin)
+	r.HandleFunc("/auth/{provider}/callback", handleOAuthCallback)
+
+	return r
 }
 
 func handleRegister(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		if err := templates.ExecuteTemplate(w, "register.html", map[string]interface{}{
-			"Error": r.URL.Query().Get("error"),
+			"Error":     r.URL.Query().Get("error"),
+			"CSRFToken": middleware.CSRFToken(r),
 		}); err != nil {
 			log.Printf("Template error: %v", err)
 			http.Error(w, "Server error", http.StatusInternalServerError)
@@ -119,6 +262,10 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/register?error=All fields are required", http.StatusSeeOther)
 		return
 	}
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		http.Redirect(w, r, "/register?error=Enter a valid email address", http.StatusSeeOther)
+		return
+	}
 
 	// Create user
 	if err := database.CreateUser(username, email, password); err != nil {
@@ -133,381 +280,1749 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 
 	// Log success and redirect
 	log.Printf("New user registered: %s (%s)", username, email)
-	http.Redirect(w, r, "/login", http.StatusSeeOther)
-}
 
-func handleLogin(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
-		err := templates.ExecuteTemplate(w, "login.html", nil)
-		if err != nil {
-			log.Printf("Template error: %v", err)
-			http.Error(w, "Server error", http.StatusInternalServerError)
-			return
-		}
-		return
+	if user, err := database.GetUserByUsername(username); err != nil {
+		log.Printf("Error getting new user: %v", err)
+	} else if err := sendVerificationEmail(r, user); err != nil {
+		log.Printf("Failed to send verification email: %v", err)
 	}
 
-	username := r.FormValue("username")
-	password := r.FormValue("password")
-
-	log.Printf("Login attempt: username=%s", username)
+	http.Redirect(w, r, "/login?notice=registered", http.StatusSeeOther)
+}
 
-	user, err := database.GetUserByUsername(username)
-	if err != nil {
-		log.Printf("Login error: %v", err)
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-		return
+// sendEmail renders one of the templates in templates/email and sends it.
+// The first line of a template is its subject.
+func sendEmail(to, name string, data interface{}) error {
+	var b strings.Builder
+	if err := mailTemplates.ExecuteTemplate(&b, name, data); err != nil {
+		return fmt.Errorf("failed to render %s: %v", name, err)
 	}
 
-	// Simple password check for now
-	if user.Password != password {
-		log.Printf("Password mismatch for user: %s", username)
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-		return
+	header, body, _ := strings.Cut(b.String(), "\n\n")
+	return mailer.Send(services.Message{
+		To:      to,
+		Subject: strings.TrimPrefix(header, "Subject: "),
+		Body:    body,
+	})
+}
+
+func sendVerificationEmail(r *http.Request, user *database.User) error {
+	token, err := database.IssueToken(user.ID, database.TokenVerifyEmail, user.Email, verifyEmailTTL)
+	if err != nil {
+		return err
 	}
+	return sendEmail(user.Email, "verify_email.txt", map[string]interface{}{
+		"Username": user.Username,
+		"Link":     baseURL(r) + "/verify-email?token=" + url.QueryEscape(token),
+		"Expires":  "48 hours",
+	})
+}
 
-	session, err := store.Get(r, "quiz-session")
+func handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token, err := database.ConsumeToken(database.TokenVerifyEmail, r.URL.Query().Get("token"))
 	if err != nil {
-		log.Printf("Session error: %v", err)
-		http.Error(w, "Server error", http.StatusInternalServerError)
+		if !errors.Is(err, database.ErrInvalidToken) {
+			log.Printf("Error verifying email: %v", err)
+		}
+		http.Redirect(w, r, "/login?error="+url.QueryEscape("That verification link is invalid or has expired"), http.StatusSeeOther)
 		return
 	}
 
-	session.Values["userID"] = user.ID
-	if err := session.Save(r, w); err != nil {
-		log.Printf("Session save error: %v", err)
+	if err := database.MarkEmailVerified(token.UserID, token.Email); err != nil {
+		log.Printf("Error verifying email: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Login successful: username=%s, userID=%d", username, user.ID)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	log.Printf("Verified email %s of user %d", token.Email, token.UserID)
+	http.Redirect(w, r, "/login?notice=verified", http.StatusSeeOther)
 }
 
-func handleCreateQuiz(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "quiz-session")
-	userID, ok := session.Values["userID"].(int)
+// handleResendVerification sends a new verification link to the logged-in
+// user
+func handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
 	if !ok {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	if r.Method == "GET" {
-		categories, err := services.FetchCategories()
-		if err != nil {
-			http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !user.EmailVerified {
+		if err := sendVerificationEmail(r, user); err != nil {
+			log.Printf("Failed to send verification email: %v", err)
+			http.Redirect(w, r, "/settings?error="+url.QueryEscape("The verification email could not be sent"), http.StatusSeeOther)
 			return
 		}
+	}
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
 
-		templates.ExecuteTemplate(w, "create_quiz.html", map[string]interface{}{
-			"Categories": categories,
-		})
+// handleForgotPassword emails a password reset link. It answers the same
+// way whether or not the address belongs to an account.
+func handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		if err := templates.ExecuteTemplate(w, "forgot_password.html", map[string]interface{}{
+			"CSRFToken": middleware.CSRFToken(r),
+		}); err != nil {
+			log.Printf("Template error: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	var request struct {
-		Title         string `json:"title"`
-		Category      int    `json:"category"`
-		Difficulty    string `json:"difficulty"`
-		QuestionCount int    `json:"questionCount"`
+	// Every request counts against the limiter so the form cannot be used
+	// to flood someone's inbox
+	key := "reset:" + database.ClientIP(r)
+	if wait := loginLimiter.Delay(key); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+		http.Error(w, "Too many requests. Try again later.", http.StatusTooManyRequests)
+		return
+	}
+	loginLimiter.Fail(key)
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	user, err := database.GetUserByEmail(email)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		log.Printf("Password reset requested for unknown email %s", email)
+	case err != nil:
+		log.Printf("Error getting user: %v", err)
+	default:
+		token, err := database.IssueToken(user.ID, database.TokenResetPassword, user.Email, resetPasswordTTL)
+		if err == nil {
+			err = sendEmail(user.Email, "reset_password.txt", map[string]interface{}{
+				"Username": user.Username,
+				"Link":     baseURL(r) + "/reset-password?token=" + url.QueryEscape(token),
+				"Expires":  "1 hour",
+			})
+		}
+		if err != nil {
+			log.Printf("Failed to send password reset email: %v", err)
+		}
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	http.Redirect(w, r, "/login?notice=reset-sent", http.StatusSeeOther)
+}
+
+func handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	invalid := "/login?error=" + url.QueryEscape("That password reset link is invalid or has expired")
+
+	if r.Method == "GET" {
+		if !database.CheckToken(database.TokenResetPassword, token) {
+			http.Redirect(w, r, invalid, http.StatusSeeOther)
+			return
+		}
+		if err := templates.ExecuteTemplate(w, "reset_password.html", map[string]interface{}{
+			"Token":     token,
+			"Error":     r.URL.Query().Get("error"),
+			"CSRFToken": middleware.CSRFToken(r),
+		}); err != nil {
+			log.Printf("Template error: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	questions, err := services.FetchQuizQuestions(request.Category, request.Difficulty, request.QuestionCount)
-	if err != nil {
-		http.Error(w, "Failed to fetch questions", http.StatusInternalServerError)
+	password := r.FormValue("password")
+	if password == "" || password != r.FormValue("confirm_password") {
+		http.Redirect(w, r, "/reset-password?token="+url.QueryEscape(token)+"&error="+url.QueryEscape("The passwords do not match"), http.StatusSeeOther)
 		return
 	}
 
-	tx, err := database.DB.Begin()
+	t, err := database.ConsumeToken(database.TokenResetPassword, token)
 	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
+		if !errors.Is(err, database.ErrInvalidToken) {
+			log.Printf("Error using reset token: %v", err)
+		}
+		http.Redirect(w, r, invalid, http.StatusSeeOther)
 		return
 	}
-	defer tx.Rollback()
 
-	result, err := tx.Exec(`
-		INSERT INTO quizzes (title, created_by)
-		VALUES (?, ?)
-	`, request.Title, userID)
-	if err != nil {
-		http.Error(w, "Failed to create quiz", http.StatusInternalServerError)
+	user, err := database.GetUserByID(t.UserID)
+	if err != nil || user.Email != t.Email {
+		http.Redirect(w, r, invalid, http.StatusSeeOther)
 		return
 	}
 
-	quizID, err := result.LastInsertId()
-	if err != nil {
-		http.Error(w, "Failed to get quiz ID", http.StatusInternalServerError)
+	if err := database.SetPassword(user.ID, password); err != nil {
+		log.Printf("Error resetting password: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	for _, q := range questions {
-		options := append([]string{q.CorrectAnswer}, q.IncorrectAnswers...)
-		optionsStr := strings.Join(options, "|")
-		_, err = tx.Exec(`
-			INSERT INTO questions (quiz_id, text, options, answer)
-			VALUES (?, ?, ?, ?)
-		`, quizID, q.Question, optionsStr, q.CorrectAnswer)
+	// The reset link proves the user receives mail at the address. Whoever
+	// knew the old password is logged out and the account is unlocked.
+	if err := database.MarkEmailVerified(user.ID, user.Email); err != nil {
+		log.Printf("Error verifying email: %v", err)
+	}
+	if err := database.InvalidateTokens(user.ID, database.TokenResetPassword); err != nil {
+		log.Printf("Error invalidating reset tokens: %v", err)
+	}
+	if err := database.RevokeUserSessions(user.ID); err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+	}
+	if err := database.UnlockAccount(user.ID); err != nil {
+		log.Printf("Error unlocking account: %v", err)
+	}
+	loginLimiter.Reset(loginKey(user.Username))
+
+	log.Printf("Password reset for user %s", user.Username)
+	http.Redirect(w, r, "/login?notice=password-reset", http.StatusSeeOther)
+}
+
+// loginNotices are the messages the login page shows after being
+// redirected to with ?notice=
+var loginNotices = map[string]string{
+	"registered":     "Your account was created. Check your inbox for a link to verify your email address.",
+	"verified":       "Your email address is verified.",
+	"reset-sent":     "If an account uses that email address, we sent it a link to reset the password.",
+	"password-reset": "Your password was changed. Log in with the new password.",
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		data := map[string]interface{}{
+			"Providers": services.Providers(),
+			"Error":     r.URL.Query().Get("error"),
+			"Notice":    loginNotices[r.URL.Query().Get("notice")],
+			"CSRFToken": middleware.CSRFToken(r),
+		}
+
+		// Explain why the user has to log in before an external identity
+		// can be linked
+		session, _ := store.Get(r, "quiz-session")
+		if pending := pendingIdentity(session); pending != nil {
+			if provider, err := services.GetProvider(pending.Provider); err == nil {
+				data["LinkProvider"] = provider.DisplayName()
+			}
+		}
+
+		err := templates.ExecuteTemplate(w, "login.html", data)
 		if err != nil {
-			http.Error(w, "Failed to create questions", http.StatusInternalServerError)
+			log.Printf("Template error: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
 			return
 		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		http.Error(w, "Failed to create quiz", http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"quizId": quizID,
-	})
-}
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+	ip := database.ClientIP(r)
+	userKey, ipKey := loginKey(username), "ip:"+ip
 
-func handleLogout(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "quiz-session")
-	session.Values = map[interface{}]interface{}{}
-	session.Save(r, w)
-	http.Redirect(w, r, "/login", http.StatusSeeOther)
-}
+	log.Printf("Login attempt: username=%s", username)
 
-func handleHome(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "quiz-session")
-	userID, ok := session.Values["userID"].(int)
-	if !ok {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	// Slow down guessing from a single address as well as against a single
+	// account spread over many addresses
+	if wait := max(loginLimiter.Delay(userKey), loginLimiter.Delay(ipKey)); wait > 0 {
+		log.Printf("Throttled login for user %s from %s", username, ip)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+		http.Error(w, "Too many login attempts. Try again later.", http.StatusTooManyRequests)
 		return
 	}
 
-	// Get user info
-	user, err := database.GetUserByID(userID)
+	lockout, err := database.GetActiveLockout(username)
 	if err != nil {
-		log.Printf("Error getting user: %v", err)
+		log.Printf("Login error: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
+	if lockout != nil {
+		log.Printf("Login for locked account: %s", username)
+		http.Error(w, "This account is temporarily locked. Try again later or contact an administrator.", http.StatusForbidden)
+		return
+	}
 
-	// Get user stats
-	stats, err := database.GetUserStats(userID)
+	user, err := database.AuthenticateUser(username, password)
 	if err != nil {
-		log.Printf("Error getting user stats: %v", err)
-		stats = &database.UserStats{
-			QuizzesTaken: 0,
-			AverageScore: 0,
-			GlobalRank:   0,
+		if errors.Is(err, database.ErrInvalidCredentials) {
+			log.Printf("Invalid credentials for user: %s", username)
+			failLogin(username, ip)
+		} else {
+			log.Printf("Login error: %v", err)
 		}
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
 	}
 
-	// Get top 5 performers
-	topScores, err := database.GetTopScores(5)
+	session, err := store.Get(r, "quiz-session")
 	if err != nil {
-		log.Printf("Error getting top scores: %v", err)
-		topScores = []database.TopScore{} // Use empty list on error
-	}
-
-	data := map[string]interface{}{
-		"Username":     user.Username,
-		"QuizzesTaken": stats.QuizzesTaken,
-		"AverageScore": stats.AverageScore,
-		"GlobalRank":   stats.GlobalRank,
-		"TopScores":    topScores,
-	}
-
-	if err := templates.ExecuteTemplate(w, "home.html", data); err != nil {
-		log.Printf("Template error: %v", err)
+		log.Printf("Session error: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
+
+	beginLogin(w, r, session, user)
 }
 
-func handleQuiz(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	quizID := vars["id"]
+// loginKey is the limiter key that counts failed logins to an account
+func loginKey(username string) string {
+	return "user:" + database.NormalizeUsername(username)
+}
 
-	quiz, err := database.GetQuizWithQuestions(quizID)
-	if err != nil {
-		log.Printf("Error getting quiz: %v", err)
-		http.Error(w, "Quiz not found", http.StatusNotFound)
-		return
+// failLogin counts a wrong password or two-factor code against the account
+// and the address it came from, and locks the account once it has failed
+// lockoutThreshold times. It reports whether the account was locked.
+func failLogin(username, ip string) bool {
+	key := loginKey(username)
+	loginLimiter.Fail("ip:" + ip)
+	failures := loginLimiter.Fail(key)
+	if failures < lockoutThreshold {
+		return false
 	}
+	if err := database.LockAccount(username, failures, ip, time.Now().Add(lockoutDuration)); err != nil {
+		log.Printf("Failed to lock account %s: %v", username, err)
+	} else {
+		log.Printf("Locked account %s after %d failed logins", username, failures)
+	}
+	loginLimiter.Reset(key)
+	return true
+}
 
-	if err := templates.ExecuteTemplate(w, "quiz.html", quiz); err != nil {
-		log.Printf("Template error: %v", err)
+// twoFactorLifetime bounds how long a user has to enter their code after
+// the password was accepted
+const twoFactorLifetime = 5 * time.Minute
+
+// beginLogin logs a user in whose first factor was verified, or sends them
+// to the second login step if they enabled two-factor authentication
+func beginLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session, user *database.User) {
+	hasTOTP, err := database.HasTOTP(user.ID)
+	if err != nil {
+		log.Printf("Error checking two-factor authentication: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
-}
 
-func handleQuizSubmission(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "quiz-session")
-	userID, ok := session.Values["userID"].(int)
-	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if hasTOTP {
+		session.Values["twoFactorUserID"] = user.ID
+		session.Values["twoFactorAt"] = time.Now().Unix()
+		if err := session.Save(r, w); err != nil {
+			log.Printf("Session save error: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
 		return
 	}
 
-	var submission struct {
-		QuizID  int      `json:"quizId"`
-		Answers []string `json:"answers"`
-	}
+	completeLogin(w, r, session, user)
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&submission); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+// completeLogin marks the session as logged in as user. The session gets a
+// new ID, so an ID planted in the browser before login is worth nothing.
+func completeLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session, user *database.User) {
+	// Logging in proves ownership of the account, so an identity that
+	// collided with it can now be linked
+	if pending := pendingIdentity(session); pending != nil {
+		if err := database.AddIdentity(user.ID, pending); err != nil {
+			log.Printf("Failed to link %s identity to user %d: %v", pending.Provider, user.ID, err)
+		} else {
+			log.Printf("Linked %s identity %s to user %d", pending.Provider, pending.Subject, user.ID)
+		}
 	}
-
-	// Get all questions and answers
-	rows, err := database.DB.Query(`
-		SELECT text, answer 
-		FROM questions 
-		WHERE quiz_id = ? 
-		ORDER BY id
-	`, submission.QuizID)
-	if err != nil {
+	clearPendingIdentity(session)
+	clearTwoFactor(session)
+	// Failed passwords and codes only stop counting once both factors
+	// have been accepted
+	loginLimiter.Reset(loginKey(user.Username))
+
+	if session.ID != "" {
+		if err := database.DeleteSession(session.ID); err != nil {
+			log.Printf("Error deleting pre-login session: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		session.ID = ""
+	}
+	session.Values["userID"] = user.ID
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Session save error: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var correctAnswers int
-	var questions []map[string]interface{}
-
-	for i := 0; rows.Next(); i++ {
-		var questionText, correctAnswer string
-		if err := rows.Scan(&questionText, &correctAnswer); err != nil {
-			continue
-		}
+	log.Printf("Login successful: username=%s, userID=%d", user.Username, user.ID)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
 
-		userAnswer := ""
-		if i < len(submission.Answers) {
-			userAnswer = submission.Answers[i]
-		}
+// twoFactorUser returns the user waiting for the second login step, or 0
+func twoFactorUser(session *sessions.Session) int {
+	userID, _ := session.Values["twoFactorUserID"].(int)
+	at, _ := session.Values["twoFactorAt"].(int64)
+	if time.Since(time.Unix(at, 0)) > twoFactorLifetime {
+		return 0
+	}
+	return userID
+}
 
-		isCorrect := userAnswer == correctAnswer
-		if isCorrect {
-			correctAnswers++
-		}
+func clearTwoFactor(session *sessions.Session) {
+	delete(session.Values, "twoFactorUserID")
+	delete(session.Values, "twoFactorAt")
+}
 
-		questions = append(questions, map[string]interface{}{
-			"text":          questionText,
-			"isCorrect":     isCorrect,
-			"userAnswer":    userAnswer,
-			"correctAnswer": correctAnswer,
-		})
+// verifySecondFactor checks a code from the authenticator app or one of the
+// recovery codes. Either is accepted only once.
+func verifySecondFactor(userID int, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(strings.ReplaceAll(code, "-", "")) > 6 {
+		return database.UseRecoveryCode(userID, code)
 	}
 
-	totalQuestions := len(questions)
-	if totalQuestions == 0 {
-		http.Error(w, "Quiz not found", http.StatusNotFound)
-		return
+	totp, err := database.GetTOTP(userID)
+	if err != nil || totp == nil || !totp.Enabled {
+		return false, err
 	}
 
-	score := float64(correctAnswers) / float64(totalQuestions) * 100
+	step, ok := services.VerifyTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return database.UseTOTPStep(userID, step)
+}
 
-	// Save the score
-	if err := database.SaveQuizScore(userID, submission.QuizID, score); err != nil {
+// handleLoginTwoFactor is the second login step for users with two-factor
+// authentication enabled
+func handleLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Get(r, "quiz-session")
+	if err != nil {
+		log.Printf("Session error: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Get user's rank for this quiz
-	var rank int
-	err = database.DB.QueryRow(`
-		WITH RankedScores AS (
-			SELECT user_id, score,
-				   RANK() OVER (ORDER BY score DESC) as rank
-			FROM quiz_results
-			WHERE quiz_id = ?
-		)
-		SELECT COALESCE(rank, 0)
-		FROM RankedScores
-		WHERE user_id = ?
-	`, submission.QuizID, userID).Scan(&rank)
-	if err != nil {
-		rank = 0 // Default to 0 if error
+	userID := twoFactorUser(session)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
 	}
 
-	// Return the results
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"score":          score,
-		"correctAnswers": correctAnswers,
-		"totalQuestions": totalQuestions,
-		"questions":      questions,
-		"rank":           rank,
-	})
+	if r.Method == "GET" {
+		if err := templates.ExecuteTemplate(w, "login_2fa.html", map[string]interface{}{
+			"Error":     r.URL.Query().Get("error"),
+			"CSRFToken": middleware.CSRFToken(r),
+		}); err != nil {
+			log.Printf("Template error: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Codes are guessed under the same limits as passwords, and a lockout
+	// imposed since the password was accepted ends the login
+	ip := database.ClientIP(r)
+	if wait := max(loginLimiter.Delay(loginKey(user.Username)), loginLimiter.Delay("ip:"+ip)); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+		http.Error(w, "Too many attempts. Try again later.", http.StatusTooManyRequests)
+		return
+	}
+	lockout, err := database.GetActiveLockout(user.Username)
+	if err != nil {
+		log.Printf("Login error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if lockout != nil {
+		log.Printf("Two-factor login for locked account: %s", user.Username)
+		clearTwoFactor(session)
+		session.Save(r, w)
+		http.Error(w, "This account is temporarily locked. Try again later or contact an administrator.", http.StatusForbidden)
+		return
+	}
+
+	ok, err := verifySecondFactor(userID, r.FormValue("code"))
+	if err != nil {
+		log.Printf("Error verifying two-factor code: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		log.Printf("Invalid two-factor code for user: %s", user.Username)
+		if failLogin(user.Username, ip) {
+			clearTwoFactor(session)
+			session.Save(r, w)
+			http.Error(w, "This account is temporarily locked. Try again later or contact an administrator.", http.StatusForbidden)
+			return
+		}
+		http.Redirect(w, r, "/login/2fa?error="+url.QueryEscape("Invalid code"), http.StatusSeeOther)
+		return
+	}
+
+	completeLogin(w, r, session, user)
+}
+
+// generatedQuizRequest is the body of a POST to /admin/create-quiz
+type generatedQuizRequest struct {
+	Title         string `json:"title"`
+	Category      int    `json:"category"`
+	Difficulty    string `json:"difficulty"`
+	QuestionCount int    `json:"questionCount"`
+}
+
+// generatedQuiz is returned by a POST to /admin/create-quiz
+type generatedQuiz struct {
+	QuizID int `json:"quizId"`
+}
+
+func handleCreateQuiz(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == "GET" {
+		categories, err := services.FetchCategories()
+		if err != nil {
+			http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+			return
+		}
+
+		templates.ExecuteTemplate(w, "create_quiz.html", map[string]interface{}{
+			"Categories": categories,
+			"CSRFToken":  middleware.CSRFToken(r),
+		})
+		return
+	}
+
+	var request generatedQuizRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	questions, err := services.FetchQuizQuestions(request.Category, request.Difficulty, request.QuestionCount)
+	if err != nil {
+		http.Error(w, "Failed to fetch questions", http.StatusInternalServerError)
+		return
+	}
+
+	quizQuestions := make([]database.Question, 0, len(questions))
+	for _, q := range questions {
+		if q.Type == services.TriviaBoolean {
+			quizQuestions = append(quizQuestions, database.Question{
+				Text: q.Question,
+				Type: database.QuestionTrueFalse,
+				Options: []database.Option{
+					{Text: "True", IsCorrect: q.CorrectAnswer == "True"},
+					{Text: "False", IsCorrect: q.CorrectAnswer == "False"},
+				},
+			})
+			continue
+		}
+		options := []database.Option{{Text: q.CorrectAnswer, IsCorrect: true}}
+		for _, incorrect := range q.IncorrectAnswers {
+			options = append(options, database.Option{Text: incorrect})
+		}
+		quizQuestions = append(quizQuestions, database.Question{Text: q.Question, Options: options})
+	}
+
+	quiz, err := database.CreateQuiz(database.Quiz{
+		Title:      request.Title,
+		CreatedBy:  userID,
+		Status:     database.QuizPublished,
+		TimeLimits: database.DefaultTimeLimits,
+		Questions:  quizQuestions,
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidQuiz) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error creating quiz: %v", err)
+		http.Error(w, "Failed to create quiz", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(generatedQuiz{QuizID: quiz.ID})
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "quiz-session")
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Session delete error: %v", err)
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// handleLogoutEverywhere revokes every session of the user, including the
+// current one
+func handleLogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "quiz-session")
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := database.RevokeUserSessions(userID); err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	session.Options.MaxAge = -1
+	session.Save(r, w)
+	log.Printf("Logged out all sessions of user %d", userID)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func handleHome(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// Get user info
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Get user stats
+	stats, err := database.GetUserStats(userID)
+	if err != nil {
+		log.Printf("Error getting user stats: %v", err)
+		stats = &database.UserStats{
+			QuizzesTaken: 0,
+			AverageScore: 0,
+			GlobalRank:   0,
+		}
+	}
+
+	// Get top 5 performers
+	topScores, err := database.GetTopScores(5)
+	if err != nil {
+		log.Printf("Error getting top scores: %v", err)
+		topScores = []database.TopScore{} // Use empty list on error
+	}
+
+	data := map[string]interface{}{
+		"Username":     user.Username,
+		"QuizzesTaken": stats.QuizzesTaken,
+		"AverageScore": stats.AverageScore,
+		"TotalPoints":  stats.TotalPoints,
+		"GlobalRank":   stats.GlobalRank,
+		"TopScores":    topScores,
+		"CanCreate":    user.HasRole(database.RoleAuthor),
+		"IsAdmin":      user.HasRole(database.RoleAdmin),
+		"CSRFToken":    middleware.CSRFToken(r),
+	}
+
+	if err := templates.ExecuteTemplate(w, "home.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleQuiz shows the start screen of a quiz. The attempt is only started
+// once the player presses start, and its questions are then fetched one at
+// a time from /api/next-question.
+func handleQuiz(w http.ResponseWriter, r *http.Request) {
+	if _, ok := middleware.UserID(r); !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	vars := mux.Vars(r)
+	quizID := vars["id"]
+
+	quiz, err := database.GetQuizWithQuestions(quizID)
+	if err != nil {
+		log.Printf("Error getting quiz: %v", err)
+		http.Error(w, "Quiz not found", http.StatusNotFound)
+		return
+	}
+	if !quiz.IsPublished() {
+		http.Error(w, "Quiz not found", http.StatusNotFound)
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "quiz.html", map[string]interface{}{
+		"Quiz":          quiz,
+		"QuestionCount": len(quiz.Questions),
+		"CSRFToken":     middleware.CSRFToken(r),
+	}); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// quizSubmission is the body of /api/submit-quiz
+type quizSubmission struct {
+	QuizID    int             `json:"quizId"`
+	AttemptID int             `json:"attemptId"`
+	Answers   grading.Answers `json:"answers"`
+}
+
+// submissionResult is the graded submission returned by /api/submit-quiz
+type submissionResult struct {
+	*grading.Result
+	Rank int `json:"rank"`
+}
+
+func handleQuizSubmission(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var submission quizSubmission
+	if err := json.NewDecoder(r.Body).Decode(&submission); err != nil {
+		if grading.IsClientError(err) {
+			middleware.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		middleware.WriteJSONError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	attempt, err := database.GetAttempt(submission.AttemptID)
+	if err != nil || attempt.UserID != userID || attempt.QuizID != submission.QuizID {
+		middleware.WriteJSONError(w, http.StatusNotFound, "Attempt not found")
+		return
+	}
+	if attempt.SubmittedAt != nil {
+		middleware.WriteJSONError(w, http.StatusConflict, "Attempt already submitted")
+		return
+	}
+
+	quiz, err := database.GetQuizWithQuestions(strconv.Itoa(submission.QuizID))
+	if err != nil || len(quiz.Questions) == 0 {
+		middleware.WriteJSONError(w, http.StatusNotFound, "Quiz not found")
+		return
+	}
+
+	shuffleForAttempt(quiz, attempt)
+
+	// Answers already locked in through /api/check-answer take precedence
+	// over whatever the client resubmits for the same question. The rest
+	// only count for questions that were served, and are received now: if
+	// the question's time has run out they are timed out.
+	locked, err := database.GetAttemptAnswers(attempt.ID)
+	if err != nil {
+		log.Printf("Error getting locked answers: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	served, err := database.GetServedQuestions(attempt.ID)
+	if err != nil {
+		log.Printf("Error getting served questions: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	now := time.Now()
+	answers := grading.Answers{}
+	timing := map[int]grading.Timing{}
+	for id, answer := range submission.Answers {
+		if _, err := grading.FindQuestion(quiz, id); err != nil {
+			middleware.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		servedAt, ok := served[id]
+		if !ok {
+			continue
+		}
+		timeTaken := int(now.Sub(servedAt).Milliseconds())
+		answers[id] = answer
+		timing[id] = grading.Timing{TimeTakenMS: &timeTaken, TimedOut: attempt.TimedOut(servedAt, now)}
+	}
+
+	result, err := grading.Grade(quiz, attempt, locked, answers, timing)
+	if err != nil {
+		if grading.IsClientError(err) {
+			middleware.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Error grading quiz %d: %v", submission.QuizID, err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	var graded []database.LockedAnswer
+	for _, a := range result.Answers {
+		if _, answered := answers[a.QuestionID]; answered {
+			graded = append(graded, a)
+		}
+	}
+	if err := database.SubmitAttempt(attempt.ID, graded, result.Score, result.Points); err != nil {
+		if errors.Is(err, database.ErrAttemptSubmitted) {
+			middleware.WriteJSONError(w, http.StatusConflict, "Attempt already submitted")
+			return
+		}
+		log.Printf("Error submitting attempt: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	// Get user's rank for this quiz
+	rank, err := database.GetQuizRank(submission.QuizID, userID)
+	if err != nil {
+		log.Printf("Error getting rank: %v", err)
+	}
+
+	// Return the results
+	json.NewEncoder(w).Encode(submissionResult{Result: result, Rank: rank})
+}
+
+// shuffleForAttempt puts the options of every question in the order they
+// are shown during the attempt. Each question gets its own order derived
+// from the attempt's seed. True/false questions keep their order, as do
+// the accepted answers of free-text ones, which are never shown. Ordering
+// questions keep the correct order they are graded against; see
+// shuffledForPlayer.
+func shuffleForAttempt(quiz *database.Quiz, attempt *database.Attempt) {
+	for i := range quiz.Questions {
+		q := &quiz.Questions[i]
+		switch q.Type {
+		case database.QuestionTrueFalse, database.QuestionFreeText, database.QuestionOrdering:
+			continue
+		}
+		q.Options = services.ShuffleOptions(q.Options, attempt.Seed^int64(q.ID))
+	}
+}
+
+// shuffledForPlayer returns q as shown to the player of attempt. The
+// options of an ordering question are only shuffled here, as the order
+// they are stored in is the answer.
+func shuffledForPlayer(q *database.Question, attempt *database.Attempt) database.PlayerQuestion {
+	question := q.ForPlayer()
+	if q.Type == database.QuestionOrdering {
+		question.Options = services.ShuffleOptions(question.Options, attempt.Seed^int64(q.ID))
+	}
+	return question
+}
+
+// nextQuestionRequest is the body of /api/next-question
+type nextQuestionRequest struct {
+	AttemptID int `json:"attemptId"`
+}
+
+// servedQuestion is the question returned by /api/next-question. Question
+// is null once every question is answered or the attempt is out of time,
+// and the attempt is ready to submit. The time left is measured on the
+// server and omitted when there is no limit.
+type servedQuestion struct {
+	Question       *database.PlayerQuestion `json:"question"`
+	Number         int                      `json:"number,omitempty"`
+	Total          int                      `json:"total"`
+	TimeLeftMS     *int                     `json:"timeLeftMs,omitempty"`
+	QuizTimeLeftMS *int                     `json:"quizTimeLeftMs,omitempty"`
+}
+
+// handleNextQuestion serves the next unanswered question of the current
+// attempt and starts its clock. Asking again before answering returns the
+// same question with the time it has left.
+func handleNextQuestion(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var request nextQuestionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	attempt, err := database.GetAttempt(request.AttemptID)
+	if err != nil || attempt.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusNotFound, "Attempt not found")
+		return
+	}
+
+	quiz, err := database.GetQuizWithQuestions(strconv.Itoa(attempt.QuizID))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, "Quiz not found")
+		return
+	}
+	shuffleForAttempt(quiz, attempt)
+
+	ids := make([]int, len(quiz.Questions))
+	for i, q := range quiz.Questions {
+		ids[i] = q.ID
+	}
+	served, err := database.NextQuestion(attempt, ids)
+	if err != nil {
+		if errors.Is(err, database.ErrAttemptSubmitted) {
+			middleware.WriteJSONError(w, http.StatusConflict, "Attempt already submitted")
+			return
+		}
+		log.Printf("Error serving question: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	result := servedQuestion{Total: len(quiz.Questions)}
+	if served != nil {
+		question := shuffledForPlayer(&quiz.Questions[served.Number-1], attempt)
+		result.Question = &question
+		result.Number = served.Number
+		result.TimeLeftMS = timeLeft(served.ExpiresAt)
+	}
+	result.QuizTimeLeftMS = timeLeft(attempt.Deadline)
+	json.NewEncoder(w).Encode(result)
+}
+
+// timeLeft returns the milliseconds until t, or nil if there is no t
+func timeLeft(t *time.Time) *int {
+	if t == nil {
+		return nil
+	}
+	ms := int(time.Until(*t).Milliseconds())
+	if ms < 0 {
+		ms = 0
+	}
+	return &ms
+}
+
+// answerCheck is the body of /api/check-answer. Answer takes the form the
+// question's type needs, as in a submission; OptionID is a shorthand for
+// questions answered with a single option. Leaving both out locks the
+// question in as skipped.
+type answerCheck struct {
+	AttemptID  int             `json:"attemptId"`
+	QuestionID int             `json:"questionId"`
+	Answer     json.RawMessage `json:"answer,omitempty"`
+	OptionID   int             `json:"optionId,omitempty"`
+}
+
+// answerCheckResult reveals whether a locked-in answer was correct. Credit
+// is the share of the question's points it earned.
+type answerCheckResult struct {
+	QuestionID       int     `json:"questionId"`
+	OptionID         int     `json:"optionId"`
+	Answer           string  `json:"answer"`
+	IsCorrect        bool    `json:"isCorrect"`
+	Credit           float64 `json:"credit"`
+	CorrectOptionID  int     `json:"correctOptionId"`
+	CorrectOptionIDs []int   `json:"correctOptionIds,omitempty"`
+	CorrectAnswer    string  `json:"correctAnswer"`
+	TimedOut         bool    `json:"timedOut"`
+	// Points is what this answer earned under the attempt's scoring policy
+	// and TotalPoints what the attempt's answers have earned so far
+	Points      float64 `json:"points"`
+	TotalPoints float64 `json:"totalPoints"`
+}
+
+// handleCheckAnswer locks in the answer to a single question of the current
+// attempt and only then reveals whether it was correct and what it scored
+func handleCheckAnswer(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var request answerCheck
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	attempt, err := database.GetAttempt(request.AttemptID)
+	if err != nil || attempt.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusNotFound, "Attempt not found")
+		return
+	}
+	if attempt.SubmittedAt != nil {
+		middleware.WriteJSONError(w, http.StatusConflict, "Attempt already submitted")
+		return
+	}
+
+	quiz, err := database.GetQuizWithQuestions(strconv.Itoa(attempt.QuizID))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, "Quiz not found")
+		return
+	}
+
+	question, err := grading.FindQuestion(quiz, request.QuestionID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if len(request.Answer) == 0 && request.OptionID != 0 {
+		request.Answer = json.RawMessage(strconv.Itoa(request.OptionID))
+	}
+	response, err := grading.Check(question, request.Answer)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	answer := database.LockedAnswer{
+		QuestionID: question.ID,
+		Response:   response.Raw,
+		Answer:     response.Answer,
+		OptionID:   response.OptionID,
+		Credit:     response.Credit,
+		IsCorrect:  response.Credit >= 1,
+	}
+	locked, err := database.LockAnswer(attempt, answer)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrAnswerLocked):
+			middleware.WriteJSONError(w, http.StatusConflict, "Answer already locked in")
+		case errors.Is(err, database.ErrQuestionNotServed):
+			middleware.WriteJSONError(w, http.StatusConflict, "Question not served yet")
+		case errors.Is(err, database.ErrAttemptSubmitted):
+			middleware.WriteJSONError(w, http.StatusConflict, "Attempt already submitted")
+		default:
+			log.Printf("Error locking answer: %v", err)
+			middleware.WriteJSONError(w, http.StatusInternalServerError, "Server error")
+		}
+		return
+	}
+
+	correct := grading.Solution(question)
+	result := answerCheckResult{
+		QuestionID:       locked.QuestionID,
+		OptionID:         locked.OptionID,
+		Answer:           locked.Answer,
+		IsCorrect:        locked.IsCorrect,
+		Credit:           locked.Credit,
+		CorrectOptionID:  correct.CorrectOptionID,
+		CorrectOptionIDs: correct.CorrectOptionIDs,
+		CorrectAnswer:    correct.CorrectAnswer,
+		TimedOut:         locked.TimedOut,
+	}
+
+	answers, err := database.GetAttemptAnswers(attempt.ID)
+	if err != nil {
+		log.Printf("Error getting attempt answers: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	points, total := grading.Points(attempt, answers)
+	for i, a := range answers {
+		if a.QuestionID == locked.QuestionID {
+			result.Points = points[i]
+		}
+	}
+	result.TotalPoints = total
+	json.NewEncoder(w).Encode(result)
+}
+
+func handleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	results, err := database.GetLeaderboard()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "leaderboard.html", map[string]interface{}{
+		"Results":   results,
+		"CSRFToken": middleware.CSRFToken(r),
+	}); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// baseURL returns the external address of the app. BASE_URL overrides the
+// scheme and host seen by the server.
+func baseURL(r *http.Request) string {
+	base := os.Getenv("BASE_URL")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return strings.TrimSuffix(base, "/")
+}
+
+// oauthCallbackURL is where a provider sends the user back to after
+// authorization
+func oauthCallbackURL(r *http.Request, provider string) string {
+	return baseURL(r) + "/auth/" + provider + "/callback"
+}
+
+func handleOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	provider, err := services.GetProvider(mux.Vars(r)["provider"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	state, err := services.GenerateOAuthState()
+	if err != nil {
+		log.Printf("Failed to generate OAuth state: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	verifier, err := services.GeneratePKCEVerifier()
+	if err != nil {
+		log.Printf("Failed to generate PKCE verifier: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := provider.AuthURL(state, verifier, oauthCallbackURL(r, provider.Name()))
+	if err != nil {
+		log.Printf("Failed to build %s authorization URL: %v", provider.Name(), err)
+		http.Error(w, "Login provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// Bind the authorization request to this browser's session
+	session, _ := store.Get(r, "quiz-session")
+	session.Values["oauthProvider"] = provider.Name()
+	session.Values["oauthState"] = state
+	session.Values["oauthVerifier"] = verifier
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Session save error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
+}
+
+func handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	provider, err := services.GetProvider(mux.Vars(r)["provider"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	session, _ := store.Get(r, "quiz-session")
+	expectedProvider, _ := session.Values["oauthProvider"].(string)
+	expectedState, _ := session.Values["oauthState"].(string)
+	verifier, _ := session.Values["oauthVerifier"].(string)
+
+	// The state is single-use whatever the outcome of this callback
+	delete(session.Values, "oauthProvider")
+	delete(session.Values, "oauthState")
+	delete(session.Values, "oauthVerifier")
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Session save error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		log.Printf("%s authorization failed: %s: %s", provider.Name(), errCode, query.Get("error_description"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	state := query.Get("state")
+	if expectedState == "" || expectedProvider != provider.Name() ||
+		subtle.ConstantTimeCompare([]byte(state), []byte(expectedState)) != 1 {
+		log.Printf("%s callback with invalid state", provider.Name())
+		http.Error(w, "Invalid OAuth state", http.StatusBadRequest)
+		return
+	}
+
+	code := query.Get("code")
+	if code == "" {
+		http.Error(w, "Code not found", http.StatusBadRequest)
+		return
+	}
+
+	token, err := provider.Exchange(code, verifier, oauthCallbackURL(r, provider.Name()))
+	if err != nil {
+		log.Printf("Failed to exchange %s code: %v", provider.Name(), err)
+		http.Error(w, "Authentication failed", http.StatusBadGateway)
+		return
+	}
+
+	identity, err := provider.FetchProfile(token)
+	if err != nil {
+		log.Printf("Failed to get %s profile: %v", provider.Name(), err)
+		http.Error(w, "Authentication failed", http.StatusBadGateway)
+		return
+	}
+
+	// A logged-in user is adding another login method from the settings page
+	if userID, ok := session.Values["userID"].(int); ok {
+		if err := database.AddIdentity(userID, identity); err != nil {
+			if errors.Is(err, database.ErrIdentityLinkedElsewhere) {
+				http.Redirect(w, r, "/settings?error="+url.QueryEscape("That "+provider.DisplayName()+" account is linked to another user"), http.StatusSeeOther)
+				return
+			}
+			log.Printf("Failed to link identity: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	// Create or get user
+	user, err := database.LinkExternalIdentity(identity)
+	if errors.Is(err, database.ErrIdentityConflict) {
+		// Only the owner of the existing account may link it, by logging in
+		if err := setPendingIdentity(session, identity); err != nil {
+			log.Printf("Failed to store pending identity: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		session.Save(r, w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to process user: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	beginLogin(w, r, session, user)
+}
+
+// pendingIdentityLifetime bounds how long an external identity waits for
+// the user to log in and link it
+const pendingIdentityLifetime = 10 * time.Minute
+
+func setPendingIdentity(session *sessions.Session, identity *models.ExternalIdentity) error {
+	data, err := json.Marshal(identity)
+	if err != nil {
+		return err
+	}
+	session.Values["pendingIdentity"] = string(data)
+	session.Values["pendingIdentityAt"] = time.Now().Unix()
+	return nil
+}
+
+func pendingIdentity(session *sessions.Session) *models.ExternalIdentity {
+	data, _ := session.Values["pendingIdentity"].(string)
+	at, _ := session.Values["pendingIdentityAt"].(int64)
+	if data == "" || time.Since(time.Unix(at, 0)) > pendingIdentityLifetime {
+		return nil
+	}
+
+	var identity models.ExternalIdentity
+	if err := json.Unmarshal([]byte(data), &identity); err != nil {
+		return nil
+	}
+	return &identity
+}
+
+func clearPendingIdentity(session *sessions.Session) {
+	delete(session.Values, "pendingIdentity")
+	delete(session.Values, "pendingIdentityAt")
+}
+
+func handleSettings(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "quiz-session")
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	identities, err := database.GetUserIdentities(userID)
+	if err != nil {
+		log.Printf("Error getting identities: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	activeSessions, err := database.GetUserSessions(userID)
+	if err != nil {
+		log.Printf("Error getting sessions: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	apiTokens, err := database.GetUserAPITokens(userID)
+	if err != nil {
+		log.Printf("Error getting API tokens: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	twoFactor, err := database.HasTOTP(userID)
+	if err != nil {
+		log.Printf("Error checking two-factor authentication: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	recoveryCodes, err := database.CountRecoveryCodes(userID)
+	if err != nil {
+		log.Printf("Error counting recovery codes: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "settings.html", map[string]interface{}{
+		"Username":      user.Username,
+		"Email":         user.Email,
+		"EmailVerified": user.EmailVerified,
+		"Identities":    identities,
+		"Sessions":      activeSessions,
+		"SessionID":     session.ID,
+		"Providers":     services.Providers(),
+		"APITokens":     apiTokens,
+		"Scopes":        database.Scopes,
+		"TwoFactor":     twoFactor,
+		"RecoveryCodes": recoveryCodes,
+		"Error":         r.URL.Query().Get("error"),
+		"CSRFToken":     middleware.CSRFToken(r),
+	}); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
 }
 
-func handleLeaderboard(w http.ResponseWriter, r *http.Request) {
-	results, err := database.GetLeaderboard()
+// totpIssuer names the app in authenticator apps
+const totpIssuer = "Quiz App"
+
+// handleTOTPSetup starts enrolling an authenticator app
+func handleTOTPSetup(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	secret, err := services.GenerateTOTPSecret()
 	if err != nil {
+		log.Printf("Error generating TOTP secret: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	if err := templates.ExecuteTemplate(w, "leaderboard.html", map[string]interface{}{
-		"Results": results,
+	if err := database.StartTOTPEnrollment(userID, secret); err != nil {
+		if errors.Is(err, database.ErrTOTPEnabled) {
+			http.Redirect(w, r, "/settings?error="+url.QueryEscape("Two-factor authentication is already enabled"), http.StatusSeeOther)
+			return
+		}
+		log.Printf("Error starting TOTP enrollment: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	renderTOTPSetup(w, r, userID, "")
+}
+
+func renderTOTPSetup(w http.ResponseWriter, r *http.Request, userID int, errMsg string) {
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	totp, err := database.GetTOTP(userID)
+	if err != nil || totp == nil {
+		log.Printf("Error getting TOTP enrollment: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "totp_setup.html", map[string]interface{}{
+		"Secret":    totp.Secret,
+		"URI":       template.URL(services.TOTPProvisioningURI(totpIssuer, user.Username, totp.Secret)),
+		"Error":     errMsg,
+		"CSRFToken": middleware.CSRFToken(r),
 	}); err != nil {
 		log.Printf("Template error: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+}
+
+// handleTOTPEnable turns two-factor authentication on once the user has
+// entered a code from the newly enrolled app
+func handleTOTPEnable(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	totp, err := database.GetTOTP(userID)
+	if err != nil {
+		log.Printf("Error getting TOTP enrollment: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if totp == nil || totp.Enabled {
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	step, ok := services.VerifyTOTP(totp.Secret, r.FormValue("code"), time.Now())
+	if !ok {
+		renderTOTPSetup(w, r, userID, "That code is not valid. Check the time on your device and try again.")
+		return
+	}
+
+	if _, err := database.UseTOTPStep(userID, step); err != nil {
+		log.Printf("Error recording TOTP use: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if err := database.EnableTOTP(userID); err != nil {
+		log.Printf("Error enabling TOTP: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
+
+	log.Printf("Enabled two-factor authentication for user %d", userID)
+	renderRecoveryCodes(w, r, userID)
 }
 
-func handleGithubAuth(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, services.GetGithubAuthURL(), http.StatusTemporaryRedirect)
+// handleTOTPDisable turns two-factor authentication off. It asks for a
+// current code so a hijacked session cannot remove the second factor.
+func handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	ok, err := verifySecondFactor(userID, r.FormValue("code"))
+	if err != nil {
+		log.Printf("Error verifying two-factor code: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Redirect(w, r, "/settings?error="+url.QueryEscape("Invalid two-factor code"), http.StatusSeeOther)
+		return
+	}
+
+	if err := database.DisableTOTP(userID); err != nil {
+		log.Printf("Error disabling TOTP: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Disabled two-factor authentication for user %d", userID)
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
 }
 
-func handleGithubCallback(w http.ResponseWriter, r *http.Request) {
-	code := r.URL.Query().Get("code")
-	if code == "" {
-		http.Error(w, "Code not found", http.StatusBadRequest)
+// handleRecoveryCodes replaces the recovery codes of the user
+func handleRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	githubUser, err := services.GetGithubUser(code)
+	ok, err := verifySecondFactor(userID, r.FormValue("code"))
 	if err != nil {
-		log.Printf("Failed to get GitHub user: %v", err)
-		http.Error(w, "Authentication failed", http.StatusInternalServerError)
+		log.Printf("Error verifying two-factor code: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Redirect(w, r, "/settings?error="+url.QueryEscape("Invalid two-factor code"), http.StatusSeeOther)
 		return
 	}
 
-	// Create or get user
-	user, err := database.GetOrCreateGithubUser(githubUser)
+	renderRecoveryCodes(w, r, userID)
+}
+
+func renderRecoveryCodes(w http.ResponseWriter, r *http.Request, userID int) {
+	codes, err := database.ReplaceRecoveryCodes(userID)
 	if err != nil {
-		log.Printf("Failed to process user: %v", err)
+		log.Printf("Error generating recovery codes: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Set session
-	session, _ := store.Get(r, "quiz-session")
-	session.Values["userID"] = user.ID
-	session.Save(r, w)
+	if err := templates.ExecuteTemplate(w, "recovery_codes.html", map[string]interface{}{
+		"Codes":     codes,
+		"CSRFToken": middleware.CSRFToken(r),
+	}); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+}
 
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+// handleCreateAPIToken mints a personal API token and shows it once
+func handleCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	days, err := strconv.Atoi(r.FormValue("expires_days"))
+	if err != nil || days < 0 {
+		http.Redirect(w, r, "/settings?error="+url.QueryEscape("Choose when the token expires"), http.StatusSeeOther)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	scopes := r.Form["scopes"]
+	if name == "" || len(scopes) == 0 {
+		http.Redirect(w, r, "/settings?error="+url.QueryEscape("Give the token a name and at least one scope"), http.StatusSeeOther)
+		return
+	}
+	for _, scope := range scopes {
+		if !database.ValidScope(scope) {
+			http.Error(w, "Unknown scope", http.StatusBadRequest)
+			return
+		}
+	}
+
+	secret, err := database.CreateAPIToken(userID, name, scopes, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		log.Printf("Error creating API token: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Created API token %q for user %d", name, userID)
+	if err := templates.ExecuteTemplate(w, "api_token.html", map[string]interface{}{
+		"Name":      name,
+		"Token":     secret,
+		"CSRFToken": middleware.CSRFToken(r),
+	}); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+}
+
+func handleRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.RevokeAPIToken(userID, tokenID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error revoking API token: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Revoked API token %d of user %d", tokenID, userID)
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+func handleUnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	identityID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid identity", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.UnlinkIdentity(userID, identityID); err != nil {
+		switch {
+		case errors.Is(err, database.ErrLastLoginMethod):
+			http.Redirect(w, r, "/settings?error="+url.QueryEscape("Set a password or link another account before unlinking this one"), http.StatusSeeOther)
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, "Identity not found", http.StatusNotFound)
+		default:
+			log.Printf("Error unlinking identity: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// handleLockouts lists the accounts that are locked after too many failed
+// logins
+func handleLockouts(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := database.GetActiveLockouts()
+	if err != nil {
+		log.Printf("Error getting lockouts: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "lockouts.html", map[string]interface{}{
+		"Lockouts":  lockouts,
+		"CSRFToken": middleware.CSRFToken(r),
+	}); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func handleUnlockAccount(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := database.UnlockAccount(user.ID); err != nil {
+		log.Printf("Error unlocking account: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	loginLimiter.Reset(loginKey(user.Username))
+
+	log.Printf("Unlocked account %s", user.Username)
+	http.Redirect(w, r, "/admin/lockouts", http.StatusSeeOther)
+}
+
+// maxPastAttempts caps how many attempts the past quizzes page lists
+const maxPastAttempts = 200
+
+// pastQuiz is a quiz on the past quizzes page with the user's submitted
+// attempts at it, newest first
+type pastQuiz struct {
+	database.QuizHistory
+	PastAttempts []database.AttemptSummary
 }
 
 func handlePastQuizzes(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "quiz-session")
-	userID, ok := session.Values["userID"].(int)
+	userID, ok := middleware.UserID(r)
 	if !ok {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	pastQuizzes, err := database.GetUserQuizzes(userID)
+	history, err := database.GetUserQuizHistory(userID)
 	if err != nil {
 		log.Printf("Error getting past quizzes: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
+	attempts, _, err := database.ListUserAttempts(userID, 0, maxPastAttempts, 0)
+	if err != nil {
+		log.Printf("Error getting past attempts: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	byQuiz := make(map[int][]database.AttemptSummary)
+	for _, a := range attempts {
+		if a.Score != nil {
+			byQuiz[a.QuizID] = append(byQuiz[a.QuizID], a)
+		}
+	}
+	pastQuizzes := make([]pastQuiz, 0, len(history))
+	for _, h := range history {
+		pastQuizzes = append(pastQuizzes, pastQuiz{h, byQuiz[h.QuizID]})
+	}
 
 	if err := templates.ExecuteTemplate(w, "past-quizzes.html", map[string]interface{}{
 		"PastQuizzes": pastQuizzes,
+		"CSRFToken":   middleware.CSRFToken(r),
+	}); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleAttemptReview shows one of the user's submitted attempts question
+// by question
+func handleAttemptReview(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserID(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	attemptID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	attempt, err := database.GetAttempt(attemptID)
+	if err != nil || attempt.UserID != userID || attempt.SubmittedAt == nil {
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Error getting attempt %d: %v", attemptID, err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Attempt not found", http.StatusNotFound)
+		return
+	}
+
+	quiz, err := database.GetAttemptQuiz(attempt)
+	if err != nil {
+		log.Printf("Error getting quiz %d: %v", attempt.QuizID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	shuffleForAttempt(quiz, attempt)
+
+	answers, err := database.GetAttemptAnswers(attempt.ID)
+	if err != nil {
+		log.Printf("Error getting attempt answers: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	review := grading.Review(quiz, answers)
+	correct := 0
+	for _, q := range review {
+		if q.IsCorrect {
+			correct++
+		}
+	}
+
+	if err := templates.ExecuteTemplate(w, "attempt_review.html", map[string]interface{}{
+		"Quiz":      quiz,
+		"Attempt":   attempt,
+		"Review":    review,
+		"Correct":   correct,
+		"Answered":  len(answers),
+		"CSRFToken": middleware.CSRFToken(r),
 	}); err != nil {
 		log.Printf("Template error: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/fs"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPICoverage(t *testing.T) {
+	if err := checkOpenAPICoverage(newRouter()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOpenAPIRequestTypes checks that the request body documented for each
+// JSON route is the type its handler decodes. Handlers are wrapped in
+// middleware by the time they reach the router, so they are found in the
+// source: the route registrations name them, and each decodes into a
+// variable declared with its type.
+func TestOpenAPIRequestTypes(t *testing.T) {
+	fset := token.NewFileSet()
+	notTest := func(fi fs.FileInfo) bool { return !strings.HasSuffix(fi.Name(), "_test.go") }
+	pkgs, err := parser.ParseDir(fset, ".", notTest, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []*ast.File
+	for _, f := range pkgs["main"].Files {
+		files = append(files, f)
+	}
+	handlers := registeredHandlers(files)
+	decoded := decodedTypes(t, files)
+
+	for _, route := range routeDocs {
+		if route.Kind != jsonRoute {
+			continue
+		}
+		key := route.Method + " " + route.Path
+		handler, ok := handlers[key]
+		if !ok {
+			t.Errorf("%s: no handler registered", key)
+			continue
+		}
+		want := ""
+		if route.Request != nil {
+			want = reflect.TypeOf(route.Request).String()
+		}
+		if got := decoded[handler]; got != want {
+			t.Errorf("%s: documented request %q, but %s decodes %q", key, want, handler, got)
+		}
+	}
+}
+
+// registeredHandlers maps "METHOD /path" to the name of the handler
+// function registered for it, looking through middleware such as
+// RequireScope(scope, handler) and subrouters made with PathPrefix
+func registeredHandlers(files []*ast.File) map[string]string {
+	handlers := make(map[string]string)
+	prefixes := make(map[string]string)
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.AssignStmt:
+				// api := r.PathPrefix("/api/v1").Subrouter()
+				if len(n.Lhs) == 1 && len(n.Rhs) == 1 {
+					if name, ok := n.Lhs[0].(*ast.Ident); ok {
+						if prefix, ok := pathPrefix(n.Rhs[0]); ok {
+							prefixes[name.Name] = prefix
+						}
+					}
+				}
+			case *ast.CallExpr:
+				// router.HandleFunc(path, handler).Methods(methods...)
+				methods, ok := n.Fun.(*ast.SelectorExpr)
+				if !ok || methods.Sel.Name != "Methods" {
+					return true
+				}
+				call, ok := methods.X.(*ast.CallExpr)
+				if !ok || len(call.Args) != 2 {
+					return true
+				}
+				fun, ok := call.Fun.(*ast.SelectorExpr)
+				if !ok || fun.Sel.Name != "HandleFunc" {
+					return true
+				}
+				path, ok := stringLiteral(call.Args[0])
+				if !ok {
+					return true
+				}
+				if router, ok := fun.X.(*ast.Ident); ok {
+					path = prefixes[router.Name] + path
+				}
+				path = pathParamPattern.ReplaceAllString(path, "{$1}")
+				handler := innermostHandler(call.Args[1])
+				for _, arg := range n.Args {
+					if method, ok := stringLiteral(arg); ok {
+						handlers[method+" "+path] = handler
+					}
+				}
+			}
+			return true
+		})
+	}
+	return handlers
+}
+
+func pathPrefix(expr ast.Expr) (string, bool) {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return "", false
+	}
+	sub, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sub.Sel.Name != "Subrouter" {
+		return "", false
+	}
+	prefix, ok := sub.X.(*ast.CallExpr)
+	if !ok || len(prefix.Args) != 1 {
+		return "", false
+	}
+	if fun, ok := prefix.Fun.(*ast.SelectorExpr); !ok || fun.Sel.Name != "PathPrefix" {
+		return "", false
+	}
+	return stringLiteral(prefix.Args[0])
+}
+
+// innermostHandler returns the name of the function at the bottom of a
+// chain of middleware calls, each taking the next handler last
+func innermostHandler(expr ast.Expr) string {
+	for {
+		switch e := expr.(type) {
+		case *ast.Ident:
+			return e.Name
+		case *ast.CallExpr:
+			if len(e.Args) == 0 {
+				return ""
+			}
+			expr = e.Args[len(e.Args)-1]
+		default:
+			return ""
+		}
+	}
+}
+
+// decodedTypes maps the name of each function that decodes a JSON body to
+// the type it decodes into, written as reflect would, e.g. main.quizUpdate
+func decodedTypes(t *testing.T, files []*ast.File) map[string]string {
+	decoded := make(map[string]string)
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil {
+				continue
+			}
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				var target ast.Expr
+				switch fun := call.Fun.(type) {
+				case *ast.Ident:
+					// decodeJSON(w, r, &v)
+					if fun.Name == "decodeJSON" && len(call.Args) == 3 {
+						target = call.Args[2]
+					}
+				case *ast.SelectorExpr:
+					// json.NewDecoder(r.Body).Decode(&v)
+					if fun.Sel.Name == "Decode" && len(call.Args) == 1 {
+						target = call.Args[0]
+					}
+				}
+				// decodeJSON itself passes on the pointer it was given
+				if addr, ok := target.(*ast.UnaryExpr); !ok || addr.Op != token.AND {
+					return true
+				}
+				typ := declaredType(target)
+				if typ == nil {
+					t.Errorf("%s: cannot tell what type %s decodes into", fn.Name.Name, types.ExprString(target))
+					return true
+				}
+				name := types.ExprString(typ)
+				if !strings.Contains(name, ".") {
+					name = "main." + name
+				}
+				decoded[fn.Name.Name] = name
+				return true
+			})
+		}
+	}
+	return decoded
+}
+
+// declaredType returns the type v was declared with, for &v where v is
+// declared as var v T
+func declaredType(expr ast.Expr) ast.Expr {
+	ident, ok := expr.(*ast.UnaryExpr).X.(*ast.Ident)
+	if !ok || ident.Obj == nil {
+		return nil
+	}
+	spec, ok := ident.Obj.Decl.(*ast.ValueSpec)
+	if !ok || spec.Type == nil {
+		return nil
+	}
+	if _, anonymous := spec.Type.(*ast.StructType); anonymous {
+		return nil
+	}
+	return spec.Type
+}
+
+func stringLiteral(expr ast.Expr) (string, bool) {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	s, err := strconv.Unquote(lit.Value)
+	return s, err == nil
+}
@@ -1,31 +1,128 @@
 package middleware
 
 import (
+	"context"
+	"errors"
+	"log"
 	"net/http"
+	"strings"
+
+	"quizapp/database"
 
 	"github.com/gorilla/sessions"
 )
 
-var store *sessions.CookieStore
+var store sessions.Store
 
-func SetStore(s *sessions.CookieStore) {
+func SetStore(s sessions.Store) {
 	store = s
 }
 
+type userContextKey struct{}
+
+// UserID returns the user a request was authenticated as by RequireAuth,
+// RequireScope or RequireRole
+func UserID(r *http.Request) (int, bool) {
+	userID, ok := r.Context().Value(userContextKey{}).(int)
+	return userID, ok && userID != 0
+}
+
+// bearerToken returns the API token sent in the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// RequireAuth allows the request through only for users logged in with the
+// session cookie
 func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return authenticate("", next)
+}
+
+// RequireScope allows the request through for users logged in with the
+// session cookie, and for API tokens that were granted scope
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return authenticate(scope, next)
+}
+
+func authenticate(scope string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// A request that carries a token is authenticated by it alone, so a
+		// cookie sent along by a browser never adds to its permissions
+		if secret, ok := bearerToken(r); ok {
+			if scope == "" {
+				fail(w, r, http.StatusForbidden, "API tokens cannot be used for this route")
+				return
+			}
+
+			token, err := database.AuthenticateAPIToken(secret)
+			if err != nil {
+				if !errors.Is(err, database.ErrInvalidAPIToken) {
+					log.Printf("API token error: %v", err)
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				fail(w, r, http.StatusUnauthorized, "Invalid or expired API token")
+				return
+			}
+			if !token.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+				fail(w, r, http.StatusForbidden, "API token is missing the "+scope+" scope")
+				return
+			}
+
+			next(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, token.UserID)))
+			return
+		}
+
 		session, err := store.Get(r, "quiz-session")
 		if err != nil {
-			http.Error(w, "Session error", http.StatusInternalServerError)
+			fail(w, r, http.StatusInternalServerError, "Session error")
 			return
 		}
 
 		userID, ok := session.Values["userID"].(int)
 		if !ok || userID == 0 {
+			if IsAPIRequest(r) {
+				WriteJSONError(w, http.StatusUnauthorized, "Log in or send an API token")
+				return
+			}
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
 
+		next(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, userID)))
+	}
+}
+
+// RequireRole allows the request through only for logged-in users that
+// have at least the given role. Inside RequireScope it checks the user the
+// token belongs to.
+func RequireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	check := func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserID(r)
+		user, err := database.GetUserByID(userID)
+		if err != nil {
+			log.Printf("Error getting user: %v", err)
+			fail(w, r, http.StatusInternalServerError, "Server error")
+			return
+		}
+
+		if !user.HasRole(role) {
+			fail(w, r, http.StatusForbidden, "Forbidden")
+			return
+		}
+
 		next(w, r)
 	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := UserID(r); ok {
+			check(w, r)
+			return
+		}
+		RequireAuth(check)(w, r)
+	}
 }
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// CSRFHeader carries the token on fetch requests
+	CSRFHeader = "X-CSRF-Token"
+	// CSRFField carries the token on form posts
+	CSRFField = "csrf_token"
+)
+
+type csrfContextKey struct{}
+
+// csrfState holds the session of a request so its token can be issued
+// when a page first asks for it
+type csrfState struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	session *sessions.Session
+	token   string
+}
+
+// issue returns the session's token, creating and saving one if it has
+// none yet. It must be called before the response body is written.
+func (s *csrfState) issue() string {
+	if s.token != "" {
+		return s.token
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Failed to generate CSRF token: %v", err)
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	s.session.Values["csrfToken"] = token
+	if err := s.session.Save(s.r, s.w); err != nil {
+		log.Printf("Session save error: %v", err)
+		return ""
+	}
+	s.token = token
+	return token
+}
+
+// CSRFProtect rejects state-changing requests that do not echo the
+// session's token back in the X-CSRF-Token header or the csrf_token form
+// field. Tokens are only issued when a page embeds one, so requests that
+// never render a form do not create sessions. Requests authenticated with
+// an API token are exempt, as browsers never attach one on their own, and
+// so are static files.
+func CSRFProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearerToken(r); ok || strings.HasPrefix(r.URL.Path, "/static/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session, err := store.Get(r, "quiz-session")
+		if err != nil {
+			// An unreadable cookie (e.g. after a key change) starts a fresh session
+			log.Printf("Session error: %v", err)
+		}
+		token, _ := session.Values["csrfToken"].(string)
+
+		if !isSafeMethod(r.Method) {
+			sent := r.Header.Get(CSRFHeader)
+			if sent == "" {
+				sent = r.PostFormValue(CSRFField)
+			}
+			if token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				log.Printf("CSRF check failed: %s %s", r.Method, r.URL.Path)
+				fail(w, r, http.StatusForbidden, "Forbidden: missing or invalid CSRF token. Reload the page and try again.")
+				return
+			}
+		}
+
+		state := &csrfState{w: w, session: session, token: token}
+		r = r.WithContext(context.WithValue(r.Context(), csrfContextKey{}, state))
+		state.r = r
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CSRFToken returns the token to embed in pages rendered for r, issuing
+// one to the session if needed. Call it before writing the response body.
+func CSRFToken(r *http.Request) string {
+	state, ok := r.Context().Value(csrfContextKey{}).(*csrfState)
+	if !ok {
+		return ""
+	}
+	return state.issue()
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
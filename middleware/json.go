@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ErrorBody is the envelope every JSON API error is returned in
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// IsAPIRequest reports whether r is for one of the JSON endpoints
+func IsAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// WriteJSON writes v as a JSON response with the given status
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// WriteJSONError writes an error envelope. The code is derived from the
+// status, e.g. "not_found" for 404.
+func WriteJSONError(w http.ResponseWriter, status int, message string) {
+	code := strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	WriteJSON(w, status, ErrorBody{Error: ErrorDetail{Code: code, Message: message}})
+}
+
+// fail reports an error as JSON for API requests and as plain text for
+// pages
+func fail(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if IsAPIRequest(r) {
+		WriteJSONError(w, status, message)
+		return
+	}
+	http.Error(w, message, status)
+}
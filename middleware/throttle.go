@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock abstracts time.Now so the limiter can be driven by a fake clock
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock backed by the wall clock
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// LoginLimiter tracks failed login attempts per key (username, client IP)
+type LoginLimiter interface {
+	// Delay returns how long the caller has to wait before the next attempt
+	// for key is accepted, or zero if it may proceed now
+	Delay(key string) time.Duration
+	// Fail records a failed attempt and returns the number of failures for
+	// key inside the current window
+	Fail(key string) int
+	// Reset forgets all failures recorded for key
+	Reset(key string)
+}
+
+// SlidingWindowLimiter counts failures inside a sliding window. The first
+// FreeAttempts failures cost nothing; every failure after that doubles the
+// delay before the next attempt, starting at BaseDelay and capped at
+// MaxDelay.
+type SlidingWindowLimiter struct {
+	Window       time.Duration
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Clock        Clock
+
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	lastSweep time.Time
+}
+
+// NewLoginLimiter returns a SlidingWindowLimiter with the defaults used for
+// the login form
+func NewLoginLimiter(clock Clock) *SlidingWindowLimiter {
+	return &SlidingWindowLimiter{
+		Window:       15 * time.Minute,
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		Clock:        clock,
+		failures:     make(map[string][]time.Time),
+	}
+}
+
+func (l *SlidingWindowLimiter) Delay(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.Clock.Now()
+	failures := l.recent(key, now)
+	extra := len(failures) - l.FreeAttempts
+	if extra <= 0 {
+		return 0
+	}
+
+	delay := l.BaseDelay
+	for i := 1; i < extra && delay < l.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+
+	wait := failures[len(failures)-1].Add(delay).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+func (l *SlidingWindowLimiter) Fail(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.failures == nil {
+		l.failures = make(map[string][]time.Time)
+	}
+	now := l.Clock.Now()
+	l.sweep(now)
+	failures := append(l.recent(key, now), now)
+	l.failures[key] = failures
+	return len(failures)
+}
+
+func (l *SlidingWindowLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+}
+
+// recent drops the failures of key that fell out of the window and returns
+// the rest. The caller must hold l.mu.
+func (l *SlidingWindowLimiter) recent(key string, now time.Time) []time.Time {
+	failures := l.failures[key]
+	cutoff := now.Add(-l.Window)
+	i := 0
+	for i < len(failures) && !failures[i].After(cutoff) {
+		i++
+	}
+	if i == len(failures) {
+		delete(l.failures, key)
+		return nil
+	}
+	failures = failures[i:]
+	l.failures[key] = failures
+	return failures
+}
+
+// sweep forgets keys that have not failed for a whole window so the map
+// does not grow without bound. The caller must hold l.mu.
+func (l *SlidingWindowLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.Window {
+		return
+	}
+	l.lastSweep = now
+	for key := range l.failures {
+		l.recent(key, now)
+	}
+}
@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestLimiter() (*SlidingWindowLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	return NewLoginLimiter(clock), clock
+}
+
+func TestLimiterDelayGrows(t *testing.T) {
+	l, clock := newTestLimiter()
+
+	for i := 1; i <= l.FreeAttempts; i++ {
+		if n := l.Fail("alice"); n != i {
+			t.Fatalf("Fail returned %d, want %d", n, i)
+		}
+		if d := l.Delay("alice"); d != 0 {
+			t.Fatalf("free attempt %d is delayed by %v", i, d)
+		}
+	}
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		l.Fail("alice")
+		if d := l.Delay("alice"); d != want {
+			t.Fatalf("delay is %v, want %v", d, want)
+		}
+	}
+
+	clock.advance(3 * time.Second)
+	if d := l.Delay("alice"); d != 5*time.Second {
+		t.Errorf("delay after waiting 3s is %v, want 5s", d)
+	}
+	if d := l.Delay("bob"); d != 0 {
+		t.Errorf("another key is delayed by %v", d)
+	}
+
+	for i := 0; i < 20; i++ {
+		l.Fail("alice")
+	}
+	if d := l.Delay("alice"); d != l.MaxDelay {
+		t.Errorf("delay is %v, want it capped at %v", d, l.MaxDelay)
+	}
+}
+
+func TestLimiterWindowSlides(t *testing.T) {
+	l, clock := newTestLimiter()
+
+	for i := 0; i < 5; i++ {
+		l.Fail("alice")
+		clock.advance(time.Minute)
+	}
+	if d := l.Delay("alice"); d != 0 {
+		t.Fatalf("delay is %v after waiting it out", d)
+	}
+
+	// The first failures fall out of the window one minute apart
+	clock.advance(l.Window - 5*time.Minute)
+	if n := l.Fail("alice"); n != 5 {
+		t.Errorf("Fail counted %d failures inside the window, want 5", n)
+	}
+	clock.advance(l.Window)
+	if n := l.Fail("alice"); n != 1 {
+		t.Errorf("Fail counted %d failures after the window passed, want 1", n)
+	}
+}
+
+func TestLimiterReset(t *testing.T) {
+	l, _ := newTestLimiter()
+
+	for i := 0; i < 5; i++ {
+		l.Fail("alice")
+		l.Fail("bob")
+	}
+	l.Reset("alice")
+	if d := l.Delay("alice"); d != 0 {
+		t.Errorf("delay is %v after Reset", d)
+	}
+	if n := l.Fail("alice"); n != 1 {
+		t.Errorf("Fail counted %d failures after Reset, want 1", n)
+	}
+	if d := l.Delay("bob"); d == 0 {
+		t.Error("Reset cleared another key")
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	l, clock := newTestLimiter()
+
+	l.Fail("alice")
+	clock.advance(l.Window / 2)
+	l.Fail("bob")
+	clock.advance(l.Window/2 + time.Second)
+
+	// Failing for a new key sweeps alice, idle for a whole window, but
+	// keeps bob
+	l.Fail("carol")
+	if _, ok := l.failures["alice"]; ok {
+		t.Error("idle key was not swept")
+	}
+	if _, ok := l.failures["bob"]; !ok {
+		t.Error("key with a recent failure was swept")
+	}
+	if len(l.failures) != 2 {
+		t.Errorf("limiter tracks %d keys, want 2", len(l.failures))
+	}
+}
@@ -7,3 +7,14 @@ type GithubUser struct {
 	Email     string `json:"email"`
 	AvatarURL string `json:"avatar_url"`
 }
+
+// ExternalIdentity is a user profile returned by an external identity
+// provider. Subject is the provider's stable ID for the user.
+type ExternalIdentity struct {
+	Provider  string `json:"provider"`
+	Subject   string `json:"subject"`
+	Username  string `json:"username"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	AvatarURL string `json:"avatar_url"`
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"quizapp/database"
+	"quizapp/middleware"
+	"quizapp/services"
+
+	"github.com/gorilla/mux"
+)
+
+// Authentication a documented route accepts besides a token scope
+const (
+	authPublic  = ""
+	authSession = "session"
+)
+
+type routeKind int
+
+const (
+	// jsonRoute takes and returns JSON. Under /api/v1 the response is
+	// wrapped in a data envelope.
+	jsonRoute routeKind = iota
+	// pageRoute renders an HTML page
+	pageRoute
+	// formRoute takes a form post and renders a page or redirects
+	formRoute
+	// redirectRoute sends the browser elsewhere
+	redirectRoute
+	// fileRoute serves static files
+	fileRoute
+)
+
+// routeDoc describes one method on one path of the router
+type routeDoc struct {
+	Method  string
+	Path    string
+	Summary string
+	Tag     string
+	// Auth is authPublic, authSession or the token scope the route requires
+	Auth     string
+	Kind     routeKind
+	Query    []string
+	Request  interface{}
+	Response interface{}
+	// List marks paginated /api/v1 responses
+	List   bool
+	Status int
+}
+
+// oneOf documents a response that takes one of several shapes
+type oneOf []interface{}
+
+// queryParamTypes are the schema types of the query parameters routes take
+var queryParamTypes = map[string]string{
+	"page":       "integer",
+	"per_page":   "integer",
+	"quiz_id":    "integer",
+	"created_by": "integer",
+	"q":          "string",
+	"token":      "string",
+	"notice":     "string",
+	"error":      "string",
+}
+
+// routeDocs documents every route registered by newRouter. Tests fail when
+// the two disagree, see checkOpenAPICoverage.
+var routeDocs = []routeDoc{
+	{Method: "GET", Path: "/static/{path}", Summary: "Static assets", Tag: "Pages", Kind: fileRoute},
+
+	{Method: "GET", Path: "/register", Summary: "Registration form", Tag: "Account", Kind: pageRoute, Query: []string{"error"}},
+	{Method: "POST", Path: "/register", Summary: "Create an account", Tag: "Account", Kind: formRoute},
+	{Method: "GET", Path: "/login", Summary: "Login form", Tag: "Account", Kind: pageRoute, Query: []string{"error", "notice"}},
+	{Method: "POST", Path: "/login", Summary: "Log in with a username and password", Tag: "Account", Kind: formRoute},
+	{Method: "GET", Path: "/login/2fa", Summary: "Second factor form", Tag: "Account", Kind: pageRoute},
+	{Method: "POST", Path: "/login/2fa", Summary: "Finish logging in with a TOTP or recovery code", Tag: "Account", Kind: formRoute},
+	{Method: "POST", Path: "/logout", Summary: "Log out", Tag: "Account", Kind: formRoute},
+	{Method: "GET", Path: "/forgot-password", Summary: "Password reset request form", Tag: "Account", Kind: pageRoute},
+	{Method: "POST", Path: "/forgot-password", Summary: "Email a password reset link", Tag: "Account", Kind: formRoute},
+	{Method: "GET", Path: "/reset-password", Summary: "Password reset form", Tag: "Account", Kind: pageRoute, Query: []string{"token"}},
+	{Method: "POST", Path: "/reset-password", Summary: "Set a new password", Tag: "Account", Kind: formRoute},
+	{Method: "GET", Path: "/verify-email", Summary: "Verify an email address", Tag: "Account", Kind: redirectRoute, Query: []string{"token"}},
+	{Method: "GET", Path: "/auth/{provider}", Summary: "Log in with an external provider", Tag: "Account", Kind: redirectRoute},
+	{Method: "GET", Path: "/auth/{provider}/callback", Summary: "External provider callback", Tag: "Account", Kind: redirectRoute},
+
+	{Method: "GET", Path: "/", Summary: "Home page", Tag: "Pages", Auth: authSession, Kind: pageRoute},
+	{Method: "GET", Path: "/quiz/{id}", Summary: "Take a quiz", Tag: "Pages", Auth: database.ScopePlay, Kind: pageRoute},
+	{Method: "GET", Path: "/leaderboard", Summary: "Leaderboard", Tag: "Pages", Auth: database.ScopeRead, Kind: pageRoute},
+	{Method: "GET", Path: "/past-quizzes", Summary: "Quizzes the user has taken", Tag: "Pages", Auth: database.ScopeRead, Kind: pageRoute},
+	{Method: "GET", Path: "/past-quizzes/attempts/{id}", Summary: "Review a past attempt question by question", Tag: "Pages", Auth: database.ScopeRead, Kind: pageRoute},
+	{Method: "GET", Path: "/admin/create-quiz", Summary: "Quiz creation form", Tag: "Admin", Auth: database.ScopeWrite, Kind: pageRoute},
+	{Method: "POST", Path: "/admin/create-quiz", Summary: "Create a quiz from Open Trivia DB questions", Tag: "Admin", Auth: database.ScopeWrite, Request: generatedQuizRequest{}, Response: generatedQuiz{}},
+	{Method: "GET", Path: "/admin/quizzes", Summary: "Quizzes the user can edit", Tag: "Admin", Auth: authSession, Kind: pageRoute, Query: []string{"error"}},
+	{Method: "POST", Path: "/admin/quizzes", Summary: "Start a draft quiz", Tag: "Admin", Auth: authSession, Kind: formRoute},
+	{Method: "GET", Path: "/admin/quizzes/{id}/edit", Summary: "Quiz editor", Tag: "Admin", Auth: authSession, Kind: pageRoute, Query: []string{"error"}},
+	{Method: "POST", Path: "/admin/quizzes/{id}", Summary: "Rename a quiz", Tag: "Admin", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/admin/quizzes/{id}/status", Summary: "Publish a quiz or move it back to draft", Tag: "Admin", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/admin/quizzes/{id}/time-limits", Summary: "Set the time limits of a quiz", Tag: "Admin", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/admin/quizzes/{id}/scoring", Summary: "Set how a quiz is scored", Tag: "Admin", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/admin/quizzes/{id}/delete", Summary: "Delete a quiz", Tag: "Admin", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/admin/quizzes/{id}/questions", Summary: "Add a question", Tag: "Admin", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/admin/quizzes/{id}/questions/{questionId}", Summary: "Edit a question", Tag: "Admin", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/admin/quizzes/{id}/questions/{questionId}/delete", Summary: "Delete a question", Tag: "Admin", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/admin/quizzes/{id}/questions/{questionId}/move", Summary: "Move a question up or down", Tag: "Admin", Auth: authSession, Kind: formRoute},
+	{Method: "GET", Path: "/admin/lockouts", Summary: "Locked accounts", Tag: "Admin", Auth: authSession, Kind: pageRoute},
+	{Method: "POST", Path: "/admin/lockouts/{id}/unlock", Summary: "Unlock an account", Tag: "Admin", Auth: authSession, Kind: formRoute},
+
+	{Method: "GET", Path: "/settings", Summary: "Account settings", Tag: "Settings", Auth: authSession, Kind: pageRoute, Query: []string{"error"}},
+	{Method: "POST", Path: "/settings/identities/{id}/unlink", Summary: "Unlink an external identity", Tag: "Settings", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/settings/sessions/revoke", Summary: "Log out every session, including this one", Tag: "Settings", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/settings/verify-email", Summary: "Resend the verification email", Tag: "Settings", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/settings/tokens", Summary: "Create an API token", Tag: "Settings", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/settings/tokens/{id}/revoke", Summary: "Revoke an API token", Tag: "Settings", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/settings/2fa/setup", Summary: "Start two-factor enrollment", Tag: "Settings", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/settings/2fa/enable", Summary: "Confirm two-factor enrollment", Tag: "Settings", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/settings/2fa/disable", Summary: "Turn off two-factor authentication", Tag: "Settings", Auth: authSession, Kind: formRoute},
+	{Method: "POST", Path: "/settings/2fa/recovery-codes", Summary: "Replace the recovery codes", Tag: "Settings", Auth: authSession, Kind: formRoute},
+
+	{Method: "POST", Path: "/api/submit-quiz", Summary: "Submit and grade an attempt", Tag: "Play", Auth: database.ScopePlay, Request: quizSubmission{}, Response: submissionResult{}},
+	{Method: "POST", Path: "/api/next-question", Summary: "Serve the next question of an attempt", Tag: "Play", Auth: database.ScopePlay, Request: nextQuestionRequest{}, Response: servedQuestion{}},
+	{Method: "POST", Path: "/api/check-answer", Summary: "Lock in the answer to one question", Tag: "Play", Auth: database.ScopePlay, Request: answerCheck{}, Response: answerCheckResult{}},
+	{Method: "GET", Path: "/api/openapi.json", Summary: "This document", Tag: "Meta", Response: services.OpenAPIDocument{}},
+
+	{Method: "GET", Path: "/api/v1/me", Summary: "The current user", Tag: "Users", Auth: database.ScopeRead, Response: database.User{}},
+	{Method: "GET", Path: "/api/v1/quizzes", Summary: "List quizzes", Tag: "Quizzes", Auth: database.ScopeRead, Query: []string{"page", "per_page", "q", "created_by"}, Response: database.QuizSummary{}, List: true},
+	{Method: "POST", Path: "/api/v1/quizzes", Summary: "Create a quiz, as a draft unless status is published", Tag: "Quizzes", Auth: database.ScopeWrite, Request: quizInput{}, Response: database.Quiz{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/v1/quizzes/{id}", Summary: "Get a quiz; questions are only included for its author and admins", Tag: "Quizzes", Auth: database.ScopeRead, Response: oneOf{database.Quiz{}, database.QuizSummary{}}},
+	{Method: "PUT", Path: "/api/v1/quizzes/{id}", Summary: "Change the title, status, time limits or scoring policy of a quiz", Tag: "Quizzes", Auth: database.ScopeWrite, Request: quizUpdate{}, Response: database.Quiz{}},
+	{Method: "DELETE", Path: "/api/v1/quizzes/{id}", Summary: "Delete a quiz with its questions and results", Tag: "Quizzes", Auth: database.ScopeWrite, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/quizzes/{id}/questions", Summary: "List the questions of a quiz", Tag: "Questions", Auth: database.ScopeRead, Response: []database.Question{}},
+	{Method: "POST", Path: "/api/v1/quizzes/{id}/questions", Summary: "Add a question", Tag: "Questions", Auth: database.ScopeWrite, Request: database.Question{}, Response: database.Question{}, Status: http.StatusCreated},
+	{Method: "PUT", Path: "/api/v1/quizzes/{id}/questions/order", Summary: "Reorder the questions of a quiz", Tag: "Questions", Auth: database.ScopeWrite, Request: questionOrder{}, Response: []database.Question{}},
+	{Method: "GET", Path: "/api/v1/quizzes/{id}/questions/{questionId}", Summary: "Get a question", Tag: "Questions", Auth: database.ScopeRead, Response: database.Question{}},
+	{Method: "PUT", Path: "/api/v1/quizzes/{id}/questions/{questionId}", Summary: "Replace a question", Tag: "Questions", Auth: database.ScopeWrite, Request: database.Question{}, Response: database.Question{}},
+	{Method: "DELETE", Path: "/api/v1/quizzes/{id}/questions/{questionId}", Summary: "Delete a question", Tag: "Questions", Auth: database.ScopeWrite, Status: http.StatusNoContent},
+	{Method: "POST", Path: "/api/v1/quizzes/{id}/attempts", Summary: "Start an attempt", Tag: "Play", Auth: database.ScopePlay, Response: database.PlayerQuiz{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/v1/attempts", Summary: "List the user's attempts", Tag: "Play", Auth: database.ScopeRead, Query: []string{"page", "per_page", "quiz_id"}, Response: database.AttemptSummary{}, List: true},
+	{Method: "GET", Path: "/api/v1/attempts/{id}", Summary: "Get one of the user's attempts", Tag: "Play", Auth: database.ScopeRead, Response: attemptDetail{}},
+	{Method: "GET", Path: "/api/v1/results", Summary: "The user's best score on every quiz", Tag: "Results", Auth: database.ScopeRead, Query: []string{"page", "per_page", "quiz_id"}, Response: database.QuizWithScore{}, List: true},
+	{Method: "GET", Path: "/api/v1/leaderboard", Summary: "Top scores", Tag: "Results", Auth: database.ScopeRead, Query: []string{"page", "per_page", "quiz_id"}, Response: database.LeaderboardEntry{}, List: true},
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	middleware.WriteJSON(w, http.StatusOK, buildOpenAPIDocument())
+}
+
+// buildOpenAPIDocument turns routeDocs into an OpenAPI 3 document
+func buildOpenAPIDocument() *services.OpenAPIDocument {
+	schemas := services.NewSchemaRegistry()
+	doc := &services.OpenAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: services.OpenAPIInfo{
+			Title:       "Quiz App",
+			Version:     "1",
+			Description: "Routes under /api/v1 take a session cookie or an API token with the scope named in x-required-scope.",
+		},
+		Paths: make(map[string]map[string]*services.OpenAPIOperation),
+		Components: services.OpenAPIComponents{
+			SecuritySchemes: map[string]services.OpenAPISecurityScheme{
+				"session": {Type: "apiKey", In: "cookie", Name: "quiz-session"},
+				"bearer":  {Type: "http", Scheme: "bearer", Description: "Personal API token (qz_...)"},
+			},
+		},
+	}
+
+	for _, route := range routeDocs {
+		if doc.Paths[route.Path] == nil {
+			doc.Paths[route.Path] = make(map[string]*services.OpenAPIOperation)
+		}
+		doc.Paths[route.Path][strings.ToLower(route.Method)] = buildOperation(route, schemas)
+	}
+
+	doc.Components.Schemas = schemas.Schemas
+	return doc
+}
+
+func buildOperation(route routeDoc, schemas *services.SchemaRegistry) *services.OpenAPIOperation {
+	op := &services.OpenAPIOperation{
+		Summary:   route.Summary,
+		Tags:      []string{route.Tag},
+		Responses: make(map[string]*services.OpenAPIResponse),
+	}
+
+	for _, name := range pathParams(route.Path) {
+		schemaType := "string"
+		if strings.HasSuffix(strings.ToLower(name), "id") {
+			schemaType = "integer"
+		}
+		op.Parameters = append(op.Parameters, services.OpenAPIParameter{
+			Name: name, In: "path", Required: true, Schema: &services.Schema{Type: schemaType},
+		})
+	}
+	for _, name := range route.Query {
+		schemaType := queryParamTypes[name]
+		if schemaType == "" {
+			schemaType = "string"
+		}
+		op.Parameters = append(op.Parameters, services.OpenAPIParameter{
+			Name: name, In: "query", Schema: &services.Schema{Type: schemaType},
+		})
+	}
+
+	switch route.Auth {
+	case authPublic:
+	case authSession:
+		op.Security = []map[string][]string{{"session": {}}}
+	default:
+		op.Security = []map[string][]string{{"session": {}}, {"bearer": {}}}
+		op.Scope = route.Auth
+	}
+
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := &services.OpenAPIResponse{Description: http.StatusText(status)}
+	op.Responses[fmt.Sprint(status)] = success
+
+	switch route.Kind {
+	case jsonRoute:
+		if route.Request != nil {
+			op.RequestBody = &services.OpenAPIRequestBody{
+				Required: true,
+				Content:  jsonContent(schemas.SchemaFor(route.Request)),
+			}
+		}
+		if route.Response != nil {
+			success.Content = jsonContent(responseSchema(route, schemas))
+		}
+		if strings.HasPrefix(route.Path, "/api/v1/") {
+			op.Responses["default"] = &services.OpenAPIResponse{
+				Description: "Error",
+				Content:     jsonContent(schemas.SchemaFor(middleware.ErrorBody{})),
+			}
+		}
+	case pageRoute:
+		success.Content = map[string]services.OpenAPIMediaType{"text/html": {}}
+	case formRoute:
+		op.RequestBody = &services.OpenAPIRequestBody{
+			Required: true,
+			Content:  map[string]services.OpenAPIMediaType{"application/x-www-form-urlencoded": {}},
+		}
+		success.Content = map[string]services.OpenAPIMediaType{"text/html": {}}
+		op.Responses["303"] = &services.OpenAPIResponse{Description: "Redirect when the form was accepted"}
+	case redirectRoute:
+		delete(op.Responses, fmt.Sprint(status))
+		op.Responses["302"] = &services.OpenAPIResponse{Description: "Redirect"}
+	case fileRoute:
+		success.Content = map[string]services.OpenAPIMediaType{"*/*": {}}
+	}
+	return op
+}
+
+// responseSchema wraps the response of /api/v1 routes in their envelope
+func responseSchema(route routeDoc, schemas *services.SchemaRegistry) *services.Schema {
+	var schema *services.Schema
+	if choices, ok := route.Response.(oneOf); ok {
+		schema = &services.Schema{}
+		for _, choice := range choices {
+			schema.OneOf = append(schema.OneOf, schemas.SchemaFor(choice))
+		}
+	} else {
+		schema = schemas.SchemaFor(route.Response)
+	}
+
+	if !strings.HasPrefix(route.Path, "/api/v1/") {
+		return schema
+	}
+	if route.List {
+		return &services.Schema{
+			Type: "object",
+			Properties: map[string]*services.Schema{
+				"data":       {Type: "array", Items: schema},
+				"pagination": schemas.SchemaFor(pagination{}),
+			},
+			Required: []string{"data", "pagination"},
+		}
+	}
+	return &services.Schema{
+		Type:       "object",
+		Properties: map[string]*services.Schema{"data": schema},
+		Required:   []string{"data"},
+	}
+}
+
+func jsonContent(schema *services.Schema) map[string]services.OpenAPIMediaType {
+	return map[string]services.OpenAPIMediaType{"application/json": {Schema: schema}}
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+func pathParams(path string) []string {
+	var names []string
+	for _, m := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+// checkOpenAPICoverage compares the routes registered on r with routeDocs
+// and lists every route that is missing from either
+func checkOpenAPICoverage(r *mux.Router) error {
+	registered := make(map[string]bool)
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		path = pathParamPattern.ReplaceAllString(path, "{$1}")
+		if pattern, err := route.GetPathRegexp(); err == nil && !strings.HasSuffix(pattern, "$") {
+			path += "{path}"
+		}
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Routes that match any method are documented as GET
+			methods = []string{"GET"}
+		}
+		for _, method := range methods {
+			registered[method+" "+path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk routes: %v", err)
+	}
+
+	documented := make(map[string]bool)
+	for _, route := range routeDocs {
+		documented[route.Method+" "+route.Path] = true
+	}
+
+	var problems []string
+	for route := range registered {
+		if !documented[route] {
+			problems = append(problems, "undocumented route "+route)
+		}
+	}
+	for route := range documented {
+		if !registered[route] {
+			problems = append(problems, "documented route is not registered: "+route)
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("OpenAPI document is out of date:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
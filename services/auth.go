@@ -1,63 +1,180 @@
 package services
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"quizapp/models"
 )
 
-const githubAuthURL = "https://github.com/login/oauth/authorize"
-const githubTokenURL = "https://github.com/login/oauth/access_token"
-const githubUserURL = "https://api.github.com/user"
-
-func GetGithubAuthURL() string {
-	return fmt.Sprintf("%s?client_id=%s&scope=user:email",
-		githubAuthURL,
-		os.Getenv("GITHUB_CLIENT_ID"),
-	)
-}
-
-func GetGithubUser(code string) (*models.GithubUser, error) {
-	// Exchange code for access token
-	tokenReq, _ := http.NewRequest("POST", githubTokenURL, nil)
-	q := tokenReq.URL.Query()
-	q.Add("client_id", os.Getenv("GITHUB_CLIENT_ID"))
-	q.Add("client_secret", os.Getenv("GITHUB_CLIENT_SECRET"))
-	q.Add("code", code)
-	tokenReq.URL.RawQuery = q.Encode()
-	tokenReq.Header.Add("Accept", "application/json")
+// Default GitHub endpoints. GITHUB_BASE_URL and GITHUB_API_URL override them,
+// e.g. to run the login flow against a local fake GitHub server.
+const (
+	defaultGithubBaseURL = "https://github.com"
+	defaultGithubAPIURL  = "https://api.github.com"
+)
 
-	tokenResp, err := http.DefaultClient.Do(tokenReq)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get token: %v", err)
+var oauthClient = &http.Client{Timeout: 10 * time.Second}
+
+// GenerateOAuthState returns a random value used to bind an authorization
+// request to the session that started it
+func GenerateOAuthState() (string, error) {
+	return randomToken(32)
+}
+
+// GeneratePKCEVerifier returns a random PKCE code verifier (RFC 7636)
+func GeneratePKCEVerifier() (string, error) {
+	return randomToken(32)
+}
+
+// PKCEChallenge derives the S256 code challenge for a verifier
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random token: %v", err)
 	}
-	defer tokenResp.Body.Close()
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
 
-	var tokenData struct {
-		AccessToken string `json:"access_token"`
+// GithubProvider logs users in with a GitHub OAuth app
+type GithubProvider struct {
+	ClientID     string
+	ClientSecret string
+	BaseURL      string
+	APIURL       string
+}
+
+// NewGithubProvider configures GitHub login from the environment
+func NewGithubProvider() *GithubProvider {
+	p := &GithubProvider{
+		ClientID:     os.Getenv("GITHUB_CLIENT_ID"),
+		ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
+		BaseURL:      defaultGithubBaseURL,
+		APIURL:       defaultGithubAPIURL,
 	}
-	if err := json.NewDecoder(tokenResp.Body).Decode(&tokenData); err != nil {
-		return nil, fmt.Errorf("failed to decode token response: %v", err)
+	if base := os.Getenv("GITHUB_BASE_URL"); base != "" {
+		p.BaseURL = strings.TrimSuffix(base, "/")
+	}
+	if base := os.Getenv("GITHUB_API_URL"); base != "" {
+		p.APIURL = strings.TrimSuffix(base, "/")
 	}
+	return p
+}
 
-	// Get user data
-	userReq, _ := http.NewRequest("GET", githubUserURL, nil)
-	userReq.Header.Add("Authorization", "token "+tokenData.AccessToken)
+func (p *GithubProvider) Name() string        { return "github" }
+func (p *GithubProvider) DisplayName() string { return "GitHub" }
+
+// AuthURL ignores redirectURL; GitHub uses the callback URL registered with
+// the OAuth app
+func (p *GithubProvider) AuthURL(state, codeVerifier, redirectURL string) (string, error) {
+	q := url.Values{}
+	q.Set("client_id", p.ClientID)
+	q.Set("scope", "user:email")
+	q.Set("state", state)
+	q.Set("code_challenge", PKCEChallenge(codeVerifier))
+	q.Set("code_challenge_method", "S256")
+	return p.BaseURL + "/login/oauth/authorize?" + q.Encode(), nil
+}
+
+func (p *GithubProvider) Exchange(code, codeVerifier, redirectURL string) (*OAuthToken, error) {
+	form := url.Values{}
+	form.Set("client_id", p.ClientID)
+	form.Set("client_secret", p.ClientSecret)
+	form.Set("code", code)
+	form.Set("code_verifier", codeVerifier)
+	return exchangeCode(p.BaseURL+"/login/oauth/access_token", form)
+}
+
+func (p *GithubProvider) FetchProfile(token *OAuthToken) (*models.ExternalIdentity, error) {
+	userReq, err := http.NewRequest("GET", p.APIURL+"/user", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user request: %v", err)
+	}
+	userReq.Header.Add("Authorization", "token "+token.AccessToken)
 	userReq.Header.Add("Accept", "application/json")
 
-	userResp, err := http.DefaultClient.Do(userReq)
+	userResp, err := oauthClient.Do(userReq)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user data: %v", err)
 	}
 	defer userResp.Body.Close()
 
+	if userResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("user endpoint returned status: %d", userResp.StatusCode)
+	}
+
 	var user models.GithubUser
 	if err := json.NewDecoder(userResp.Body).Decode(&user); err != nil {
 		return nil, fmt.Errorf("failed to decode user data: %v", err)
 	}
+	if user.ID == 0 {
+		return nil, fmt.Errorf("user data did not include an ID")
+	}
+
+	return &models.ExternalIdentity{
+		Provider:  p.Name(),
+		Subject:   strconv.Itoa(user.ID),
+		Username:  user.Login,
+		Name:      user.Name,
+		Email:     user.Email,
+		AvatarURL: user.AvatarURL,
+	}, nil
+}
+
+// exchangeCode posts an authorization code grant to a token endpoint
+func exchangeCode(tokenURL string, form url.Values) (*OAuthToken, error) {
+	form.Set("grant_type", "authorization_code")
+
+	tokenReq, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token request: %v", err)
+	}
+	tokenReq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.Header.Add("Accept", "application/json")
+
+	tokenResp, err := oauthClient.Do(tokenReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token: %v", err)
+	}
+	defer tokenResp.Body.Close()
+
+	// Errors come back as an error field, with a 400 status from
+	// spec-compliant servers and a 200 status from GitHub
+	var tokenData struct {
+		AccessToken      string `json:"access_token"`
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(tokenResp.Body).Decode(&tokenData); err != nil {
+		return nil, fmt.Errorf("failed to decode token response (status %d): %v", tokenResp.StatusCode, err)
+	}
+	if tokenData.Error != "" {
+		return nil, fmt.Errorf("token exchange failed: %s: %s", tokenData.Error, tokenData.ErrorDescription)
+	}
+	if tokenResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned status: %d", tokenResp.StatusCode)
+	}
+	if tokenData.AccessToken == "" {
+		return nil, fmt.Errorf("token response did not include an access token")
+	}
 
-	return &user, nil
+	return &OAuthToken{
+		AccessToken: tokenData.AccessToken,
+		IDToken:     tokenData.IDToken,
+	}, nil
 }
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"quizapp/models"
+)
+
+// OIDCProvider logs users in with any OpenID Connect provider. Endpoints
+// are read from the issuer's discovery document on first use.
+type OIDCProvider struct {
+	ID           string
+	Label        string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	discoveryOnce sync.Once
+	discovery     *oidcDiscovery
+	discoveryErr  error
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// NewOIDCProviderFromEnv configures an OpenID Connect provider from
+// OIDC_ISSUER, OIDC_CLIENT_ID and OIDC_CLIENT_SECRET. OIDC_NAME,
+// OIDC_DISPLAY_NAME and OIDC_SCOPES are optional. It returns nil when no
+// issuer is configured.
+func NewOIDCProviderFromEnv() *OIDCProvider {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+
+	p := &OIDCProvider{
+		ID:           "oidc",
+		Label:        "Single Sign-On",
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		Scopes:       []string{"openid", "profile", "email"},
+	}
+	if name := os.Getenv("OIDC_NAME"); name != "" {
+		p.ID = name
+	}
+	if label := os.Getenv("OIDC_DISPLAY_NAME"); label != "" {
+		p.Label = label
+	}
+	if scopes := os.Getenv("OIDC_SCOPES"); scopes != "" {
+		p.Scopes = strings.Fields(scopes)
+	}
+	return p
+}
+
+func (p *OIDCProvider) Name() string        { return p.ID }
+func (p *OIDCProvider) DisplayName() string { return p.Label }
+
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.discoveryOnce.Do(func() {
+		resp, err := oauthClient.Get(p.Issuer + "/.well-known/openid-configuration")
+		if err != nil {
+			p.discoveryErr = fmt.Errorf("failed to fetch discovery document: %v", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			p.discoveryErr = fmt.Errorf("discovery endpoint returned status: %d", resp.StatusCode)
+			return
+		}
+
+		var doc oidcDiscovery
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			p.discoveryErr = fmt.Errorf("failed to decode discovery document: %v", err)
+			return
+		}
+		if strings.TrimSuffix(doc.Issuer, "/") != p.Issuer {
+			p.discoveryErr = fmt.Errorf("discovery document issuer %q does not match %q", doc.Issuer, p.Issuer)
+			return
+		}
+		if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.UserinfoEndpoint == "" {
+			p.discoveryErr = fmt.Errorf("discovery document is missing required endpoints")
+			return
+		}
+		p.discovery = &doc
+	})
+	return p.discovery, p.discoveryErr
+}
+
+func (p *OIDCProvider) AuthURL(state, codeVerifier, redirectURL string) (string, error) {
+	doc, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", redirectURL)
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", state)
+	q.Set("code_challenge", PKCEChallenge(codeVerifier))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return doc.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+func (p *OIDCProvider) Exchange(code, codeVerifier, redirectURL string) (*OAuthToken, error) {
+	doc, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("client_id", p.ClientID)
+	form.Set("client_secret", p.ClientSecret)
+	form.Set("code", code)
+	form.Set("code_verifier", codeVerifier)
+	form.Set("redirect_uri", redirectURL)
+	return exchangeCode(doc.TokenEndpoint, form)
+}
+
+// FetchProfile reads the user's claims from the userinfo endpoint rather
+// than trusting the unverified ID token
+func (p *OIDCProvider) FetchProfile(token *OAuthToken) (*models.ExternalIdentity, error) {
+	doc, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", doc.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create userinfo request: %v", err)
+	}
+	req.Header.Add("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Add("Accept", "application/json")
+
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get userinfo: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo endpoint returned status: %d", resp.StatusCode)
+	}
+
+	var claims struct {
+		Subject           string `json:"sub"`
+		PreferredUsername string `json:"preferred_username"`
+		Name              string `json:"name"`
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		Picture           string `json:"picture"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("failed to decode userinfo: %v", err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("userinfo did not include a subject")
+	}
+
+	identity := &models.ExternalIdentity{
+		Provider:  p.Name(),
+		Subject:   claims.Subject,
+		Username:  claims.PreferredUsername,
+		Name:      claims.Name,
+		AvatarURL: claims.Picture,
+	}
+	// Unverified addresses must not be used to match existing accounts
+	if claims.EmailVerified {
+		identity.Email = claims.Email
+	}
+	if identity.Username == "" {
+		identity.Username = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	return identity, nil
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"quizapp/models"
+)
+
+// OAuthToken is the result of exchanging an authorization code
+type OAuthToken struct {
+	AccessToken string
+	IDToken     string
+}
+
+// Provider is an external identity provider users can log in with
+type Provider interface {
+	// Name is the provider's URL-safe identifier, e.g. "github"
+	Name() string
+	// DisplayName is shown on the login page
+	DisplayName() string
+	// AuthURL returns the URL to send the user to for authorization
+	AuthURL(state, codeVerifier, redirectURL string) (string, error)
+	// Exchange trades an authorization code for tokens
+	Exchange(code, codeVerifier, redirectURL string) (*OAuthToken, error)
+	// FetchProfile returns the identity of the user the token belongs to
+	FetchProfile(token *OAuthToken) (*models.ExternalIdentity, error)
+}
+
+var (
+	providers    = make(map[string]Provider)
+	providersMux sync.RWMutex
+)
+
+// RegisterProvider makes a provider available for login
+func RegisterProvider(p Provider) {
+	providersMux.Lock()
+	providers[p.Name()] = p
+	providersMux.Unlock()
+}
+
+// GetProvider returns the registered provider with the given name
+func GetProvider(name string) (Provider, error) {
+	providersMux.RLock()
+	defer providersMux.RUnlock()
+
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider: %s", name)
+	}
+	return p, nil
+}
+
+// Providers returns all registered providers sorted by name
+func Providers() []Provider {
+	providersMux.RLock()
+	defer providersMux.RUnlock()
+
+	list := make([]Provider, 0, len(providers))
+	for _, p := range providers {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name() < list[j].Name()
+	})
+	return list
+}
@@ -17,6 +17,12 @@ const (
 	categoryURL = "https://opentdb.com/api_category.php"
 )
 
+// Types of OpenTDB question
+const (
+	TriviaMultiple = "multiple"
+	TriviaBoolean  = "boolean"
+)
+
 type TriviaCategory struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"`
@@ -162,12 +168,20 @@ func FetchQuizQuestions(categoryID int, difficulty string, amount int) ([]Trivia
 // Helper function to shuffle answers
 func ShuffleAnswers(question *TriviaQuestion) []string {
 	allAnswers := append([]string{question.CorrectAnswer}, question.IncorrectAnswers...)
+	return ShuffleOptions(allAnswers, rand.Int63())
+}
+
+// ShuffleOptions returns a shuffled copy of options. The same seed always
+// produces the same order, so an attempt can be replayed for review.
+func ShuffleOptions[T any](options []T, seed int64) []T {
+	shuffled := append([]T(nil), options...)
+	rng := rand.New(rand.NewSource(seed))
 	// Fisher-Yates shuffle
-	for i := len(allAnswers) - 1; i > 0; i-- {
-		j := rand.Intn(i + 1)
-		allAnswers[i], allAnswers[j] = allAnswers[j], allAnswers[i]
+	for i := len(shuffled) - 1; i > 0; i-- {
+		j := rng.Intn(i + 1)
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
 	}
-	return allAnswers
+	return shuffled
 }
 
 // Helper function to check if a string is base64 encoded
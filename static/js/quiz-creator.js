@@ -7,6 +7,11 @@ function showError(message) {
     setTimeout(() => errorDiv.remove(), 3000);
 }
 
+function csrfToken() {
+    const meta = document.querySelector('meta[name="csrf-token"]');
+    return meta ? meta.content : '';
+}
+
 document.getElementById('quiz-form').addEventListener('submit', async (e) => {
     e.preventDefault();
     
@@ -21,7 +26,8 @@ document.getElementById('quiz-form').addEventListener('submit', async (e) => {
         const response = await fetch('/admin/create-quiz', {
             method: 'POST',
             headers: {
-                'Content-Type': 'application/json'
+                'Content-Type': 'application/json',
+                'X-CSRF-Token': csrfToken()
             },
             body: JSON.stringify(formData)
         });